@@ -0,0 +1,240 @@
+package apierror
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Code is a stable, machine-readable error identifier. Clients branch on the
+// code; the message is for people and may change.
+type Code string
+
+const (
+	// 400
+	ValidationFailed        Code = "VALIDATION_FAILED"
+	PackCurrencyUnavailable Code = "PACK_CURRENCY_UNAVAILABLE"
+	CouponCodeUnknown       Code = "COUPON_CODE_UNKNOWN"
+	CouponInactive          Code = "COUPON_INACTIVE"
+	CouponNotStarted        Code = "COUPON_NOT_STARTED"
+	CouponExpired           Code = "COUPON_EXPIRED"
+	CouponExhausted         Code = "COUPON_EXHAUSTED"
+	CouponCustomerLimit     Code = "COUPON_CUSTOMER_LIMIT_REACHED"
+	CouponPackNotEligible   Code = "COUPON_PACK_NOT_ELIGIBLE"
+	CouponCurrencyMismatch  Code = "COUPON_CURRENCY_MISMATCH"
+	SetupTokenInvalid       Code = "SETUP_TOKEN_INVALID"
+	InvitationInvalid       Code = "INVITATION_INVALID"
+	LoginChallengeInvalid   Code = "LOGIN_CHALLENGE_INVALID"
+	MFAEnrollmentNotStarted Code = "MFA_ENROLLMENT_NOT_STARTED"
+	IdentityEmailMissing    Code = "IDENTITY_EMAIL_MISSING"
+	IdempotencyKeyInvalid   Code = "IDEMPOTENCY_KEY_INVALID"
+
+	// 401
+	AuthenticationRequired Code = "AUTHENTICATION_REQUIRED"
+	InvalidToken           Code = "INVALID_TOKEN"
+	InvalidCredentials     Code = "INVALID_CREDENTIALS"
+	InvalidAPIKey          Code = "INVALID_API_KEY"
+	InvalidMFACode         Code = "INVALID_MFA_CODE"
+	SSOFailed              Code = "SSO_FAILED"
+
+	// 403
+	Forbidden         Code = "FORBIDDEN"
+	PermissionDenied  Code = "PERMISSION_DENIED"
+	InsufficientScope Code = "INSUFFICIENT_SCOPE"
+	AccountDisabled   Code = "ACCOUNT_DISABLED"
+	MFARequired       Code = "MFA_REQUIRED"
+	SelfActionDenied  Code = "SELF_ACTION_DENIED"
+
+	// 404
+	NotFound             Code = "NOT_FOUND"
+	CustomerNotFound     Code = "CUSTOMER_NOT_FOUND"
+	PackNotFound         Code = "PACK_NOT_FOUND"
+	PriceNotFound        Code = "PRICE_NOT_FOUND"
+	SubscriptionNotFound Code = "SUBSCRIPTION_NOT_FOUND"
+	NoActiveSubscription Code = "NO_ACTIVE_SUBSCRIPTION"
+	CouponNotFound       Code = "COUPON_NOT_FOUND"
+	MemberNotFound       Code = "MEMBER_NOT_FOUND"
+	InvitationNotFound   Code = "INVITATION_NOT_FOUND"
+	UserNotFound         Code = "USER_NOT_FOUND"
+	AdminNotFound        Code = "ADMIN_NOT_FOUND"
+	APIKeyNotFound       Code = "API_KEY_NOT_FOUND"
+	OAuthClientNotFound  Code = "OAUTH_CLIENT_NOT_FOUND"
+	SSONotConfigured     Code = "SSO_NOT_CONFIGURED"
+	JobNotFound          Code = "JOB_NOT_FOUND"
+
+	// 409
+	EmailAlreadyRegistered    Code = "EMAIL_ALREADY_REGISTERED"
+	AccountKindConflict       Code = "ACCOUNT_KIND_CONFLICT"
+	IdentityEmailUnverified   Code = "IDENTITY_EMAIL_UNVERIFIED"
+	SKUAlreadyExists          Code = "SKU_ALREADY_EXISTS"
+	CouponCodeAlreadyExists   Code = "COUPON_CODE_ALREADY_EXISTS"
+	SubscriptionAlreadyActive Code = "SUBSCRIPTION_ALREADY_ACTIVE"
+	SubscriptionNotRequested  Code = "SUBSCRIPTION_NOT_REQUESTED"
+	SubscriptionNotActive     Code = "SUBSCRIPTION_NOT_ACTIVE"
+	PackInUse                 Code = "PACK_IN_USE"
+	CustomerErased            Code = "CUSTOMER_ERASED"
+	LastPrice                 Code = "LAST_PRICE"
+	LastOwner                 Code = "LAST_OWNER"
+	LastSuperAdmin            Code = "LAST_SUPER_ADMIN"
+	MFAAlreadyEnabled         Code = "MFA_ALREADY_ENABLED"
+	MFANotEnabled             Code = "MFA_NOT_ENABLED"
+	IdempotencyKeyInProgress  Code = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	ConcurrentUpdate          Code = "CONCURRENT_UPDATE"
+
+	// 412
+	PreconditionFailed Code = "PRECONDITION_FAILED"
+
+	// 413
+	PayloadTooLarge Code = "PAYLOAD_TOO_LARGE"
+
+	// 415
+	UnsupportedMediaType Code = "UNSUPPORTED_MEDIA_TYPE"
+
+	// 422
+	IdempotencyKeyReused Code = "IDEMPOTENCY_KEY_REUSED"
+
+	// 429
+	RateLimited          Code = "RATE_LIMITED"
+	TooManyLoginAttempts Code = "TOO_MANY_LOGIN_ATTEMPTS"
+
+	// 5xx
+	Internal                    Code = "INTERNAL_ERROR"
+	IdentityProviderUnavailable Code = "IDENTITY_PROVIDER_UNAVAILABLE"
+)
+
+// statuses maps every code to the HTTP status it is sent with
+var statuses = map[Code]int{
+	ValidationFailed:        http.StatusBadRequest,
+	PackCurrencyUnavailable: http.StatusBadRequest,
+	CouponCodeUnknown:       http.StatusBadRequest,
+	CouponInactive:          http.StatusBadRequest,
+	CouponNotStarted:        http.StatusBadRequest,
+	CouponExpired:           http.StatusBadRequest,
+	CouponExhausted:         http.StatusBadRequest,
+	CouponCustomerLimit:     http.StatusBadRequest,
+	CouponPackNotEligible:   http.StatusBadRequest,
+	CouponCurrencyMismatch:  http.StatusBadRequest,
+	SetupTokenInvalid:       http.StatusBadRequest,
+	InvitationInvalid:       http.StatusBadRequest,
+	LoginChallengeInvalid:   http.StatusBadRequest,
+	MFAEnrollmentNotStarted: http.StatusBadRequest,
+	IdentityEmailMissing:    http.StatusBadRequest,
+	IdempotencyKeyInvalid:   http.StatusBadRequest,
+
+	AuthenticationRequired: http.StatusUnauthorized,
+	InvalidToken:           http.StatusUnauthorized,
+	InvalidCredentials:     http.StatusUnauthorized,
+	InvalidAPIKey:          http.StatusUnauthorized,
+	InvalidMFACode:         http.StatusUnauthorized,
+	SSOFailed:              http.StatusUnauthorized,
+
+	Forbidden:         http.StatusForbidden,
+	PermissionDenied:  http.StatusForbidden,
+	InsufficientScope: http.StatusForbidden,
+	AccountDisabled:   http.StatusForbidden,
+	MFARequired:       http.StatusForbidden,
+	SelfActionDenied:  http.StatusForbidden,
+
+	NotFound:             http.StatusNotFound,
+	CustomerNotFound:     http.StatusNotFound,
+	PackNotFound:         http.StatusNotFound,
+	PriceNotFound:        http.StatusNotFound,
+	SubscriptionNotFound: http.StatusNotFound,
+	NoActiveSubscription: http.StatusNotFound,
+	CouponNotFound:       http.StatusNotFound,
+	MemberNotFound:       http.StatusNotFound,
+	InvitationNotFound:   http.StatusNotFound,
+	UserNotFound:         http.StatusNotFound,
+	AdminNotFound:        http.StatusNotFound,
+	APIKeyNotFound:       http.StatusNotFound,
+	OAuthClientNotFound:  http.StatusNotFound,
+	SSONotConfigured:     http.StatusNotFound,
+	JobNotFound:          http.StatusNotFound,
+
+	EmailAlreadyRegistered:    http.StatusConflict,
+	AccountKindConflict:       http.StatusConflict,
+	IdentityEmailUnverified:   http.StatusConflict,
+	SKUAlreadyExists:          http.StatusConflict,
+	CouponCodeAlreadyExists:   http.StatusConflict,
+	SubscriptionAlreadyActive: http.StatusConflict,
+	SubscriptionNotRequested:  http.StatusConflict,
+	SubscriptionNotActive:     http.StatusConflict,
+	PackInUse:                 http.StatusConflict,
+	CustomerErased:            http.StatusConflict,
+	LastPrice:                 http.StatusConflict,
+	LastOwner:                 http.StatusConflict,
+	LastSuperAdmin:            http.StatusConflict,
+	MFAAlreadyEnabled:         http.StatusConflict,
+	MFANotEnabled:             http.StatusConflict,
+	IdempotencyKeyInProgress:  http.StatusConflict,
+	ConcurrentUpdate:          http.StatusConflict,
+
+	PreconditionFailed: http.StatusPreconditionFailed,
+
+	PayloadTooLarge: http.StatusRequestEntityTooLarge,
+
+	UnsupportedMediaType: http.StatusUnsupportedMediaType,
+
+	IdempotencyKeyReused: http.StatusUnprocessableEntity,
+
+	RateLimited:          http.StatusTooManyRequests,
+	TooManyLoginAttempts: http.StatusTooManyRequests,
+
+	Internal:                    http.StatusInternalServerError,
+	IdentityProviderUnavailable: http.StatusBadGateway,
+}
+
+// Status returns the HTTP status a code is sent with
+func (code Code) Status() int {
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// FieldError describes one invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// Error is an error that is safe to send to the client as is
+type Error struct {
+	Code    Code
+	Message string
+	Details []FieldError
+}
+
+func (e *Error) Error() string { return string(e.Code) + ": " + e.Message }
+
+// Status returns the HTTP status the error is sent with
+func (e *Error) Status() int { return e.Code.Status() }
+
+// New returns an error with a code and a message for people
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Fields returns a VALIDATION_FAILED error listing invalid fields
+func Fields(details ...FieldError) *Error {
+	return &Error{Code: ValidationFailed, Message: "Request validation failed", Details: details}
+}
+
+// Abort records err for the Errors middleware to render and stops the
+// handler chain. Handlers return right after calling it.
+func Abort(c *gin.Context, err *Error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// AbortCode is Abort with a new error
+func AbortCode(c *gin.Context, code Code, message string) {
+	Abort(c, New(code, message))
+}
+
+// AbortBind is Abort for a request that failed to bind, listing the invalid
+// fields without exposing validator or decoder internals
+func AbortBind(c *gin.Context, err error) {
+	Abort(c, Validation(err))
+}
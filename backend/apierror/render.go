@@ -0,0 +1,64 @@
+package apierror
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// ProblemContentType is the RFC 7807 media type
+const ProblemContentType = "application/problem+json"
+
+// WantsProblem reports whether the client asked for RFC 7807 errors
+func WantsProblem(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), ProblemContentType)
+}
+
+// Render writes err to the client, as an RFC 7807 problem document when
+// problem is set and in the API's usual envelope otherwise:
+//
+//	{"success": false, "code": "PACK_NOT_FOUND", "message": "...", "details": [...]}
+func Render(c *gin.Context, err *Error, problem bool) {
+	status := err.Status()
+
+	if !problem {
+		body := gin.H{"success": false, "code": err.Code, "message": err.Message}
+		if len(err.Details) > 0 {
+			body["details"] = err.Details
+		}
+		c.JSON(status, body)
+		return
+	}
+
+	body := gin.H{
+		"type":     "urn:license-mnm:error:" + string(err.Code),
+		"title":    http.StatusText(status),
+		"status":   status,
+		"detail":   err.Message,
+		"instance": c.Request.URL.Path,
+		"code":     err.Code,
+	}
+	if len(err.Details) > 0 {
+		body["errors"] = err.Details
+	}
+	if requestID := c.GetString("request_id"); requestID != "" {
+		body["request_id"] = requestID
+	}
+	c.Render(status, problemJSON{body})
+}
+
+// problemJSON renders JSON with the problem+json content type
+type problemJSON struct {
+	data any
+}
+
+func (r problemJSON) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	return render.JSON{Data: r.data}.Render(w)
+}
+
+func (r problemJSON) WriteContentType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", ProblemContentType)
+}
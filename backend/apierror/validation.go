@@ -0,0 +1,136 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+func init() {
+	// Report fields by the names clients send, not the Go struct field names
+	if validate, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+			for _, tag := range []string{"json", "form"} {
+				name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+				if name == "-" {
+					return ""
+				}
+				if name != "" {
+					return name
+				}
+			}
+			return field.Name
+		})
+	}
+}
+
+// Validation turns a binding error into a VALIDATION_FAILED error with one
+// detail per invalid field
+func Validation(err error) *Error {
+	apiErr := New(ValidationFailed, "Request validation failed")
+
+	var validationErrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &validationErrs):
+		for _, fe := range validationErrs {
+			apiErr.Details = append(apiErr.Details, FieldError{
+				Field:   fieldPath(fe),
+				Rule:    fe.Tag(),
+				Message: ruleMessage(fe),
+			})
+		}
+	case errors.As(err, &typeErr):
+		apiErr.Details = []FieldError{{
+			Field:   typeErr.Field,
+			Rule:    "type",
+			Message: "must be a " + jsonType(typeErr.Type),
+		}}
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		apiErr.Message = "Request body is not valid JSON"
+	case errors.Is(err, io.EOF):
+		apiErr.Message = "Request body is required"
+	default:
+		apiErr.Message = "Request body is invalid"
+	}
+	return apiErr
+}
+
+// fieldPath is the field's path in the request, e.g. "prices[0].currency"
+func fieldPath(fe validator.FieldError) string {
+	// The namespace starts with the struct's type name, which clients never
+	// see, unless the request is an anonymous struct. The type name is the
+	// one segment the tag name function doesn't rename.
+	typeName, path, found := strings.Cut(fe.Namespace(), ".")
+	structTypeName, _, _ := strings.Cut(fe.StructNamespace(), ".")
+	if found && typeName == structTypeName {
+		return path
+	}
+	return fe.Namespace()
+}
+
+// ruleMessage describes the rule a field broke
+func ruleMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "url", "http_url":
+		return "must be a valid URL"
+	case "oneof":
+		return "must be one of: " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "alpha":
+		return "must contain only letters"
+	case "len":
+		if fe.Kind() == reflect.String {
+			return "must be exactly " + fe.Param() + " characters"
+		}
+		return "must have exactly " + fe.Param() + " items"
+	case "min", "gte":
+		if fe.Kind() == reflect.String {
+			return "must be at least " + fe.Param() + " characters"
+		}
+		if fe.Kind() == reflect.Slice || fe.Kind() == reflect.Map {
+			return "must have at least " + fe.Param() + " items"
+		}
+		return "must be at least " + fe.Param()
+	case "max", "lte":
+		if fe.Kind() == reflect.String {
+			return "must be at most " + fe.Param() + " characters"
+		}
+		if fe.Kind() == reflect.Slice || fe.Kind() == reflect.Map {
+			return "must have at most " + fe.Param() + " items"
+		}
+		return "must be at most " + fe.Param()
+	case "gt":
+		return "must be greater than " + fe.Param()
+	case "lt":
+		return "must be less than " + fe.Param()
+	}
+	return "failed the " + fe.Tag() + " check"
+}
+
+// jsonType names a Go type the way a JSON client thinks of it
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	}
+	return "object"
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"license-mnm/sso/mockidp"
+)
+
+// A stand-in OpenID Connect identity provider for trying single sign-on
+// locally, without a network connection or a real IdP. Every authorization
+// request is approved at once for the identity given by the flags; the
+// email, name and groups can be overridden per request with login_hint-style
+// query parameters mock_email, mock_name and mock_groups.
+//
+// Usage:
+//
+//	go run cmd/mockidp/main.go -addr :9000 -email alice@example.com -groups it-admins
+//
+// then start the server with
+//
+//	OIDC_ISSUER_URL=http://localhost:9000 OIDC_CLIENT_ID=license-mnm \
+//	OIDC_REDIRECT_URL=http://localhost:8080/api/auth/oidc/callback \
+//	OIDC_ADMIN_ROLE_GROUPS=it-admins=super_admin go run main.go
+//
+// and open http://localhost:8080/api/auth/oidc/admin/login.
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "", "issuer URL (default http://localhost<addr>)")
+	email := flag.String("email", "user@example.com", "email of the signed-in identity")
+	name := flag.String("name", "Test User", "name of the signed-in identity")
+	groups := flag.String("groups", "", "comma-separated groups of the signed-in identity")
+	flag.Parse()
+
+	if *issuer == "" {
+		*issuer = "http://localhost" + *addr
+	}
+
+	idp, err := mockidp.New(*email, *name, mockidp.SplitGroups(*groups))
+	if err != nil {
+		log.Fatal("Failed to generate signing key:", err)
+	}
+	idp.Issuer = *issuer
+
+	log.Printf("Mock identity provider %s signing in %s (groups %v)", idp.Issuer, idp.Email, idp.Groups)
+	log.Fatal(http.ListenAndServe(*addr, idp))
+}
@@ -1,15 +1,31 @@
 package main
 
 import (
+	"flag"
 	"license-mnm/database"
 	"license-mnm/models"
+	"license-mnm/rbac"
 	"license-mnm/utils"
 	"log"
+	"os"
 )
 
-// Run this once to create an admin user
-// Usage: go run cmd/seed/main.go
+// Run this once to create the first super admin
+// Usage: go run cmd/seed/main.go -email admin@example.com -password 'a-strong-password'
+// The credentials can also be given as ADMIN_EMAIL and ADMIN_PASSWORD.
 func main() {
+	email := flag.String("email", os.Getenv("ADMIN_EMAIL"), "admin email (env ADMIN_EMAIL)")
+	password := flag.String("password", os.Getenv("ADMIN_PASSWORD"), "admin password (env ADMIN_PASSWORD)")
+	flag.Parse()
+
+	if *email == "" || *password == "" {
+		flag.Usage()
+		log.Fatal("Admin email and password are required")
+	}
+	if len(*password) < 8 {
+		log.Fatal("Admin password must be at least 8 characters")
+	}
+
 	// Initialize database
 	if err := database.InitDB(); err != nil {
 		log.Fatal("Failed to connect to database:", err)
@@ -17,21 +33,21 @@ func main() {
 
 	// Check if admin already exists
 	var existingAdmin models.User
-	if err := database.DB.Where("email = ? AND role = ?", "admin@example.com", "admin").First(&existingAdmin).Error; err == nil {
-		log.Println("Admin user already exists")
+	if err := database.DB.Where("email = ?", *email).First(&existingAdmin).Error; err == nil {
+		log.Println("User already exists:", *email)
 		return
 	}
 
 	// Create admin user
-	hashedPassword, err := utils.HashPassword("admin123")
+	hashedPassword, err := utils.HashPassword(*password)
 	if err != nil {
 		log.Fatal("Failed to hash password:", err)
 	}
 
 	admin := models.User{
-		Email:        "admin@example.com",
+		Email:        *email,
 		PasswordHash: hashedPassword,
-		Role:         "admin",
+		Role:         rbac.RoleSuperAdmin,
 	}
 
 	if err := database.DB.Create(&admin).Error; err != nil {
@@ -39,13 +55,5 @@ func main() {
 	}
 
 	log.Println("Admin user created successfully!")
-	log.Println("Email: admin@example.com")
-	log.Println("Password: admin123")
+	log.Println("Email:", *email)
 }
-
-
-
-
-
-
-
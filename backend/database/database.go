@@ -1,33 +1,113 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"license-mnm/models"
+	"license-mnm/tracing"
+	"license-mnm/utils"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 var DB *gorm.DB
 
+// schema lists the models AutoMigrate manages; Ready checks their tables exist
+var schema = []interface{}{
+	&models.User{},
+	&models.Customer{},
+	&models.SubscriptionPack{},
+	&models.Subscription{},
+	&models.PackPrice{},
+	&models.PackPriceHistory{},
+	&models.Coupon{},
+	&models.CouponRedemption{},
+	&models.CustomerMember{},
+	&models.CustomerInvitation{},
+	&models.PasswordSetupToken{},
+	&models.MFARecoveryCode{},
+	&models.Setting{},
+	&models.LoginAttempt{},
+	&models.AuditLog{},
+	&models.UserIdentity{},
+	&models.OIDCLoginState{},
+	&models.APIKey{},
+	&models.OAuthClient{},
+	&models.IdempotencyKey{},
+	&models.Job{},
+}
+
+// migrated is set once InitDB has brought the schema up to date
+var migrated atomic.Bool
+
+// defaultConnectTimeout is how long InitDB retries an unavailable database
+// unless DB_CONNECT_TIMEOUT (e.g. "1m") says otherwise
+const defaultConnectTimeout = 30 * time.Second
+
 // InitDB initializes the database connection
 func InitDB() error {
 	var err error
-	DB, err = gorm.Open(sqlite.Open("license_mnm.db"), &gorm.Config{})
+	DB, err = connect()
 	if err != nil {
 		return err
 	}
 
+	// Trace queries as child spans of the request that runs them
+	if err := DB.Use(tracing.GormPlugin{}); err != nil {
+		return err
+	}
+
+	if err := dropStaleSearchTriggers(); err != nil {
+		return err
+	}
+
 	// Auto-migrate all models
-	err = DB.AutoMigrate(
-		&models.User{},
-		&models.Customer{},
-		&models.SubscriptionPack{},
-		&models.Subscription{},
-	)
+	err = DB.AutoMigrate(schema...)
 	if err != nil {
 		return err
 	}
 
+	if err := migrateLegacyPrices(); err != nil {
+		return err
+	}
+
+	// Deployments from before staff roles existed only have plain admins;
+	// promote the oldest one so someone can manage admin accounts
+	err = DB.Exec(`UPDATE users SET role = 'super_admin'
+		WHERE id = (SELECT MIN(id) FROM users WHERE role = 'admin')
+		AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'super_admin')`).Error
+	if err != nil {
+		return err
+	}
+
+	// Every customer created before organizations existed is owned by its own user
+	err = DB.Exec(`INSERT INTO customer_members (customer_id, user_id, role, created_at, updated_at)
+		SELECT id, user_id, 'owner', created_at, updated_at FROM customers
+		WHERE user_id NOT IN (SELECT user_id FROM customer_members)`).Error
+	if err != nil {
+		return err
+	}
+
+	// Number redemptions from before per-customer slots existed, so the
+	// unique index below can enforce MaxRedemptionsPerCustomer
+	err = DB.Exec(`UPDATE coupon_redemptions SET seq = (SELECT COUNT(*) FROM coupon_redemptions AS earlier
+		WHERE earlier.coupon_id = coupon_redemptions.coupon_id AND earlier.customer_id = coupon_redemptions.customer_id
+		AND earlier.id <= coupon_redemptions.id) WHERE seq = 0`).Error
+	if err != nil {
+		return err
+	}
+	if err := DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_coupon_redemptions_slot ON coupon_redemptions(coupon_id, customer_id, seq)").Error; err != nil {
+		return err
+	}
+
 	// Create indexes
 	DB.Exec("CREATE INDEX IF NOT EXISTS idx_users_email ON users(email)")
 	DB.Exec("CREATE INDEX IF NOT EXISTS idx_customers_user_id ON customers(user_id)")
@@ -36,12 +116,132 @@ func InitDB() error {
 	DB.Exec("CREATE INDEX IF NOT EXISTS idx_subscriptions_status ON subscriptions(status)")
 	DB.Exec("CREATE INDEX IF NOT EXISTS idx_subscription_packs_sku ON subscription_packs(sku)")
 
+	if err := setupCustomerSearch(); err != nil {
+		return err
+	}
+
+	migrated.Store(true)
 	return nil
 }
 
+// connect opens the database, retrying with backoff while it is unavailable
+func connect() (*gorm.DB, error) {
+	timeout := defaultConnectTimeout
+	if value, err := time.ParseDuration(os.Getenv("DB_CONNECT_TIMEOUT")); err == nil {
+		timeout = value
+	}
+	deadline := time.Now().Add(timeout)
 
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		path = "license_mnm.db"
+	}
 
+	wait := 500 * time.Millisecond
+	for {
+		db, err := gorm.Open(sqlite.Open(path), &gorm.Config{
+			// Unique violations come back as gorm.ErrDuplicatedKey
+			TranslateError: true,
+			// Slow queries and errors go to the structured log; callers handle not-found
+			Logger: logger.New(slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn), logger.Config{
+				SlowThreshold:             200 * time.Millisecond,
+				LogLevel:                  logger.Warn,
+				IgnoreRecordNotFoundError: true,
+			}),
+		})
+		if err == nil {
+			var sqlDB *sql.DB
+			if sqlDB, err = db.DB(); err == nil {
+				err = sqlDB.Ping()
+			}
+		}
+		if err == nil {
+			return db, nil
+		}
 
+		if time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		slog.Warn("database unavailable, retrying", "error", err, "retry_in", wait.String())
+		time.Sleep(wait)
+		wait = min(wait*2, 5*time.Second)
+	}
+}
 
+// Ready returns why the database can't serve requests, or nil: it must have
+// been migrated, answer a ping and still have every table
+func Ready(ctx context.Context) error {
+	if !migrated.Load() {
+		return errors.New("migrations have not run")
+	}
 
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return err
+	}
+
+	migrator := DB.WithContext(ctx).Migrator()
+	for _, model := range schema {
+		if !migrator.HasTable(model) {
+			return fmt.Errorf("table for %T is missing", model)
+		}
+	}
+	return nil
+}
 
+// Close closes the database connections
+func Close() error {
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// migrateLegacyPrices moves the old float subscription_packs.price column into
+// pack_prices as minor units in the default currency, then drops it
+func migrateLegacyPrices() error {
+	if !DB.Migrator().HasColumn(&models.SubscriptionPack{}, "price") {
+		return nil
+	}
+
+	currency := utils.DefaultCurrency()
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var legacy []struct {
+			ID        uint
+			Price     float64
+			UpdatedAt time.Time
+		}
+		if err := tx.Table("subscription_packs").Select("id, price, updated_at").Scan(&legacy).Error; err != nil {
+			return err
+		}
+
+		for _, pack := range legacy {
+			amount := utils.ToMinorUnits(pack.Price, currency)
+			price := models.PackPrice{PackID: pack.ID, Currency: currency, Amount: amount}
+			if err := tx.Where("pack_id = ? AND currency = ?", pack.ID, currency).FirstOrCreate(&price).Error; err != nil {
+				return err
+			}
+			history := models.PackPriceHistory{PackID: pack.ID, Currency: currency, Amount: &amount, EffectiveAt: pack.UpdatedAt}
+			if err := tx.Create(&history).Error; err != nil {
+				return err
+			}
+			// Best available record of what existing subscriptions were sold at
+			if err := tx.Model(&models.Subscription{}).Where("pack_id = ? AND (price_currency IS NULL OR price_currency = '')", pack.ID).
+				Updates(map[string]interface{}{"price_amount": amount, "price_currency": currency}).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Migrator().DropColumn(&models.SubscriptionPack{}, "price")
+	})
+	if err != nil {
+		return err
+	}
+
+	// SQLite rebuilds the table to drop a column, losing its indexes
+	return DB.AutoMigrate(&models.SubscriptionPack{})
+}
@@ -0,0 +1,31 @@
+// Package dbtest gives tests a migrated in-memory database.
+package dbtest
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"license-mnm/database"
+
+	"gorm.io/gorm"
+)
+
+// databases numbers the in-memory databases so tests never share one
+var databases atomic.Int64
+
+// Open points database.DB at a new in-memory SQLite database with the full
+// schema, closed when the test ends. Tests using it can't run in parallel.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	t.Setenv("DB_PATH", fmt.Sprintf("file:test%d?mode=memory&cache=shared&_busy_timeout=5000", databases.Add(1)))
+	if err := database.InitDB(); err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := database.Close(); err != nil {
+			t.Errorf("close test database: %v", err)
+		}
+	})
+	return database.DB
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"log/slog"
+	"sync/atomic"
+
+	"gorm.io/gorm"
+)
+
+// fullTextSearch is set when customer search uses the customer_search index
+var fullTextSearch atomic.Bool
+
+// FullTextSearch reports whether customers can be searched through the
+// customer_search FTS5 table. Without it, search falls back to LIKE.
+func FullTextSearch() bool {
+	return fullTextSearch.Load()
+}
+
+// customerSearchTriggers keep customer_search in step with the customers
+// and users tables
+var customerSearchTriggers = []struct{ name, sql string }{
+	{"customer_search_insert", `CREATE TRIGGER IF NOT EXISTS customer_search_insert AFTER INSERT ON customers BEGIN
+		INSERT INTO customer_search (rowid, name, email, phone)
+		SELECT NEW.id, NEW.name, users.email, NEW.phone FROM users WHERE users.id = NEW.user_id;
+	END`},
+	{"customer_search_update", `CREATE TRIGGER IF NOT EXISTS customer_search_update AFTER UPDATE OF name, phone, user_id ON customers BEGIN
+		DELETE FROM customer_search WHERE rowid = OLD.id;
+		INSERT INTO customer_search (rowid, name, email, phone)
+		SELECT NEW.id, NEW.name, users.email, NEW.phone FROM users WHERE users.id = NEW.user_id;
+	END`},
+	{"customer_search_delete", `CREATE TRIGGER IF NOT EXISTS customer_search_delete AFTER DELETE ON customers BEGIN
+		DELETE FROM customer_search WHERE rowid = OLD.id;
+	END`},
+	{"customer_search_email", `CREATE TRIGGER IF NOT EXISTS customer_search_email AFTER UPDATE OF email ON users BEGIN
+		UPDATE customer_search SET email = NEW.email WHERE rowid IN (SELECT id FROM customers WHERE user_id = NEW.id);
+	END`},
+}
+
+// fts5Available reports whether SQLite was built with FTS5
+// (go build -tags sqlite_fts5)
+func fts5Available() (bool, error) {
+	if DB.Dialector.Name() != "sqlite" {
+		return false, nil
+	}
+	var fts5 bool
+	err := DB.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5).Error
+	return fts5, err
+}
+
+// dropStaleSearchTriggers drops triggers left by a build with FTS5 when this
+// one lacks it; they would fail every customer write, and every migration
+// that renames a table. It runs before migrations.
+func dropStaleSearchTriggers() error {
+	fts5, err := fts5Available()
+	if err != nil || fts5 || DB.Dialector.Name() != "sqlite" {
+		return err
+	}
+	for _, trigger := range customerSearchTriggers {
+		if err := DB.Exec("DROP TRIGGER IF EXISTS " + trigger.name).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupCustomerSearch creates the customer_search full-text index when
+// SQLite has FTS5. The index is rebuilt whenever one of its triggers is
+// missing: on first use, after running a build without FTS5, or after a
+// migration rebuilt the customers table.
+func setupCustomerSearch() error {
+	fts5, err := fts5Available()
+	if err != nil {
+		return err
+	}
+	if !fts5 {
+		slog.Info("SQLite was built without FTS5; customer search scans the customers table")
+		return nil
+	}
+
+	var triggers int64
+	names := make([]string, len(customerSearchTriggers))
+	for i, trigger := range customerSearchTriggers {
+		names[i] = trigger.name
+	}
+	err = DB.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name IN ?", names).Scan(&triggers).Error
+	if err != nil {
+		return err
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS customer_search USING fts5(name, email, phone)").Error; err != nil {
+			return err
+		}
+		if triggers == int64(len(customerSearchTriggers)) {
+			return nil
+		}
+
+		for _, trigger := range customerSearchTriggers {
+			if err := tx.Exec(trigger.sql).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM customer_search").Error; err != nil {
+			return err
+		}
+		return tx.Exec(`INSERT INTO customer_search (rowid, name, email, phone)
+			SELECT customers.id, customers.name, users.email, customers.phone
+			FROM customers JOIN users ON users.id = customers.user_id`).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	fullTextSearch.Store(true)
+	return nil
+}
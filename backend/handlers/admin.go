@@ -1,38 +1,50 @@
 package handlers
 
 import (
+	"errors"
+	"license-mnm/apierror"
 	"license-mnm/database"
+	"license-mnm/metrics"
 	"license-mnm/models"
-	"license-mnm/utils"
+	"license-mnm/pagination"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 // GetDashboard returns admin dashboard data
 func GetDashboard(c *gin.Context) {
-	var totalCustomers int64
-	var activeSubscriptions int64
-	var pendingRequests int64
-	var totalRevenue float64
-
-	database.DB.Model(&models.Customer{}).Where("deleted_at IS NULL").Count(&totalCustomers)
-	database.DB.Model(&models.Subscription{}).Where("status = ?", "active").Count(&activeSubscriptions)
-	database.DB.Model(&models.Subscription{}).Where("status = ?", "requested").Count(&pendingRequests)
-
-	// Calculate total revenue from active subscriptions
-	var subscriptions []models.Subscription
-	database.DB.Where("status = ?", "active").Preload("Pack").Find(&subscriptions)
-	for _, sub := range subscriptions {
-		totalRevenue += sub.Pack.Price
+	// The same counts as the license_customers and license_subscriptions metrics
+	totalCustomers, err := metrics.CustomerCount(requestDB(c))
+	logDBError(c, "count customers", err)
+	subscriptionCounts, err := metrics.SubscriptionCounts(requestDB(c))
+	logDBError(c, "count subscriptions", err)
+
+	// Calculate total revenue from active subscriptions at the price they were sold at,
+	// per currency in minor units
+	var revenueRows []struct {
+		PriceCurrency string
+		Total         int64
+	}
+	err = requestDB(c).Model(&models.Subscription{}).Select("price_currency, SUM(price_amount) AS total").
+		Where("status = ?", "active").Group("price_currency").Scan(&revenueRows).Error
+	logDBError(c, "sum revenue", err)
+	totalRevenue := map[string]int64{}
+	for _, row := range revenueRows {
+		totalRevenue[row.PriceCurrency] = row.Total
 	}
 
 	// Get recent activities (last 10 subscriptions)
 	var recentActivities []map[string]interface{}
 	var recentSubs []models.Subscription
-	database.DB.Order("created_at DESC").Limit(10).Preload("Customer").Preload("Pack").Find(&recentSubs)
+	logDBError(c, "list recent subscriptions", requestDB(c).Order("created_at DESC").Limit(10).Preload("Customer").Preload("Pack").Find(&recentSubs).Error)
 
 	for _, sub := range recentSubs {
 		activity := map[string]interface{}{
@@ -48,42 +60,151 @@ func GetDashboard(c *gin.Context) {
 		"success": true,
 		"data": gin.H{
 			"total_customers":      totalCustomers,
-			"active_subscriptions":  activeSubscriptions,
-			"pending_requests":     pendingRequests,
+			"active_subscriptions":  subscriptionCounts["active"],
+			"pending_requests":     subscriptionCounts["requested"],
 			"total_revenue":        totalRevenue,
 			"recent_activities":    recentActivities,
 		},
 	})
 }
 
-// ListCustomers returns paginated list of customers
-func ListCustomers(c *gin.Context) {
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	search := c.Query("search")
+// customerSorts are the fields customer lists can be sorted by
+var customerSorts = map[string]pagination.Sort[models.Customer]{
+	"id":         {Column: "customers.id", Value: func(c *models.Customer) any { return c.ID }},
+	"name":       {Column: "customers.name", Value: func(c *models.Customer) any { return c.Name }},
+	"created_at": {Column: "customers.created_at", Value: func(c *models.Customer) any { return c.CreatedAt }},
+	"updated_at": {Column: "customers.updated_at", Value: func(c *models.Customer) any { return c.UpdatedAt }},
+}
 
-	offset := (page - 1) * limit
+// customerList pages ListCustomers
+var customerList = pagination.List[models.Customer]{
+	DefaultLimit: 10,
+	DefaultSort:  "id",
+	Sorts:        customerSorts,
+	ID:           func(c *models.Customer) uint { return c.ID },
+	IDColumn:     "customers.id",
+}
+
+// customerSearchList pages ListCustomers searching the full-text index,
+// best matches first
+var customerSearchList = pagination.List[models.Customer]{
+	DefaultLimit: 10,
+	DefaultSort:  "relevance",
+	Sorts: func() map[string]pagination.Sort[models.Customer] {
+		sorts := maps.Clone(customerSorts)
+		sorts["relevance"] = pagination.Sort[models.Customer]{Column: customerSearchRank}
+		return sorts
+	}(),
+	ID:       func(c *models.Customer) uint { return c.ID },
+	IDColumn: "customers.id",
+}
+
+// customerSearchResult is a customer found by search, with the fields that
+// matched
+type customerSearchResult struct {
+	models.Customer
+	Highlights map[string]string `json:"highlights"`
+}
+
+// ListCustomers returns paginated list of customers. With search, only
+// customers whose name, email or phone match every term are listed, with
+// the matches highlighted.
+func ListCustomers(c *gin.Context) {
+	terms := strings.Fields(c.Query("search"))
+	list := &customerList
+	if len(terms) > 0 && database.FullTextSearch() {
+		list = &customerSearchList
+	}
+	page, apiErr := list.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
 
 	var customers []models.Customer
 	var total int64
 
-	query := database.DB.Model(&models.Customer{}).Where("deleted_at IS NULL")
-	if search != "" {
-		query = query.Where("name LIKE ? OR email LIKE ?", "%"+search+"%", "%"+search+"%")
+	query := requestDB(c).Model(&models.Customer{}).
+		Joins("JOIN users ON users.id = customers.user_id").
+		Where("customers.deleted_at IS NULL")
+	if len(terms) > 0 {
+		query = searchCustomers(query, terms)
 	}
 
-	query.Count(&total)
-	query.Offset(offset).Limit(limit).Preload("User").Find(&customers)
+	logDBError(c, "count customers", query.Count(&total).Error)
+	logDBError(c, "list customers", page.Apply(query.Select("customers.*")).Preload("User").Find(&customers).Error)
+	customers, meta := page.Result(customers, total)
+
+	if len(terms) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success":    true,
+			"customers":  customers,
+			"pagination": meta,
+		})
+		return
+	}
+
+	highlights, err := customerHighlights(requestDB(c), terms, customers)
+	logDBError(c, "highlight customers", err)
+	results := make([]customerSearchResult, len(customers))
+	for i, customer := range customers {
+		results[i] = customerSearchResult{Customer: customer, Highlights: highlights[customer.ID]}
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"customers": customers,
-		"pagination": gin.H{
-			"page":  page,
-			"limit": limit,
-			"total": total,
-		},
+		"success":    true,
+		"customers":  results,
+		"pagination": meta,
+	})
+}
+
+// newCustomer creates a customer organization with a user that owns it. The
+// user has no password; it sets one with the returned setup token. It fails
+// with errEmailRegistered when the email already has an account.
+func newCustomer(db *gorm.DB, name, email, phone string) (customer models.Customer, setupToken string, setup models.PasswordSetupToken, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&models.User{}).Where("email = ?", email).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return errEmailRegistered
+		}
+
+		user := models.User{
+			Email: email,
+			Role:  "customer",
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return errEmailRegistered
+			}
+			return err
+		}
+
+		customer = models.Customer{
+			UserID: user.ID,
+			Name:   name,
+			Phone:  phone,
+		}
+		if err := tx.Create(&customer).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&models.CustomerMember{
+			CustomerID: customer.ID,
+			UserID:     user.ID,
+			Role:       "owner",
+			Name:       name,
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		setupToken, setup, err = createPasswordSetupToken(tx, user.ID)
+		return err
 	})
+	return customer, setupToken, setup, err
 }
 
 // CreateCustomer creates a new customer
@@ -95,44 +216,27 @@ func CreateCustomer(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
 		return
 	}
 
-	// Check if email exists
-	var existingUser models.User
-	if err := database.DB.Where("email = ?", req.Email).First(&existingUser).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Email already registered"})
+	customer, setupToken, setup, err := newCustomer(requestDB(c), req.Name, req.Email, req.Phone)
+	if errors.Is(err, errEmailRegistered) {
+		apierror.AbortCode(c, apierror.EmailAlreadyRegistered, "Email already registered")
 		return
 	}
-
-	// Create user with default password
-	hashedPassword, _ := utils.HashPassword("password123") // Default password
-	user := models.User{
-		Email:        req.Email,
-		PasswordHash: hashedPassword,
-		Role:         "customer",
-	}
-
-	if err := database.DB.Create(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create user"})
-		return
-	}
-
-	customer := models.Customer{
-		UserID: user.ID,
-		Name:   req.Name,
-		Phone:  req.Phone,
-	}
-
-	if err := database.DB.Create(&customer).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create customer"})
+	if err != nil {
+		logDBError(c, "create customer", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to create customer")
 		return
 	}
 
+	setETag(c, customer.Version)
 	c.JSON(http.StatusCreated, gin.H{
-		"success": true,
-		"customer": customer,
+		"success":          true,
+		"customer":         customer,
+		"setup_token":      setupToken,
+		"setup_expires_at": setup.ExpiresAt,
 	})
 }
 
@@ -141,18 +245,20 @@ func GetCustomer(c *gin.Context) {
 	id := c.Param("customer_id")
 
 	var customer models.Customer
-	if err := database.DB.Where("id = ? AND deleted_at IS NULL", id).Preload("User").Preload("Subscriptions.Pack").First(&customer).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).Preload("User").Preload("Members.User").Preload("Subscriptions.Pack").First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
 		return
 	}
 
+	setETag(c, customer.Version)
 	c.JSON(http.StatusOK, gin.H{
 		"success":  true,
 		"customer": customer,
 	})
 }
 
-// UpdateCustomer updates customer information
+// UpdateCustomer updates customer information. With If-Match it only
+// applies if the customer is still at that version.
 func UpdateCustomer(c *gin.Context) {
 	id := c.Param("customer_id")
 
@@ -162,13 +268,17 @@ func UpdateCustomer(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
 		return
 	}
 
 	var customer models.Customer
-	if err := database.DB.Where("id = ? AND deleted_at IS NULL", id).First(&customer).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+
+	if !ifMatch(c, customer.Version) {
 		return
 	}
 
@@ -179,21 +289,119 @@ func UpdateCustomer(c *gin.Context) {
 		customer.Phone = req.Phone
 	}
 
-	database.DB.Save(&customer)
+	saveCustomer(c, customer)
+}
+
+// customerPatch is a PatchCustomer request; fields left out stay unchanged
+type customerPatch struct {
+	Name  *string `json:"name"`
+	Phone *string `json:"phone"`
+}
+
+// apply copies the fields present in the request onto customer
+func (req customerPatch) apply(customer *models.Customer) {
+	if req.Name != nil {
+		customer.Name = *req.Name
+	}
+	if req.Phone != nil {
+		customer.Phone = *req.Phone
+	}
+}
+
+// validateCustomer checks a customer against the rules CreateCustomer binds with
+func validateCustomer(customer models.Customer) *apierror.Error {
+	var details []apierror.FieldError
+	if customer.Name == "" {
+		details = append(details, apierror.FieldError{Field: "name", Rule: "required", Message: "is required"})
+	}
+	if customer.Phone == "" {
+		details = append(details, apierror.FieldError{Field: "phone", Rule: "required", Message: "is required"})
+	}
+	if details != nil {
+		return apierror.Fields(details...)
+	}
+	return nil
+}
+
+// PatchCustomer partially updates a customer: every field sent is set, even
+// to its zero value, and the result must pass the same checks as a new
+// customer. With If-Match it only applies if the customer is still at that version.
+func PatchCustomer(c *gin.Context) {
+	id := c.Param("customer_id")
 
+	var req customerPatch
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var customer models.Customer
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+	if !ifMatch(c, customer.Version) {
+		return
+	}
+
+	req.apply(&customer)
+	if err := validateCustomer(customer); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+
+	saveCustomer(c, customer)
+}
+
+// saveCustomer stores an updated customer and responds with it
+func saveCustomer(c *gin.Context, customer models.Customer) {
+	if err := saveVersioned(requestDB(c), &customer, &customer.Version); err != nil {
+		if errors.Is(err, errVersionConflict) {
+			abortVersionConflict(c)
+			return
+		}
+		logDBError(c, "update customer", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to update customer")
+		return
+	}
+
+	setETag(c, customer.Version)
 	c.JSON(http.StatusOK, gin.H{
 		"success":  true,
 		"customer": customer,
 	})
 }
 
-// DeleteCustomer soft deletes a customer
+// DeleteCustomer soft deletes a customer, deactivating its subscriptions and
+// revoking its API keys and OAuth clients. With If-Match it only applies if
+// the customer is still at that version.
 func DeleteCustomer(c *gin.Context) {
 	id := c.Param("customer_id")
 
+	var customer models.Customer
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+	if !ifMatch(c, customer.Version) {
+		return
+	}
+
 	now := time.Now()
-	if err := database.DB.Model(&models.Customer{}).Where("id = ?", id).Update("deleted_at", now).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	customer.DeletedAt = &now
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &customer, &customer.Version); err != nil {
+			return err
+		}
+		return revokeCustomerAccess(tx, customer.ID, now)
+	})
+	if err != nil {
+		if errors.Is(err, errVersionConflict) {
+			abortVersionConflict(c)
+			return
+		}
+		logDBError(c, "delete customer", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to delete customer")
 		return
 	}
 
@@ -203,83 +411,150 @@ func DeleteCustomer(c *gin.Context) {
 	})
 }
 
+// packList pages ListSubscriptionPacks
+var packList = pagination.List[models.SubscriptionPack]{
+	DefaultLimit: 10,
+	DefaultSort:  "id",
+	Sorts: map[string]pagination.Sort[models.SubscriptionPack]{
+		"id":              {Column: "id", Value: func(p *models.SubscriptionPack) any { return p.ID }},
+		"name":            {Column: "name", Value: func(p *models.SubscriptionPack) any { return p.Name }},
+		"sku":             {Column: "sku", Value: func(p *models.SubscriptionPack) any { return p.SKU }},
+		"validity_months": {Column: "validity_months", Value: func(p *models.SubscriptionPack) any { return p.ValidityMonths }},
+		"created_at":      {Column: "created_at", Value: func(p *models.SubscriptionPack) any { return p.CreatedAt }},
+	},
+	ID: func(p *models.SubscriptionPack) uint { return p.ID },
+}
+
 // ListSubscriptionPacks returns paginated list of subscription packs
 func ListSubscriptionPacks(c *gin.Context) {
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	offset := (page - 1) * limit
+	page, apiErr := packList.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
 
 	var packs []models.SubscriptionPack
 	var total int64
 
-	database.DB.Model(&models.SubscriptionPack{}).Where("deleted_at IS NULL").Count(&total)
-	database.DB.Where("deleted_at IS NULL").Offset(offset).Limit(limit).Find(&packs)
+	query := requestDB(c).Model(&models.SubscriptionPack{}).Where("deleted_at IS NULL")
+	logDBError(c, "count packs", query.Count(&total).Error)
+	logDBError(c, "list packs", page.Apply(query).Preload("Prices").Find(&packs).Error)
+	packs, meta := page.Result(packs, total)
 
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"packs":   packs,
-		"pagination": gin.H{
-			"page":  page,
-			"limit": limit,
-			"total": total,
-		},
+		"success":    true,
+		"packs":      packs,
+		"pagination": meta,
 	})
 }
 
 // CreateSubscriptionPack creates a new subscription pack
 func CreateSubscriptionPack(c *gin.Context) {
 	var req struct {
-		Name          string  `json:"name" binding:"required"`
-		Description   string  `json:"description"`
-		SKU           string  `json:"sku" binding:"required"`
-		Price         float64 `json:"price" binding:"required"`
-		ValidityMonths int    `json:"validity_months" binding:"required,min=1,max=12"`
+		Name           string       `json:"name" binding:"required"`
+		Description    string       `json:"description"`
+		SKU            string       `json:"sku" binding:"required"`
+		Price          *float64     `json:"price" binding:"omitempty,min=0"` // major units in Currency, kept for older clients
+		Currency       string       `json:"currency" binding:"omitempty,len=3,alpha"`
+		Prices         []priceInput `json:"prices" binding:"omitempty,dive"`
+		ValidityMonths int          `json:"validity_months" binding:"required,min=1,max=12"`
+		RateLimit      int          `json:"rate_limit" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	prices := req.Prices
+	if req.Price != nil {
+		prices = append(prices, majorUnitPrice(*req.Price, req.Currency))
+	}
+	if len(prices) == 0 {
+		apierror.AbortCode(c, apierror.ValidationFailed, "At least one price is required")
 		return
 	}
 
 	pack := models.SubscriptionPack{
-		Name:          req.Name,
-		Description:   req.Description,
-		SKU:           req.SKU,
-		Price:         req.Price,
+		Name:           req.Name,
+		Description:    req.Description,
+		SKU:            req.SKU,
 		ValidityMonths: req.ValidityMonths,
+		RateLimit:      req.RateLimit,
 	}
 
-	if err := database.DB.Create(&pack).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "SKU already exists"})
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&pack).Error; err != nil {
+			return err
+		}
+		for _, price := range prices {
+			if err := setPackPrice(tx, pack.ID, price.Currency, price.Amount, currentUserID(c)); err != nil {
+				return err
+			}
+		}
+		return tx.Where("pack_id = ?", pack.ID).Find(&pack.Prices).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		apierror.AbortCode(c, apierror.SKUAlreadyExists, "SKU already exists")
+		return
+	}
+	if err != nil {
+		logDBError(c, "create subscription pack", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to create subscription pack")
 		return
 	}
 
+	setETag(c, pack.Version)
 	c.JSON(http.StatusCreated, gin.H{
 		"success": true,
 		"pack":    pack,
 	})
 }
 
-// UpdateSubscriptionPack updates a subscription pack
+// GetSubscriptionPack returns a subscription pack with its prices
+func GetSubscriptionPack(c *gin.Context) {
+	id := c.Param("pack_id")
+
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).Preload("Prices").First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+
+	setETag(c, pack.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"pack":    pack,
+	})
+}
+
+// UpdateSubscriptionPack updates a subscription pack. With If-Match it only
+// applies if the pack is still at that version.
 func UpdateSubscriptionPack(c *gin.Context) {
 	id := c.Param("pack_id")
 
 	var req struct {
-		Name          string  `json:"name"`
-		Description   string  `json:"description"`
-		SKU           string  `json:"sku"`
-		Price         float64 `json:"price"`
-		ValidityMonths int    `json:"validity_months"`
+		Name           string       `json:"name"`
+		Description    string       `json:"description"`
+		SKU            string       `json:"sku"`
+		Price          float64      `json:"price"` // major units in Currency, kept for older clients
+		Currency       string       `json:"currency" binding:"omitempty,len=3,alpha"`
+		Prices         []priceInput `json:"prices" binding:"omitempty,dive"`
+		ValidityMonths int          `json:"validity_months"`
+		RateLimit      *int         `json:"rate_limit" binding:"omitempty,min=0"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
 		return
 	}
 
 	var pack models.SubscriptionPack
-	if err := database.DB.Where("id = ? AND deleted_at IS NULL", id).First(&pack).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Subscription pack not found"})
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+	if !ifMatch(c, pack.Version) {
 		return
 	}
 
@@ -292,28 +567,171 @@ func UpdateSubscriptionPack(c *gin.Context) {
 	if req.SKU != "" {
 		pack.SKU = req.SKU
 	}
-	if req.Price > 0 {
-		pack.Price = req.Price
-	}
 	if req.ValidityMonths > 0 {
 		pack.ValidityMonths = req.ValidityMonths
 	}
+	if req.RateLimit != nil {
+		pack.RateLimit = *req.RateLimit
+	}
+
+	prices := req.Prices
+	if req.Price > 0 {
+		prices = append(prices, majorUnitPrice(req.Price, req.Currency))
+	}
+
+	savePack(c, pack, prices)
+}
+
+// packPatch is a PatchSubscriptionPack request; fields left out stay unchanged
+type packPatch struct {
+	Name           *string      `json:"name"`
+	Description    *string      `json:"description"`
+	SKU            *string      `json:"sku"`
+	Price          *float64     `json:"price" binding:"omitempty,min=0"` // major units in Currency, kept for older clients
+	Currency       *string      `json:"currency" binding:"omitempty,len=3,alpha"`
+	Prices         []priceInput `json:"prices" binding:"omitempty,dive"` // set these currencies; others keep their price
+	ValidityMonths *int         `json:"validity_months"`
+	RateLimit      *int         `json:"rate_limit"`
+}
+
+// apply copies the fields present in the request onto pack and returns the
+// prices to set
+func (req packPatch) apply(pack *models.SubscriptionPack) []priceInput {
+	if req.Name != nil {
+		pack.Name = *req.Name
+	}
+	if req.Description != nil {
+		pack.Description = *req.Description
+	}
+	if req.SKU != nil {
+		pack.SKU = *req.SKU
+	}
+	if req.ValidityMonths != nil {
+		pack.ValidityMonths = *req.ValidityMonths
+	}
+	if req.RateLimit != nil {
+		pack.RateLimit = *req.RateLimit
+	}
+
+	prices := req.Prices
+	if req.Price != nil {
+		currency := ""
+		if req.Currency != nil {
+			currency = *req.Currency
+		}
+		prices = append(prices, majorUnitPrice(*req.Price, currency))
+	}
+	return prices
+}
+
+// validatePack checks a pack against the rules CreateSubscriptionPack binds with
+func validatePack(pack models.SubscriptionPack) *apierror.Error {
+	var details []apierror.FieldError
+	if pack.Name == "" {
+		details = append(details, apierror.FieldError{Field: "name", Rule: "required", Message: "is required"})
+	}
+	if pack.SKU == "" {
+		details = append(details, apierror.FieldError{Field: "sku", Rule: "required", Message: "is required"})
+	}
+	if pack.ValidityMonths < 1 || pack.ValidityMonths > 12 {
+		details = append(details, apierror.FieldError{Field: "validity_months", Rule: "range", Message: "must be between 1 and 12"})
+	}
+	if pack.RateLimit < 0 {
+		details = append(details, apierror.FieldError{Field: "rate_limit", Rule: "min", Message: "must be at least 0"})
+	}
+	if details != nil {
+		return apierror.Fields(details...)
+	}
+	return nil
+}
+
+// PatchSubscriptionPack partially updates a subscription pack: every field
+// sent is set, even to its zero value (a price of 0 makes the pack free), and
+// the result must pass the same checks as a new pack. With If-Match it only
+// applies if the pack is still at that version.
+func PatchSubscriptionPack(c *gin.Context) {
+	id := c.Param("pack_id")
+
+	var req packPatch
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+	if !ifMatch(c, pack.Version) {
+		return
+	}
 
-	database.DB.Save(&pack)
+	prices := req.apply(&pack)
+	if err := validatePack(pack); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+
+	savePack(c, pack, prices)
+}
+
+// savePack stores an updated pack and the prices to set, then responds with it
+func savePack(c *gin.Context, pack models.SubscriptionPack, prices []priceInput) {
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &pack, &pack.Version); err != nil {
+			return err
+		}
+		for _, price := range prices {
+			if err := setPackPrice(tx, pack.ID, price.Currency, price.Amount, currentUserID(c)); err != nil {
+				return err
+			}
+		}
+		return tx.Where("pack_id = ?", pack.ID).Find(&pack.Prices).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		apierror.AbortCode(c, apierror.SKUAlreadyExists, "SKU already exists")
+		return
+	}
+	if errors.Is(err, errVersionConflict) {
+		abortVersionConflict(c)
+		return
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to update subscription pack")
+		return
+	}
 
+	setETag(c, pack.Version)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"pack":    pack,
 	})
 }
 
-// DeleteSubscriptionPack soft deletes a subscription pack
+// DeleteSubscriptionPack soft deletes a subscription pack. With If-Match it
+// only applies if the pack is still at that version.
 func DeleteSubscriptionPack(c *gin.Context) {
 	id := c.Param("pack_id")
 
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+	if !ifMatch(c, pack.Version) {
+		return
+	}
+
 	now := time.Now()
-	if err := database.DB.Model(&models.SubscriptionPack{}).Where("id = ?", id).Update("deleted_at", now).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Subscription pack not found"})
+	pack.DeletedAt = &now
+	if err := saveVersioned(requestDB(c), &pack, &pack.Version); err != nil {
+		if errors.Is(err, errVersionConflict) {
+			abortVersionConflict(c)
+			return
+		}
+		logDBError(c, "delete subscription pack", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to delete subscription pack")
 		return
 	}
 
@@ -323,54 +741,193 @@ func DeleteSubscriptionPack(c *gin.Context) {
 	})
 }
 
+// subscriptionList pages ListSubscriptions
+var subscriptionList = pagination.List[models.Subscription]{
+	DefaultLimit: 10,
+	DefaultSort:  "id",
+	Sorts:        subscriptionSorts,
+	ID:           func(s *models.Subscription) uint { return s.ID },
+}
+
+// subscriptionSorts are the fields subscription lists can be sorted by
+var subscriptionSorts = map[string]pagination.Sort[models.Subscription]{
+	"id":           {Column: "id", Value: func(s *models.Subscription) any { return s.ID }},
+	"created_at":   {Column: "created_at", Value: func(s *models.Subscription) any { return s.CreatedAt }},
+	"requested_at": {Column: "requested_at", Value: func(s *models.Subscription) any { return s.RequestedAt }},
+	"assigned_at":  {Column: "assigned_at", Value: func(s *models.Subscription) any { return s.AssignedAt }},
+	"expires_at":   {Column: "expires_at", Value: func(s *models.Subscription) any { return s.ExpiresAt }},
+	"status":       {Column: "status", Value: func(s *models.Subscription) any { return s.Status }},
+}
+
 // ListSubscriptions returns all subscriptions
 func ListSubscriptions(c *gin.Context) {
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	status := c.Query("status")
-	offset := (page - 1) * limit
+	page, apiErr := subscriptionList.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
+	filter, apiErr := parseSubscriptionFilter(c.Request.URL.Query())
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
 
 	var subscriptions []models.Subscription
 	var total int64
 
-	query := database.DB.Model(&models.Subscription{})
-	if status != "" {
-		query = query.Where("status = ?", status)
-	}
-
-	query.Count(&total)
-	query.Offset(offset).Limit(limit).Preload("Customer").Preload("Pack").Find(&subscriptions)
+	query := filter.apply(requestDB(c).Model(&models.Subscription{}))
+	logDBError(c, "count subscriptions", query.Count(&total).Error)
+	logDBError(c, "list subscriptions", page.Apply(query).Preload("Customer").Preload("Pack").Find(&subscriptions).Error)
+	subscriptions, meta := page.Result(subscriptions, total)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success":       true,
 		"subscriptions": subscriptions,
-		"pagination": gin.H{
-			"page":  page,
-			"limit": limit,
-			"total": total,
-		},
+		"pagination":    meta,
 	})
 }
 
+// subscriptionFilter narrows ListSubscriptions. Zero fields don't filter.
+type subscriptionFilter struct {
+	customerID      uint
+	packID          uint
+	statuses        []string
+	expiresAfter    *time.Time
+	expiresBefore   *time.Time
+	requestedAfter  *time.Time
+	requestedBefore *time.Time
+	expiringWithin  *int // days
+}
+
+// subscriptionFilterParams are the parameters parseSubscriptionFilter reads
+var subscriptionFilterParams = []string{
+	"customer_id", "pack_id", "status", "expires_after", "expires_before",
+	"requested_after", "requested_before", "expiring_within_days",
+}
+
+// parseSubscriptionFilter reads customer_id, pack_id, status (repeated or
+// comma-separated), expires_after/before, requested_after/before (RFC 3339
+// times or YYYY-MM-DD dates) and expiring_within_days
+func parseSubscriptionFilter(query url.Values) (subscriptionFilter, *apierror.Error) {
+	var filter subscriptionFilter
+	var details []apierror.FieldError
+
+	for _, param := range []struct {
+		name string
+		id   *uint
+	}{{"customer_id", &filter.customerID}, {"pack_id", &filter.packID}} {
+		if value := query.Get(param.name); value != "" {
+			id, err := strconv.ParseUint(value, 10, 0)
+			if err != nil || id == 0 {
+				details = append(details, apierror.FieldError{Field: param.name, Rule: "min", Message: "must be a positive integer"})
+			}
+			*param.id = uint(id)
+		}
+	}
+
+	for _, value := range query["status"] {
+		for _, status := range strings.Split(value, ",") {
+			if status = strings.TrimSpace(status); status == "" {
+				continue
+			}
+			if !slices.Contains(metrics.SubscriptionStatuses, status) {
+				details = append(details, apierror.FieldError{Field: "status", Rule: "oneof", Message: "must be one of: " + strings.Join(metrics.SubscriptionStatuses, ", ")})
+				break
+			}
+			filter.statuses = append(filter.statuses, status)
+		}
+	}
+
+	for _, param := range []struct {
+		name string
+		t    **time.Time
+	}{
+		{"expires_after", &filter.expiresAfter},
+		{"expires_before", &filter.expiresBefore},
+		{"requested_after", &filter.requestedAfter},
+		{"requested_before", &filter.requestedBefore},
+	} {
+		if value := query.Get(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				t, err = time.ParseInLocation(time.DateOnly, value, time.Local)
+			}
+			if err != nil {
+				details = append(details, apierror.FieldError{Field: param.name, Rule: "datetime", Message: "must be an RFC 3339 time or a YYYY-MM-DD date"})
+				continue
+			}
+			t = t.Local() // stored times are local; they compare as text
+			*param.t = &t
+		}
+	}
+
+	if value := query.Get("expiring_within_days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 0 {
+			details = append(details, apierror.FieldError{Field: "expiring_within_days", Rule: "min", Message: "must be a non-negative integer"})
+		}
+		filter.expiringWithin = &days
+	}
+
+	if details != nil {
+		return filter, apierror.Fields(details...)
+	}
+	return filter, nil
+}
+
+// apply adds the filter's conditions to query
+func (f subscriptionFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.customerID != 0 {
+		query = query.Where("customer_id = ?", f.customerID)
+	}
+	if f.packID != 0 {
+		query = query.Where("pack_id = ?", f.packID)
+	}
+	if len(f.statuses) > 0 {
+		query = query.Where("status IN ?", f.statuses)
+	}
+	if f.expiresAfter != nil {
+		query = query.Where("expires_at >= ?", *f.expiresAfter)
+	}
+	if f.expiresBefore != nil {
+		query = query.Where("expires_at < ?", *f.expiresBefore)
+	}
+	if f.requestedAfter != nil {
+		query = query.Where("requested_at >= ?", *f.requestedAfter)
+	}
+	if f.requestedBefore != nil {
+		query = query.Where("requested_at < ?", *f.requestedBefore)
+	}
+	if f.expiringWithin != nil {
+		now := time.Now()
+		query = query.Where("expires_at >= ? AND expires_at < ?", now, now.AddDate(0, 0, *f.expiringWithin))
+	}
+	return query
+}
+
 // ApproveSubscription approves a subscription request
 func ApproveSubscription(c *gin.Context) {
 	id := c.Param("subscription_id")
 
 	var subscription models.Subscription
-	if err := database.DB.Where("id = ?", id).First(&subscription).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Subscription not found"})
+	if err := requestDB(c).Where("id = ?", id).First(&subscription).Error; err != nil {
+		apierror.AbortCode(c, apierror.SubscriptionNotFound, "Subscription not found")
 		return
 	}
 
 	if subscription.Status != "requested" {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Subscription is not in requested status"})
+		apierror.AbortCode(c, apierror.SubscriptionNotRequested, "Subscription is not in requested status")
 		return
 	}
 
 	now := time.Now()
 	subscription.Status = "approved"
 	subscription.ApprovedAt = &now
-	database.DB.Save(&subscription)
+	if err := requestDB(c).Save(&subscription).Error; err != nil {
+		logDBError(c, "approve subscription", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to approve subscription")
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -383,30 +940,38 @@ func AssignSubscription(c *gin.Context) {
 	customerID := c.Param("customer_id")
 
 	var req struct {
-		PackID int `json:"pack_id" binding:"required"`
+		PackID     int    `json:"pack_id" binding:"required"`
+		Currency   string `json:"currency" binding:"omitempty,len=3,alpha"`
+		CouponCode string `json:"coupon_code"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
 		return
 	}
 
 	// Check if customer has active subscription
 	var activeSubCount int64
-	if err := database.DB.Model(&models.Subscription{}).Where("customer_id = ? AND status = ?", customerID, "active").Count(&activeSubCount).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to check existing subscription"})
+	if err := requestDB(c).Model(&models.Subscription{}).Where("customer_id = ? AND status = ?", customerID, "active").Count(&activeSubCount).Error; err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to check existing subscription")
 		return
 	}
 	
 	if activeSubCount > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Customer already has an active subscription"})
+		apierror.AbortCode(c, apierror.SubscriptionAlreadyActive, "Customer already has an active subscription")
 		return
 	}
 
 	// Get pack
 	var pack models.SubscriptionPack
-	if err := database.DB.Where("id = ? AND deleted_at IS NULL", req.PackID).First(&pack).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Subscription pack not found"})
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", req.PackID).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+
+	price, err := resolvePackPrice(pack.ID, req.Currency)
+	if err != nil {
+		apierror.AbortCode(c, apierror.PackCurrencyUnavailable, "Subscription pack is not available in this currency")
 		return
 	}
 
@@ -414,15 +979,22 @@ func AssignSubscription(c *gin.Context) {
 	expiresAt := now.AddDate(0, pack.ValidityMonths, 0)
 
 	subscription := models.Subscription{
-		CustomerID:  uint(parseInt(customerID)),
-		PackID:      uint(req.PackID),
-		Status:      "active",
-		AssignedAt:  &now,
-		ExpiresAt:   &expiresAt,
+		CustomerID:    uint(parseInt(customerID)),
+		PackID:        uint(req.PackID),
+		Status:        "active",
+		AssignedAt:    &now,
+		ExpiresAt:     &expiresAt,
+		PriceAmount:   price.Amount,
+		PriceCurrency: price.Currency,
 	}
 
-	if err := database.DB.Create(&subscription).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to assign subscription"})
+	if err := createSubscription(requestDB(c), &subscription, req.CouponCode); err != nil {
+		var couponErr *apierror.Error
+		if errors.As(err, &couponErr) {
+			apierror.Abort(c, couponErr)
+			return
+		}
+		apierror.AbortCode(c, apierror.Internal, "Failed to assign subscription")
 		return
 	}
 
@@ -432,13 +1004,26 @@ func AssignSubscription(c *gin.Context) {
 	})
 }
 
-// UnassignSubscription removes a subscription assignment
+// UnassignSubscription removes a subscription assignment. The coupon use of
+// a subscription that was never assigned is given back.
 func UnassignSubscription(c *gin.Context) {
 	customerID := c.Param("customer_id")
 	subscriptionID := c.Param("subscription_id")
 
-	if err := database.DB.Where("id = ? AND customer_id = ?", subscriptionID, customerID).Delete(&models.Subscription{}).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Subscription not found"})
+	var subscription models.Subscription
+	if err := requestDB(c).Where("id = ? AND customer_id = ?", subscriptionID, customerID).First(&subscription).Error; err != nil {
+		apierror.AbortCode(c, apierror.SubscriptionNotFound, "Subscription not found")
+		return
+	}
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := releaseCoupon(tx, subscription); err != nil {
+			return err
+		}
+		return tx.Delete(&subscription).Error
+	})
+	if err != nil {
+		logDBError(c, "unassign subscription", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to unassign subscription")
 		return
 	}
 
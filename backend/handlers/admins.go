@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"errors"
+	"license-mnm/apierror"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"license-mnm/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// passwordSetupTTL is how long an admin invitation link stays valid
+const passwordSetupTTL = 72 * time.Hour
+
+var (
+	errLastSuperAdmin = errors.New("cannot remove the last super admin")
+	errSelfAction     = errors.New("admins cannot disable or delete themselves")
+)
+
+// ensureOtherSuperAdmin fails when user is the only remaining enabled super admin
+func ensureOtherSuperAdmin(tx *gorm.DB, user models.User) error {
+	if user.Role != rbac.RoleSuperAdmin {
+		return nil
+	}
+
+	var superAdmins int64
+	if err := tx.Model(&models.User{}).Where("role = ? AND id <> ? AND disabled_at IS NULL", rbac.RoleSuperAdmin, user.ID).Count(&superAdmins).Error; err != nil {
+		return err
+	}
+	if superAdmins == 0 {
+		return errLastSuperAdmin
+	}
+	return nil
+}
+
+// findAdmin loads a staff user by the :user_id path parameter
+func findAdmin(tx *gorm.DB, c *gin.Context) (models.User, error) {
+	var admin models.User
+	err := tx.Where("id = ? AND role IN ?", c.Param("user_id"), rbac.StaffRoles).First(&admin).Error
+	return admin, err
+}
+
+// respondAdminError writes the response for errors from admin account changes
+func respondAdminError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		apierror.AbortCode(c, apierror.AdminNotFound, "Admin not found")
+	case errors.Is(err, errLastSuperAdmin):
+		apierror.AbortCode(c, apierror.LastSuperAdmin, "The last super admin must stay an enabled super admin")
+	case errors.Is(err, errSelfAction):
+		apierror.AbortCode(c, apierror.SelfActionDenied, "You cannot disable or delete your own account")
+	case errors.Is(err, errEmailRegistered):
+		apierror.AbortCode(c, apierror.EmailAlreadyRegistered, "Email already registered")
+	default:
+		apierror.AbortCode(c, apierror.Internal, "Failed to "+action)
+	}
+}
+
+// createPasswordSetupToken issues a one-time token the user exchanges for a password
+func createPasswordSetupToken(tx *gorm.DB, userID uint) (string, models.PasswordSetupToken, error) {
+	token, err := utils.GenerateRandomToken()
+	if err != nil {
+		return "", models.PasswordSetupToken{}, err
+	}
+
+	setup := models.PasswordSetupToken{
+		UserID:    userID,
+		TokenHash: utils.HashToken(token),
+		ExpiresAt: time.Now().Add(passwordSetupTTL),
+	}
+	if err := tx.Create(&setup).Error; err != nil {
+		return "", setup, err
+	}
+	return token, setup, nil
+}
+
+// ListRoles returns the staff roles and the permissions each one grants
+func ListRoles(c *gin.Context) {
+	var roles []gin.H
+	for _, role := range rbac.StaffRoles {
+		roles = append(roles, gin.H{
+			"role":        role,
+			"permissions": rbac.RolePermissions[role],
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"roles":   roles,
+	})
+}
+
+// ListAdmins returns all staff users
+func ListAdmins(c *gin.Context) {
+	query := requestDB(c).Where("role IN ?", rbac.StaffRoles)
+	if role := c.Query("role"); role != "" {
+		query = query.Where("role = ?", role)
+	}
+	switch c.Query("status") {
+	case "disabled":
+		query = query.Where("disabled_at IS NOT NULL")
+	case "active":
+		query = query.Where("disabled_at IS NULL")
+	}
+
+	var admins []models.User
+	logDBError(c, "list admins", query.Order("id").Find(&admins).Error)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"admins":  admins,
+	})
+}
+
+// GetAdmin returns a staff user
+func GetAdmin(c *gin.Context) {
+	admin, err := findAdmin(requestDB(c), c)
+	if err != nil {
+		respondAdminError(c, err, "load admin")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"admin":   admin,
+	})
+}
+
+// CreateAdmin creates a staff user with the given role. Without a password
+// the admin is invited: the response carries a token for the password setup
+// endpoint, to be sent to the invitee by email.
+func CreateAdmin(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email" binding:"required,email"`
+		Password string `json:"password" binding:"omitempty,min=8"`
+		Role     string `json:"role" binding:"required,oneof=super_admin admin billing_admin support"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var existingUser models.User
+	if err := requestDB(c).Where("email = ?", req.Email).First(&existingUser).Error; err == nil {
+		apierror.AbortCode(c, apierror.EmailAlreadyRegistered, "Email already registered")
+		return
+	}
+
+	var hashedPassword string
+	if req.Password != "" {
+		hash, err := utils.HashPassword(req.Password)
+		if err != nil {
+			apierror.AbortCode(c, apierror.Internal, "Failed to hash password")
+			return
+		}
+		hashedPassword = hash
+	}
+
+	admin := models.User{
+		Email:        req.Email,
+		PasswordHash: hashedPassword,
+		Role:         req.Role,
+	}
+
+	var setupToken string
+	var setup models.PasswordSetupToken
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&admin).Error; err != nil {
+			return err
+		}
+		if req.Password != "" {
+			return nil
+		}
+		var err error
+		setupToken, setup, err = createPasswordSetupToken(tx, admin.ID)
+		return err
+	})
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to create admin")
+		return
+	}
+
+	response := gin.H{
+		"success": true,
+		"admin":   admin,
+	}
+	if setupToken != "" {
+		response["setup_token"] = setupToken
+		response["setup_expires_at"] = setup.ExpiresAt
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// UpdateAdmin updates a staff user's email or role
+func UpdateAdmin(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"omitempty,email"`
+		Role  string `json:"role" binding:"omitempty,oneof=super_admin admin billing_admin support"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var admin models.User
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if admin, err = findAdmin(tx, c); err != nil {
+			return err
+		}
+
+		if req.Email != "" && !strings.EqualFold(req.Email, admin.Email) {
+			var existingUser models.User
+			if err := tx.Where("email = ? AND id <> ?", req.Email, admin.ID).First(&existingUser).Error; err == nil {
+				return errEmailRegistered
+			}
+			admin.Email = req.Email
+		}
+		if req.Role != "" && req.Role != admin.Role {
+			if err := ensureOtherSuperAdmin(tx, admin); err != nil {
+				return err
+			}
+			admin.Role = req.Role
+		}
+		return tx.Save(&admin).Error
+	})
+	if err != nil {
+		respondAdminError(c, err, "update admin")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"admin":   admin,
+	})
+}
+
+// AssignAdminRole changes a staff user's role
+func AssignAdminRole(c *gin.Context) {
+	var req struct {
+		Role string `json:"role" binding:"required,oneof=super_admin admin billing_admin support"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var admin models.User
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if admin, err = findAdmin(tx, c); err != nil {
+			return err
+		}
+		if req.Role != rbac.RoleSuperAdmin {
+			if err := ensureOtherSuperAdmin(tx, admin); err != nil {
+				return err
+			}
+		}
+		admin.Role = req.Role
+		return tx.Save(&admin).Error
+	})
+	if err != nil {
+		respondAdminError(c, err, "assign role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"admin":   admin,
+	})
+}
+
+// DisableAdmin blocks a staff user from signing in without deleting them
+func DisableAdmin(c *gin.Context) {
+	var admin models.User
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if admin, err = findAdmin(tx, c); err != nil {
+			return err
+		}
+		if admin.ID == currentUserID(c) {
+			return errSelfAction
+		}
+		if err := ensureOtherSuperAdmin(tx, admin); err != nil {
+			return err
+		}
+		if admin.DisabledAt == nil {
+			now := time.Now()
+			admin.DisabledAt = &now
+		}
+		return tx.Save(&admin).Error
+	})
+	if err != nil {
+		respondAdminError(c, err, "disable admin")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"admin":   admin,
+	})
+}
+
+// EnableAdmin lets a disabled staff user sign in again
+func EnableAdmin(c *gin.Context) {
+	admin, err := findAdmin(requestDB(c), c)
+	if err != nil {
+		respondAdminError(c, err, "enable admin")
+		return
+	}
+
+	admin.DisabledAt = nil
+	if err := requestDB(c).Model(&admin).Update("disabled_at", nil).Error; err != nil {
+		respondAdminError(c, err, "enable admin")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"admin":   admin,
+	})
+}
+
+// DeleteAdmin permanently deletes a staff user
+func DeleteAdmin(c *gin.Context) {
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		admin, err := findAdmin(tx, c)
+		if err != nil {
+			return err
+		}
+		if admin.ID == currentUserID(c) {
+			return errSelfAction
+		}
+		if err := ensureOtherSuperAdmin(tx, admin); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", admin.ID).Delete(&models.PasswordSetupToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&admin).Error
+	})
+	if err != nil {
+		respondAdminError(c, err, "delete admin")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Admin deleted successfully",
+	})
+}
+
+// ResendAdminInvitation issues a new password setup token for a staff user
+func ResendAdminInvitation(c *gin.Context) {
+	admin, err := findAdmin(requestDB(c), c)
+	if err != nil {
+		respondAdminError(c, err, "create invitation")
+		return
+	}
+
+	token, setup, err := createPasswordSetupToken(requestDB(c), admin.ID)
+	if err != nil {
+		respondAdminError(c, err, "create invitation")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":          true,
+		"setup_token":      token,
+		"setup_expires_at": setup.ExpiresAt,
+	})
+}
+
+// SetupAdminPassword sets an invited admin's password from their setup token
+func SetupAdminPassword(c *gin.Context) {
+	setupPassword(c, rbac.StaffRoles)
+}
+
+// SetupCustomerPassword sets the password of a customer created by an admin
+// or an import, from their setup token
+func SetupCustomerPassword(c *gin.Context) {
+	setupPassword(c, []string{"customer"})
+}
+
+// setupPassword exchanges a setup token for a password, for users with one of roles
+func setupPassword(c *gin.Context, roles []string) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=8"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var setup models.PasswordSetupToken
+	users := requestDB(c).Model(&models.User{}).Select("id").Where("role IN ?", roles)
+	if err := requestDB(c).Where("token_hash = ? AND used_at IS NULL AND expires_at > ? AND user_id IN (?)", utils.HashToken(req.Token), time.Now(), users).
+		First(&setup).Error; err != nil {
+		apierror.AbortCode(c, apierror.SetupTokenInvalid, "Invalid or expired token")
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(req.Password)
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to hash password")
+		return
+	}
+
+	err = requestDB(c).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		// Using the token also invalidates any other outstanding tokens for the user
+		if err := tx.Model(&models.PasswordSetupToken{}).Where("user_id = ? AND used_at IS NULL", setup.UserID).
+			Update("used_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ? AND role IN ?", setup.UserID, roles).
+			Update("password_hash", hashedPassword).Error
+	})
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to set password")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Password set successfully",
+	})
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"license-mnm/apierror"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"license-mnm/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListAPIKeys returns the caller's active scoped API keys
+func ListAPIKeys(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var keys []models.APIKey
+	logDBError(c, "list api keys", requestDB(c).Where("user_id = ? AND revoked_at IS NULL", userID).Order("id").Find(&keys).Error)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"keys":    keys,
+	})
+}
+
+// CreateAPIKey creates an SDK API key with the chosen scopes for the caller.
+// The key is only returned here.
+func CreateAPIKey(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var req struct {
+		Name   string   `json:"name" binding:"required"`
+		Scopes []string `json:"scopes" binding:"required,min=1,dive,oneof=subscription:read subscription:write history:read"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+
+	scopes := strings.Join(req.Scopes, " ")
+	if rbac.HasScope(scopes, rbac.ScopeSubscriptionWrite) && !canManageSubscriptions(member) {
+		apierror.AbortCode(c, apierror.Forbidden, "Only organization owners and billing members can create keys with the subscription:write scope")
+		return
+	}
+
+	apiKey, err := utils.GenerateAPIKey()
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to generate API key")
+		return
+	}
+
+	key := models.APIKey{
+		UserID:  member.UserID,
+		Name:    req.Name,
+		Prefix:  utils.APIKeyPrefix(apiKey),
+		KeyHash: utils.HashToken(apiKey),
+		Scopes:  scopes,
+	}
+	if err := requestDB(c).Create(&key).Error; err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to create API key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"key":     key,
+		"api_key": apiKey,
+	})
+}
+
+// RevokeAPIKey revokes one of the caller's scoped API keys
+func RevokeAPIKey(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	result := requestDB(c).Model(&models.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("key_id"), userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to revoke API key")
+		return
+	}
+	if result.RowsAffected == 0 {
+		apierror.AbortCode(c, apierror.APIKeyNotFound, "API key not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "API key revoked successfully",
+	})
+}
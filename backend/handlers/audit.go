@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"license-mnm/apierror"
+	"license-mnm/logging"
+	"license-mnm/models"
+	"license-mnm/pagination"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordAudit writes an audit log entry for the current request. Failures
+// are logged rather than returned so auditing never blocks the action.
+func recordAudit(c *gin.Context, action, subject string, details gin.H) {
+	entry := models.AuditLog{
+		Action:  action,
+		Subject: subject,
+		IP:      c.ClientIP(),
+	}
+	if userID := currentUserID(c); userID != 0 {
+		entry.ActorID = &userID
+	}
+	if details != nil {
+		if encoded, err := json.Marshal(details); err == nil {
+			entry.Details = string(encoded)
+		}
+	}
+
+	if err := requestDB(c).Create(&entry).Error; err != nil {
+		logging.FromContext(c).Error("failed to record audit event", "action", action, "subject", subject, "error", err)
+	}
+}
+
+// auditLogList pages ListAuditLogs
+var auditLogList = pagination.List[models.AuditLog]{
+	DefaultLimit: 50,
+	DefaultSort:  "id",
+	DefaultDesc:  true,
+	Sorts: map[string]pagination.Sort[models.AuditLog]{
+		"id":         {Column: "id", Value: func(e *models.AuditLog) any { return e.ID }},
+		"created_at": {Column: "created_at", Value: func(e *models.AuditLog) any { return e.CreatedAt }},
+	},
+	ID: func(e *models.AuditLog) uint { return e.ID },
+}
+
+// ListAuditLogs returns audit log entries, newest first
+func ListAuditLogs(c *gin.Context) {
+	page, apiErr := auditLogList.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
+	action := c.Query("action")
+	subject := c.Query("subject")
+
+	var entries []models.AuditLog
+	var total int64
+
+	query := requestDB(c).Model(&models.AuditLog{})
+	if action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if subject != "" {
+		query = query.Where("subject = ?", subject)
+	}
+
+	logDBError(c, "count audit logs", query.Count(&total).Error)
+	logDBError(c, "list audit logs", page.Apply(query).Find(&entries).Error)
+	entries, meta := page.Result(entries, total)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"audit_logs": entries,
+		"pagination": meta,
+	})
+}
@@ -1,8 +1,9 @@
 package handlers
 
 import (
-	"license-mnm/database"
+	"license-mnm/apierror"
 	"license-mnm/models"
+	"license-mnm/rbac"
 	"license-mnm/utils"
 	"net/http"
 
@@ -18,32 +19,50 @@ func AdminLogin(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	if !loginAllowed(c, req.Email) {
 		return
 	}
 
 	var user models.User
-	if err := database.DB.Where("email = ? AND role = ?", req.Email, "admin").First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid credentials"})
+	if err := requestDB(c).Where("email = ? AND role IN ?", req.Email, rbac.StaffRoles).First(&user).Error; err != nil {
+		loginFailed(c, req.Email, "")
+		apierror.AbortCode(c, apierror.InvalidCredentials, "Invalid credentials")
 		return
 	}
 
-	if !utils.CheckPasswordHash(req.Password, user.PasswordHash) {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid credentials"})
+	if user.PasswordHash == "" || !utils.CheckPasswordHash(req.Password, user.PasswordHash) {
+		loginFailed(c, req.Email, user.Role)
+		apierror.AbortCode(c, apierror.InvalidCredentials, "Invalid credentials")
 		return
 	}
 
+	if user.DisabledAt != nil {
+		apierror.AbortCode(c, apierror.AccountDisabled, "Account is disabled")
+		return
+	}
+
+	completeLogin(c, user, loginClientAdmin)
+}
+
+// respondAdminLogin issues the JWT for an authenticated admin
+func respondAdminLogin(c *gin.Context, user models.User) {
 	token, err := utils.GenerateToken(user.ID, user.Email, user.Role)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to generate token"})
+		apierror.AbortCode(c, apierror.Internal, "Failed to generate token")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success":    true,
-		"token":      token,
-		"email":      user.Email,
-		"expires_in": 3600,
+		"token":       token,
+		"email":       user.Email,
+		"role":        user.Role,
+		"permissions": rbac.RolePermissions[user.Role],
+		"expires_in":  3600,
 	})
 }
 
@@ -55,24 +74,35 @@ func CustomerLogin(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	if !loginAllowed(c, req.Email) {
 		return
 	}
 
 	var user models.User
-	if err := database.DB.Where("email = ? AND role = ?", req.Email, "customer").Preload("Customer").First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid credentials"})
+	if err := requestDB(c).Where("email = ? AND role = ?", req.Email, "customer").Preload("Customer").First(&user).Error; err != nil {
+		loginFailed(c, req.Email, "")
+		apierror.AbortCode(c, apierror.InvalidCredentials, "Invalid credentials")
 		return
 	}
 
 	if !utils.CheckPasswordHash(req.Password, user.PasswordHash) {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid credentials"})
+		loginFailed(c, req.Email, user.Role)
+		apierror.AbortCode(c, apierror.InvalidCredentials, "Invalid credentials")
 		return
 	}
 
+	completeLogin(c, user, loginClientCustomer)
+}
+
+// respondCustomerLogin issues the JWT for an authenticated customer user
+func respondCustomerLogin(c *gin.Context, user models.User) {
 	token, err := utils.GenerateToken(user.ID, user.Email, user.Role)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to generate token"})
+		apierror.AbortCode(c, apierror.Internal, "Failed to generate token")
 		return
 	}
 
@@ -82,12 +112,21 @@ func CustomerLogin(c *gin.Context) {
 		phone = user.Customer.Phone
 	}
 
+	var organization gin.H
+	if member, err := membershipForUser(user.ID); err == nil {
+		organization = organizationSummary(member)
+		if name == "" {
+			name = member.Name
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success":    true,
 		"token":      token,
-		"name":       name,
-		"phone":      phone,
-		"expires_in": 3600,
+		"name":         name,
+		"phone":        phone,
+		"organization": organization,
+		"expires_in":   3600,
 	})
 }
 
@@ -101,26 +140,26 @@ func CustomerSignup(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
 		return
 	}
 
 	// Check if user already exists
 	var existingUser models.User
-	if err := database.DB.Where("email = ?", req.Email).First(&existingUser).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Email already registered"})
+	if err := requestDB(c).Where("email = ?", req.Email).First(&existingUser).Error; err == nil {
+		apierror.AbortCode(c, apierror.EmailAlreadyRegistered, "Email already registered")
 		return
 	}
 
 	// Hash password
 	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to hash password"})
+		apierror.AbortCode(c, apierror.Internal, "Failed to hash password")
 		return
 	}
 
 	// Create user and customer in transaction
-	err = database.DB.Transaction(func(tx *gorm.DB) error {
+	err = requestDB(c).Transaction(func(tx *gorm.DB) error {
 		user := models.User{
 			Email:        req.Email,
 			PasswordHash: hashedPassword,
@@ -139,6 +178,16 @@ func CustomerSignup(c *gin.Context) {
 			return err
 		}
 
+		member := models.CustomerMember{
+			CustomerID: customer.ID,
+			UserID:     user.ID,
+			Role:       "owner",
+			Name:       req.Name,
+		}
+		if err := tx.Create(&member).Error; err != nil {
+			return err
+		}
+
 		// Generate token
 		token, err := utils.GenerateToken(user.ID, user.Email, user.Role)
 		if err != nil {
@@ -158,7 +207,7 @@ func CustomerSignup(c *gin.Context) {
 	})
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create account"})
+		apierror.AbortCode(c, apierror.Internal, "Failed to create account")
 		return
 	}
 }
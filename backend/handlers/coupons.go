@@ -0,0 +1,468 @@
+package handlers
+
+import (
+	"errors"
+	"license-mnm/apierror"
+	"license-mnm/models"
+	"license-mnm/pagination"
+	"license-mnm/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Reasons a coupon can't be applied, safe to show to the caller
+var (
+	errCouponNotFound         = apierror.New(apierror.CouponCodeUnknown, "Coupon not found")
+	errCouponInactive         = apierror.New(apierror.CouponInactive, "Coupon is not active")
+	errCouponNotStarted       = apierror.New(apierror.CouponNotStarted, "Coupon is not valid yet")
+	errCouponExpired          = apierror.New(apierror.CouponExpired, "Coupon has expired")
+	errCouponExhausted        = apierror.New(apierror.CouponExhausted, "Coupon usage limit reached")
+	errCouponCustomerLimit    = apierror.New(apierror.CouponCustomerLimit, "Coupon already used the maximum number of times by this customer")
+	errCouponPackNotEligible  = apierror.New(apierror.CouponPackNotEligible, "Coupon does not apply to this subscription pack")
+	errCouponCurrencyMismatch = apierror.New(apierror.CouponCurrencyMismatch, "Coupon does not apply to this currency")
+)
+
+// normalizeCouponCode makes coupon codes case-insensitive
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// couponDiscount returns the discount a coupon gives on a price, never more than the price itself
+func couponDiscount(coupon models.Coupon, price models.PackPrice) (int64, error) {
+	var discount int64
+	switch coupon.DiscountType {
+	case "percentage":
+		discount = (price.Amount*int64(coupon.PercentOff) + 50) / 100
+	case "fixed":
+		if coupon.Currency != price.Currency {
+			return 0, errCouponCurrencyMismatch
+		}
+		discount = coupon.AmountOff
+	}
+	if discount > price.Amount {
+		discount = price.Amount
+	}
+	return discount, nil
+}
+
+// redeemCoupon checks a coupon against the customer and pack, reserves one use
+// of it and returns the redemption to record, without its subscription. It
+// must run in the same transaction that creates the subscription so usage
+// caps hold under concurrent requests.
+func redeemCoupon(tx *gorm.DB, code string, customerID, packID uint, price models.PackPrice) (models.CouponRedemption, error) {
+	var coupon models.Coupon
+	if err := tx.Where("code = ? AND deleted_at IS NULL", normalizeCouponCode(code)).Preload("Packs").First(&coupon).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.CouponRedemption{}, errCouponNotFound
+		}
+		return models.CouponRedemption{}, err
+	}
+
+	now := time.Now()
+	switch {
+	case !coupon.Active:
+		return models.CouponRedemption{}, errCouponInactive
+	case coupon.StartsAt != nil && now.Before(*coupon.StartsAt):
+		return models.CouponRedemption{}, errCouponNotStarted
+	case coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt):
+		return models.CouponRedemption{}, errCouponExpired
+	}
+
+	if len(coupon.Packs) > 0 {
+		eligible := false
+		for _, pack := range coupon.Packs {
+			if pack.ID == packID {
+				eligible = true
+				break
+			}
+		}
+		if !eligible {
+			return models.CouponRedemption{}, errCouponPackNotEligible
+		}
+	}
+
+	discount, err := couponDiscount(coupon, price)
+	if err != nil {
+		return models.CouponRedemption{}, err
+	}
+	seq, err := redemptionSlot(tx, coupon, customerID)
+	if err != nil {
+		return models.CouponRedemption{}, err
+	}
+
+	// Conditional increment so two concurrent redemptions can't both take the last use
+	result := tx.Model(&models.Coupon{}).
+		Where("id = ? AND (max_redemptions = 0 OR times_redeemed < max_redemptions)", coupon.ID).
+		Update("times_redeemed", gorm.Expr("times_redeemed + 1"))
+	if result.Error != nil {
+		return models.CouponRedemption{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return models.CouponRedemption{}, errCouponExhausted
+	}
+
+	return models.CouponRedemption{
+		CouponID:       coupon.ID,
+		CustomerID:     customerID,
+		DiscountAmount: discount,
+		Currency:       price.Currency,
+		Seq:            seq,
+	}, nil
+}
+
+// redemptionSlot picks the Seq of a customer's next use of a coupon: the
+// lowest free one up to MaxRedemptionsPerCustomer, or the next one when
+// uses are unlimited. The unique index on coupon, customer and Seq stops
+// two concurrent requests from taking the same slot.
+func redemptionSlot(tx *gorm.DB, coupon models.Coupon, customerID uint) (int, error) {
+	var taken []int
+	if err := tx.Model(&models.CouponRedemption{}).Where("coupon_id = ? AND customer_id = ?", coupon.ID, customerID).Order("seq").Pluck("seq", &taken).Error; err != nil {
+		return 0, err
+	}
+	if coupon.MaxRedemptionsPerCustomer == 0 {
+		if len(taken) == 0 {
+			return 1, nil
+		}
+		return taken[len(taken)-1] + 1, nil
+	}
+	seq := 1
+	for _, used := range taken {
+		if used == seq {
+			seq++
+		}
+	}
+	if seq > coupon.MaxRedemptionsPerCustomer {
+		return 0, errCouponCustomerLimit
+	}
+	return seq, nil
+}
+
+// releaseCoupon gives back the coupon use of a subscription that ends
+// without ever having been assigned, such as a rejected request. It does
+// nothing for other subscriptions.
+func releaseCoupon(tx *gorm.DB, subscription models.Subscription) error {
+	if subscription.CouponID == nil || subscription.AssignedAt != nil {
+		return nil
+	}
+	result := tx.Where("subscription_id = ?", subscription.ID).Delete(&models.CouponRedemption{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return tx.Model(&models.Coupon{}).Where("id = ? AND times_redeemed > 0", *subscription.CouponID).
+		Update("times_redeemed", gorm.Expr("times_redeemed - 1")).Error
+}
+
+// createSubscription stores a new subscription, applying couponCode to its
+// price if one is given and recording the redemption
+func createSubscription(db *gorm.DB, subscription *models.Subscription, couponCode string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var redemption models.CouponRedemption
+		if couponCode != "" {
+			price := models.PackPrice{PackID: subscription.PackID, Currency: subscription.PriceCurrency, Amount: subscription.PriceAmount}
+			var err error
+			if redemption, err = redeemCoupon(tx, couponCode, subscription.CustomerID, subscription.PackID, price); err != nil {
+				return err
+			}
+			subscription.CouponID = &redemption.CouponID
+			subscription.DiscountAmount = redemption.DiscountAmount
+			subscription.PriceAmount -= redemption.DiscountAmount
+		}
+
+		if err := tx.Create(subscription).Error; err != nil {
+			return err
+		}
+
+		if subscription.CouponID == nil {
+			return nil
+		}
+		redemption.SubscriptionID = subscription.ID
+		err := tx.Create(&redemption).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return errCouponCustomerLimit
+		}
+		return err
+	})
+}
+
+// couponRequest holds the admin-editable coupon fields
+type couponRequest struct {
+	Code                      *string    `json:"code" binding:"omitempty,min=3,max=64"`
+	Description               *string    `json:"description"`
+	DiscountType              *string    `json:"discount_type" binding:"omitempty,oneof=percentage fixed"`
+	PercentOff                *int       `json:"percent_off" binding:"omitempty,min=1,max=100"`
+	AmountOff                 *int64     `json:"amount_off" binding:"omitempty,min=1"`
+	Currency                  *string    `json:"currency" binding:"omitempty,len=3,alpha"`
+	StartsAt                  *time.Time `json:"starts_at"`
+	ExpiresAt                 *time.Time `json:"expires_at"`
+	MaxRedemptions            *int       `json:"max_redemptions" binding:"omitempty,min=0"`
+	MaxRedemptionsPerCustomer *int       `json:"max_redemptions_per_customer" binding:"omitempty,min=0"`
+	Active                    *bool      `json:"active"`
+	PackIDs                   *[]uint    `json:"pack_ids"`
+}
+
+// apply copies the fields present in the request onto coupon
+func (req couponRequest) apply(coupon *models.Coupon) {
+	if req.Code != nil {
+		coupon.Code = normalizeCouponCode(*req.Code)
+	}
+	if req.Description != nil {
+		coupon.Description = *req.Description
+	}
+	if req.DiscountType != nil {
+		coupon.DiscountType = *req.DiscountType
+	}
+	if req.PercentOff != nil {
+		coupon.PercentOff = *req.PercentOff
+	}
+	if req.AmountOff != nil {
+		coupon.AmountOff = *req.AmountOff
+	}
+	if req.Currency != nil {
+		coupon.Currency = utils.NormalizeCurrency(*req.Currency)
+	}
+	if req.StartsAt != nil {
+		coupon.StartsAt = req.StartsAt
+	}
+	if req.ExpiresAt != nil {
+		coupon.ExpiresAt = req.ExpiresAt
+	}
+	if req.MaxRedemptions != nil {
+		coupon.MaxRedemptions = *req.MaxRedemptions
+	}
+	if req.MaxRedemptionsPerCustomer != nil {
+		coupon.MaxRedemptionsPerCustomer = *req.MaxRedemptionsPerCustomer
+	}
+	if req.Active != nil {
+		coupon.Active = *req.Active
+	}
+}
+
+// validateCoupon checks the fields that depend on each other
+func validateCoupon(coupon models.Coupon) string {
+	switch {
+	case coupon.Code == "":
+		return "Coupon code is required"
+	case coupon.DiscountType == "percentage" && (coupon.PercentOff < 1 || coupon.PercentOff > 100):
+		return "percent_off must be between 1 and 100 for percentage coupons"
+	case coupon.DiscountType == "fixed" && (coupon.AmountOff < 1 || coupon.Currency == ""):
+		return "amount_off and currency are required for fixed coupons"
+	case coupon.DiscountType != "percentage" && coupon.DiscountType != "fixed":
+		return "discount_type must be percentage or fixed"
+	case coupon.StartsAt != nil && coupon.ExpiresAt != nil && !coupon.ExpiresAt.After(*coupon.StartsAt):
+		return "expires_at must be after starts_at"
+	}
+	return ""
+}
+
+// setCouponPacks replaces the packs a coupon is restricted to
+func setCouponPacks(tx *gorm.DB, coupon *models.Coupon, packIDs []uint) error {
+	var packs []models.SubscriptionPack
+	if len(packIDs) > 0 {
+		if err := tx.Where("id IN ? AND deleted_at IS NULL", packIDs).Find(&packs).Error; err != nil {
+			return err
+		}
+		if len(packs) != len(packIDs) {
+			return errCouponPackNotEligible
+		}
+	}
+	return tx.Model(coupon).Association("Packs").Replace(packs)
+}
+
+// couponList pages ListCoupons
+var couponList = pagination.List[models.Coupon]{
+	DefaultLimit: 10,
+	DefaultSort:  "created_at",
+	DefaultDesc:  true,
+	Sorts: map[string]pagination.Sort[models.Coupon]{
+		"id":         {Column: "id", Value: func(c *models.Coupon) any { return c.ID }},
+		"code":       {Column: "code", Value: func(c *models.Coupon) any { return c.Code }},
+		"created_at": {Column: "created_at", Value: func(c *models.Coupon) any { return c.CreatedAt }},
+		"expires_at": {Column: "expires_at", Value: func(c *models.Coupon) any { return c.ExpiresAt }},
+	},
+	ID: func(c *models.Coupon) uint { return c.ID },
+}
+
+// ListCoupons returns paginated list of coupons
+func ListCoupons(c *gin.Context) {
+	page, apiErr := couponList.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
+
+	var coupons []models.Coupon
+	var total int64
+
+	query := requestDB(c).Model(&models.Coupon{}).Where("deleted_at IS NULL")
+	if active := c.Query("active"); active != "" {
+		query = query.Where("active = ?", active == "true")
+	}
+
+	logDBError(c, "count coupons", query.Count(&total).Error)
+	logDBError(c, "list coupons", page.Apply(query).Preload("Packs").Find(&coupons).Error)
+	coupons, meta := page.Result(coupons, total)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"coupons":    coupons,
+		"pagination": meta,
+	})
+}
+
+// CreateCoupon creates a new coupon
+func CreateCoupon(c *gin.Context) {
+	var req couponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	coupon := models.Coupon{Active: true}
+	req.apply(&coupon)
+	if msg := validateCoupon(coupon); msg != "" {
+		apierror.AbortCode(c, apierror.ValidationFailed, msg)
+		return
+	}
+
+	var existing models.Coupon
+	if err := requestDB(c).Where("code = ?", coupon.Code).First(&existing).Error; err == nil {
+		apierror.AbortCode(c, apierror.CouponCodeAlreadyExists, "Coupon code already exists")
+		return
+	}
+
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Packs").Create(&coupon).Error; err != nil {
+			return err
+		}
+		if req.PackIDs != nil {
+			return setCouponPacks(tx, &coupon, *req.PackIDs)
+		}
+		return nil
+	})
+	if errors.Is(err, errCouponPackNotEligible) {
+		apierror.AbortCode(c, apierror.ValidationFailed, "One or more subscription packs not found")
+		return
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to create coupon")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"coupon":  coupon,
+	})
+}
+
+// GetCoupon returns coupon details
+func GetCoupon(c *gin.Context) {
+	id := c.Param("coupon_id")
+
+	var coupon models.Coupon
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).Preload("Packs").First(&coupon).Error; err != nil {
+		apierror.AbortCode(c, apierror.CouponNotFound, "Coupon not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"coupon":  coupon,
+	})
+}
+
+// UpdateCoupon updates a coupon
+func UpdateCoupon(c *gin.Context) {
+	id := c.Param("coupon_id")
+
+	var req couponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var coupon models.Coupon
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&coupon).Error; err != nil {
+		apierror.AbortCode(c, apierror.CouponNotFound, "Coupon not found")
+		return
+	}
+
+	originalCode := coupon.Code
+	req.apply(&coupon)
+	if msg := validateCoupon(coupon); msg != "" {
+		apierror.AbortCode(c, apierror.ValidationFailed, msg)
+		return
+	}
+
+	if coupon.Code != originalCode {
+		var existing models.Coupon
+		if err := requestDB(c).Where("code = ? AND id <> ?", coupon.Code, coupon.ID).First(&existing).Error; err == nil {
+			apierror.AbortCode(c, apierror.CouponCodeAlreadyExists, "Coupon code already exists")
+			return
+		}
+	}
+
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Packs").Save(&coupon).Error; err != nil {
+			return err
+		}
+		if req.PackIDs != nil {
+			return setCouponPacks(tx, &coupon, *req.PackIDs)
+		}
+		return nil
+	})
+	if errors.Is(err, errCouponPackNotEligible) {
+		apierror.AbortCode(c, apierror.ValidationFailed, "One or more subscription packs not found")
+		return
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to update coupon")
+		return
+	}
+
+	logDBError(c, "load coupon packs", requestDB(c).Model(&coupon).Association("Packs").Find(&coupon.Packs))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"coupon":  coupon,
+	})
+}
+
+// DeleteCoupon soft deletes a coupon
+func DeleteCoupon(c *gin.Context) {
+	id := c.Param("coupon_id")
+
+	now := time.Now()
+	result := requestDB(c).Model(&models.Coupon{}).Where("id = ? AND deleted_at IS NULL", id).Update("deleted_at", now)
+	if result.Error != nil || result.RowsAffected == 0 {
+		apierror.AbortCode(c, apierror.CouponNotFound, "Coupon not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Coupon deleted successfully",
+	})
+}
+
+// ListCouponRedemptions returns the subscriptions a coupon was used on
+func ListCouponRedemptions(c *gin.Context) {
+	id := c.Param("coupon_id")
+
+	var coupon models.Coupon
+	if err := requestDB(c).Where("id = ?", id).First(&coupon).Error; err != nil {
+		apierror.AbortCode(c, apierror.CouponNotFound, "Coupon not found")
+		return
+	}
+
+	var redemptions []models.CouponRedemption
+	logDBError(c, "list coupon redemptions", requestDB(c).Where("coupon_id = ?", coupon.ID).Order("created_at DESC").Find(&redemptions).Error)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"redemptions": redemptions,
+	})
+}
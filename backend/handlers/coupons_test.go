@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"license-mnm/database/dbtest"
+	"license-mnm/middleware"
+	"license-mnm/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestCouponDiscount(t *testing.T) {
+	usd := models.PackPrice{Currency: "USD", Amount: 1000}
+	tests := []struct {
+		name    string
+		coupon  models.Coupon
+		price   models.PackPrice
+		want    int64
+		wantErr error
+	}{
+		{"percentage", models.Coupon{DiscountType: "percentage", PercentOff: 25}, usd, 250, nil},
+		{"percentage rounds half up", models.Coupon{DiscountType: "percentage", PercentOff: 15}, models.PackPrice{Currency: "USD", Amount: 999}, 150, nil},
+		{"full percentage", models.Coupon{DiscountType: "percentage", PercentOff: 100}, usd, 1000, nil},
+		{"fixed", models.Coupon{DiscountType: "fixed", AmountOff: 300, Currency: "USD"}, usd, 300, nil},
+		{"fixed capped at price", models.Coupon{DiscountType: "fixed", AmountOff: 5000, Currency: "USD"}, usd, 1000, nil},
+		{"fixed in another currency", models.Coupon{DiscountType: "fixed", AmountOff: 300, Currency: "EUR"}, usd, 0, errCouponCurrencyMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := couponDiscount(tt.coupon, tt.price)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("couponDiscount() = %d, %v; want %d, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedemptionSlot(t *testing.T) {
+	db := dbtest.Open(t)
+	customer := testCustomer(t, db, "slots@example.com")
+
+	tests := []struct {
+		name    string
+		max     int
+		taken   []int
+		want    int
+		wantErr error
+	}{
+		{"first use", 2, nil, 1, nil},
+		{"next use", 3, []int{1}, 2, nil},
+		{"freed slot is reused", 3, []int{1, 3}, 2, nil},
+		{"all slots taken", 2, []int{1, 2}, 0, errCouponCustomerLimit},
+		{"unlimited starts at one", 0, nil, 1, nil},
+		{"unlimited follows the highest", 0, []int{1, 4}, 5, nil},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coupon := models.Coupon{Code: fmt.Sprintf("SLOT%d", i), DiscountType: "percentage", PercentOff: 10, Active: true, MaxRedemptionsPerCustomer: tt.max}
+			if err := db.Create(&coupon).Error; err != nil {
+				t.Fatal(err)
+			}
+			for _, seq := range tt.taken {
+				redemption := models.CouponRedemption{CouponID: coupon.ID, CustomerID: customer.ID, SubscriptionID: uint(seq), Currency: "USD", Seq: seq}
+				if err := db.Create(&redemption).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := redemptionSlot(db, coupon, customer.ID)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("redemptionSlot() = %d, %v; want %d, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedemptionSlotIsUnique(t *testing.T) {
+	db := dbtest.Open(t)
+	customer := testCustomer(t, db, "unique@example.com")
+
+	first := models.CouponRedemption{CouponID: 1, CustomerID: customer.ID, SubscriptionID: 1, Currency: "USD", Seq: 1}
+	if err := db.Create(&first).Error; err != nil {
+		t.Fatal(err)
+	}
+	second := models.CouponRedemption{CouponID: 1, CustomerID: customer.ID, SubscriptionID: 2, Currency: "USD", Seq: 1}
+	if err := db.Create(&second).Error; !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Errorf("second redemption in slot 1: got %v, want gorm.ErrDuplicatedKey", err)
+	}
+}
+
+func TestCreateSubscriptionPerCustomerLimit(t *testing.T) {
+	db := dbtest.Open(t)
+	customer := testCustomer(t, db, "limit@example.com")
+	pack := testPack(t, db, "LIMIT")
+	coupon := models.Coupon{Code: "ONCE", DiscountType: "percentage", PercentOff: 10, Active: true, MaxRedemptionsPerCustomer: 1}
+	if err := db.Create(&coupon).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent requests may fail on locks or on the limit, but only one
+	// may take the coupon
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subscription := models.Subscription{CustomerID: customer.ID, PackID: pack.ID, Status: "requested", PriceAmount: 1000, PriceCurrency: "USD"}
+			createSubscription(db, &subscription, "once")
+		}()
+	}
+	wg.Wait()
+
+	var redemptions int64
+	db.Model(&models.CouponRedemption{}).Where("coupon_id = ?", coupon.ID).Count(&redemptions)
+	db.First(&coupon, coupon.ID)
+	if redemptions != 1 || coupon.TimesRedeemed != 1 {
+		t.Errorf("got %d redemptions, times_redeemed %d; want 1 and 1", redemptions, coupon.TimesRedeemed)
+	}
+
+	subscription := models.Subscription{CustomerID: customer.ID, PackID: pack.ID, Status: "requested", PriceAmount: 1000, PriceCurrency: "USD"}
+	if err := createSubscription(db, &subscription, "ONCE"); err != errCouponCustomerLimit {
+		t.Errorf("another use: got %v, want errCouponCustomerLimit", err)
+	}
+}
+
+func TestReleaseCoupon(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       string
+		coupon       bool
+		wantReleased bool
+	}{
+		{"rejected request", "requested", true, true},
+		{"assigned subscription", "active", true, false},
+		{"no coupon", "requested", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			customer := testCustomer(t, db, "release@example.com")
+			pack := testPack(t, db, "RELEASE")
+			coupon := models.Coupon{Code: "CAPPED", DiscountType: "fixed", AmountOff: 100, Currency: "USD", Active: true, MaxRedemptions: 1, MaxRedemptionsPerCustomer: 1}
+			if err := db.Create(&coupon).Error; err != nil {
+				t.Fatal(err)
+			}
+			code := ""
+			if tt.coupon {
+				code = coupon.Code
+			}
+			subscription := testSubscription(t, db, customer, pack, tt.status, code)
+
+			if err := releaseCoupon(db, subscription); err != nil {
+				t.Fatalf("releaseCoupon: %v", err)
+			}
+
+			var redemptions int64
+			db.Model(&models.CouponRedemption{}).Where("subscription_id = ?", subscription.ID).Count(&redemptions)
+			db.First(&coupon, coupon.ID)
+			wantUses := int64(0)
+			if tt.coupon && !tt.wantReleased {
+				wantUses = 1
+			}
+			if redemptions != wantUses || int64(coupon.TimesRedeemed) != wantUses {
+				t.Errorf("got %d redemptions, times_redeemed %d; want %d", redemptions, coupon.TimesRedeemed, wantUses)
+			}
+
+			// A released use can be taken again, even with both caps at one
+			if tt.wantReleased {
+				testSubscription(t, db, customer, pack, "requested", coupon.Code)
+			}
+		})
+	}
+}
+
+func TestCreateCouponActive(t *testing.T) {
+	tests := []struct {
+		name       string
+		active     string // the active field of the request; omitted when empty
+		wantActive bool
+		wantErr    error
+	}{
+		{"inactive", `,"active":false`, false, errCouponInactive},
+		{"active", `,"active":true`, true, nil},
+		{"active by default", "", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			customer := testCustomer(t, db, "coupon@example.com")
+			pack := testPack(t, db, "COUPON")
+
+			r := gin.New()
+			r.Use(middleware.Errors(false))
+			r.POST("/coupons", CreateCoupon)
+			body := `{"code":"LAUNCH","discount_type":"percentage","percent_off":10` + tt.active + `}`
+			req := httptest.NewRequest(http.MethodPost, "/coupons", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("create: got %d %s", w.Code, w.Body)
+			}
+
+			var coupon models.Coupon
+			db.Where("code = ?", "LAUNCH").First(&coupon)
+			if coupon.Active != tt.wantActive {
+				t.Errorf("stored active %v, want %v", coupon.Active, tt.wantActive)
+			}
+			subscription := models.Subscription{CustomerID: customer.ID, PackID: pack.ID, Status: "requested", PriceAmount: 1000, PriceCurrency: "USD"}
+			if err := createSubscription(db, &subscription, "LAUNCH"); err != tt.wantErr {
+				t.Errorf("redeem: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,10 +1,11 @@
 package handlers
 
 import (
-	"license-mnm/database"
+	"errors"
+	"license-mnm/apierror"
 	"license-mnm/models"
+	"license-mnm/pagination"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,15 +15,16 @@ import (
 func GetCustomerSubscription(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 
-	var customer models.Customer
-	if err := database.DB.Where("user_id = ?", userID).First(&customer).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
 		return
 	}
+	customer := member.Customer
 
 	var subscription models.Subscription
-	if err := database.DB.Where("customer_id = ? AND status = ?", customer.ID, "active").Preload("Pack").First(&subscription).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "No active subscription found"})
+	if err := requestDB(c).Where("customer_id = ? AND status = ?", customer.ID, "active").Preload("Pack").First(&subscription).Error; err != nil {
+		apierror.AbortCode(c, apierror.NoActiveSubscription, "No active subscription found")
 		return
 	}
 
@@ -35,7 +37,8 @@ func GetCustomerSubscription(c *gin.Context) {
 			"pack": gin.H{
 				"name":            subscription.Pack.Name,
 				"sku":             subscription.Pack.SKU,
-				"price":           subscription.Pack.Price,
+				"price":           subscription.PriceAmount,
+				"currency":        subscription.PriceCurrency,
 				"validity_months": subscription.Pack.ValidityMonths,
 			},
 			"status":       subscription.Status,
@@ -51,43 +54,64 @@ func RequestSubscription(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 
 	var req struct {
-		SKU string `json:"sku" binding:"required"`
+		SKU        string `json:"sku" binding:"required"`
+		Currency   string `json:"currency" binding:"omitempty,len=3,alpha"`
+		CouponCode string `json:"coupon_code"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
 		return
 	}
 
-	var customer models.Customer
-	if err := database.DB.Where("user_id = ?", userID).First(&customer).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+	customer := member.Customer
+
+	if !canManageSubscriptions(member) {
+		apierror.AbortCode(c, apierror.Forbidden, "Only organization owners and billing members can change the subscription")
 		return
 	}
 
 	// Check if customer has active subscription
 	var activeSub models.Subscription
-	if err := database.DB.Where("customer_id = ? AND status = ?", customer.ID, "active").First(&activeSub).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Customer already has an active subscription"})
+	if err := requestDB(c).Where("customer_id = ? AND status = ?", customer.ID, "active").First(&activeSub).Error; err == nil {
+		apierror.AbortCode(c, apierror.SubscriptionAlreadyActive, "Customer already has an active subscription")
 		return
 	}
 
 	// Get pack by SKU
 	var pack models.SubscriptionPack
-	if err := database.DB.Where("sku = ? AND deleted_at IS NULL", req.SKU).First(&pack).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Subscription pack not found"})
+	if err := requestDB(c).Where("sku = ? AND deleted_at IS NULL", req.SKU).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+
+	price, err := resolvePackPrice(pack.ID, req.Currency)
+	if err != nil {
+		apierror.AbortCode(c, apierror.PackCurrencyUnavailable, "Subscription pack is not available in this currency")
 		return
 	}
 
 	subscription := models.Subscription{
-		CustomerID:  customer.ID,
-		PackID:      pack.ID,
-		Status:      "requested",
-		RequestedAt: time.Now(),
+		CustomerID:    customer.ID,
+		PackID:        pack.ID,
+		Status:        "requested",
+		RequestedAt:   time.Now(),
+		PriceAmount:   price.Amount,
+		PriceCurrency: price.Currency,
 	}
 
-	if err := database.DB.Create(&subscription).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create subscription request"})
+	if err := createSubscription(requestDB(c), &subscription, req.CouponCode); err != nil {
+		var couponErr *apierror.Error
+		if errors.As(err, &couponErr) {
+			apierror.Abort(c, couponErr)
+			return
+		}
+		apierror.AbortCode(c, apierror.Internal, "Failed to create subscription request")
 		return
 	}
 
@@ -95,9 +119,12 @@ func RequestSubscription(c *gin.Context) {
 		"success": true,
 		"message": "Subscription request submitted successfully",
 		"subscription": gin.H{
-			"id":           subscription.ID,
-			"status":       subscription.Status,
-			"requested_at": subscription.RequestedAt,
+			"id":              subscription.ID,
+			"status":          subscription.Status,
+			"requested_at":    subscription.RequestedAt,
+			"price":           subscription.PriceAmount,
+			"currency":        subscription.PriceCurrency,
+			"discount_amount": subscription.DiscountAmount,
 		},
 	})
 }
@@ -106,22 +133,32 @@ func RequestSubscription(c *gin.Context) {
 func DeactivateSubscription(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 
-	var customer models.Customer
-	if err := database.DB.Where("user_id = ?", userID).First(&customer).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+	customer := member.Customer
+
+	if !canManageSubscriptions(member) {
+		apierror.AbortCode(c, apierror.Forbidden, "Only organization owners and billing members can change the subscription")
 		return
 	}
 
 	var subscription models.Subscription
-	if err := database.DB.Where("customer_id = ? AND status = ?", customer.ID, "active").First(&subscription).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "No active subscription found"})
+	if err := requestDB(c).Where("customer_id = ? AND status = ?", customer.ID, "active").First(&subscription).Error; err != nil {
+		apierror.AbortCode(c, apierror.NoActiveSubscription, "No active subscription found")
 		return
 	}
 
 	now := time.Now()
 	subscription.Status = "inactive"
 	subscription.DeactivatedAt = &now
-	database.DB.Save(&subscription)
+	if err := requestDB(c).Save(&subscription).Error; err != nil {
+		logDBError(c, "deactivate subscription", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to deactivate subscription")
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success":       true,
@@ -130,32 +167,38 @@ func DeactivateSubscription(c *gin.Context) {
 	})
 }
 
+// historyList pages GetSubscriptionHistory and SDKGetSubscriptionHistory
+var historyList = pagination.List[models.Subscription]{
+	DefaultLimit: 10,
+	DefaultSort:  "created_at",
+	DefaultDesc:  true,
+	Sorts:        subscriptionSorts,
+	ID:           func(s *models.Subscription) uint { return s.ID },
+}
+
 // GetSubscriptionHistory returns customer's subscription history
 func GetSubscriptionHistory(c *gin.Context) {
 	userID, _ := c.Get("user_id")
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	sort := c.DefaultQuery("sort", "desc")
-	offset := (page - 1) * limit
-
-	var customer models.Customer
-	if err := database.DB.Where("user_id = ?", userID).First(&customer).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	page, apiErr := historyList.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
+
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
 		return
 	}
+	customer := member.Customer
 
 	var subscriptions []models.Subscription
 	var total int64
 
-	query := database.DB.Model(&models.Subscription{}).Where("customer_id = ?", customer.ID)
-	query.Count(&total)
-
-	orderBy := "created_at DESC"
-	if sort == "asc" {
-		orderBy = "created_at ASC"
-	}
-
-	query.Order(orderBy).Offset(offset).Limit(limit).Preload("Pack").Find(&subscriptions)
+	query := requestDB(c).Model(&models.Subscription{}).Where("customer_id = ?", customer.ID)
+	logDBError(c, "count subscription history", query.Count(&total).Error)
+	logDBError(c, "list subscription history", page.Apply(query).Preload("Pack").Find(&subscriptions).Error)
+	subscriptions, meta := page.Result(subscriptions, total)
 
 	var history []map[string]interface{}
 	for _, sub := range subscriptions {
@@ -171,11 +214,7 @@ func GetSubscriptionHistory(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"history": history,
-		"pagination": gin.H{
-			"page":  page,
-			"limit": limit,
-			"total": total,
-		},
+		"pagination": meta,
 	})
 }
 
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"license-mnm/apierror"
+	"license-mnm/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// exportBatchSize is how many customers an export loads at a time
+const exportBatchSize = 500
+
+// exportWriteTimeout is how long writing one batch of an export may take.
+// The deadline moves with every batch, so large exports outlast the
+// server's write timeout.
+const exportWriteTimeout = 30 * time.Second
+
+// customerExportColumns are the columns of a CSV export. The first three
+// match the import columns, so an export can be imported elsewhere.
+var customerExportColumns = []string{
+	"name", "email", "phone", "customer_id", "created_at",
+	"subscription_id", "pack_sku", "status", "requested_at", "assigned_at", "expires_at",
+	"price_amount", "price_currency",
+}
+
+// ExportCustomers streams every customer and their subscriptions, as CSV
+// (format=csv, the default; one row per subscription) or NDJSON
+// (format=ndjson; one customer object per line)
+func ExportCustomers(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "ndjson" {
+		apierror.Abort(c, apierror.Fields(apierror.FieldError{Field: "format", Rule: "oneof", Message: "must be one of: csv, ndjson"}))
+		return
+	}
+
+	filename := "customers-" + time.Now().Format("20060102") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+
+	controller := http.NewResponseController(c.Writer)
+	csvWriter := csv.NewWriter(c.Writer)
+	jsonEncoder := json.NewEncoder(c.Writer)
+	if format == "csv" {
+		csvWriter.Write(customerExportColumns)
+	}
+
+	var afterID uint
+	for {
+		controller.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+
+		var customers []models.Customer
+		err := requestDB(c).Preload("User").Preload("Subscriptions", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id")
+		}).Preload("Subscriptions.Pack").
+			Where("id > ? AND deleted_at IS NULL", afterID).
+			Order("id").Limit(exportBatchSize).Find(&customers).Error
+		if err != nil {
+			// Headers are already sent, so the client sees a truncated file
+			logDBError(c, "export customers", err)
+			return
+		}
+
+		for _, customer := range customers {
+			if format == "csv" {
+				writeCustomerCSV(csvWriter, customer)
+			} else if err := jsonEncoder.Encode(exportedCustomer(customer)); err != nil {
+				return
+			}
+		}
+		csvWriter.Flush()
+		if csvWriter.Error() != nil {
+			return
+		}
+		c.Writer.Flush()
+
+		if len(customers) < exportBatchSize {
+			return
+		}
+		afterID = customers[len(customers)-1].ID
+	}
+}
+
+// writeCustomerCSV writes a row per subscription, or a single row with empty
+// subscription columns for a customer without one
+func writeCustomerCSV(w *csv.Writer, customer models.Customer) {
+	base := []string{
+		customer.Name, customer.User.Email, customer.Phone,
+		strconv.FormatUint(uint64(customer.ID), 10), customer.CreatedAt.Format(time.RFC3339),
+	}
+	if len(customer.Subscriptions) == 0 {
+		w.Write(append(base, make([]string, len(customerExportColumns)-len(base))...))
+		return
+	}
+	for _, subscription := range customer.Subscriptions {
+		w.Write(append(base[:len(base):len(base)],
+			strconv.FormatUint(uint64(subscription.ID), 10),
+			subscription.Pack.SKU,
+			subscription.Status,
+			subscription.RequestedAt.Format(time.RFC3339),
+			formatTime(subscription.AssignedAt),
+			formatTime(subscription.ExpiresAt),
+			strconv.FormatInt(subscription.PriceAmount, 10),
+			subscription.PriceCurrency,
+		))
+	}
+}
+
+// formatTime formats an optional time as RFC 3339, or "" when it is unset
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// customerExport is a customer in an NDJSON export
+type customerExport struct {
+	ID            uint                 `json:"id"`
+	Name          string               `json:"name"`
+	Email         string               `json:"email"`
+	Phone         string               `json:"phone"`
+	CreatedAt     time.Time            `json:"created_at"`
+	Subscriptions []subscriptionExport `json:"subscriptions"`
+}
+
+// subscriptionExport is a subscription in an NDJSON export
+type subscriptionExport struct {
+	ID            uint       `json:"id"`
+	PackSKU       string     `json:"pack_sku"`
+	Status        string     `json:"status"`
+	RequestedAt   time.Time  `json:"requested_at"`
+	AssignedAt    *time.Time `json:"assigned_at"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	PriceAmount   int64      `json:"price_amount"`
+	PriceCurrency string     `json:"price_currency"`
+}
+
+func exportedCustomer(customer models.Customer) customerExport {
+	exported := customerExport{
+		ID:            customer.ID,
+		Name:          customer.Name,
+		Email:         customer.User.Email,
+		Phone:         customer.Phone,
+		CreatedAt:     customer.CreatedAt,
+		Subscriptions: make([]subscriptionExport, len(customer.Subscriptions)),
+	}
+	for i, subscription := range customer.Subscriptions {
+		exported.Subscriptions[i] = subscriptionExport{
+			ID:            subscription.ID,
+			PackSKU:       subscription.Pack.SKU,
+			Status:        subscription.Status,
+			RequestedAt:   subscription.RequestedAt,
+			AssignedAt:    subscription.AssignedAt,
+			ExpiresAt:     subscription.ExpiresAt,
+			PriceAmount:   subscription.PriceAmount,
+			PriceCurrency: subscription.PriceCurrency,
+		}
+	}
+	return exported
+}
@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/jobs"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+)
+
+// Limits on one import request
+const (
+	maxImportBytes = 10 << 20
+	maxImportRows  = 10000
+)
+
+// JobKindCustomerImport is the kind of jobs ImportCustomers starts
+const JobKindCustomerImport = "customer_import"
+
+// customerImportRow is one customer of an import file
+type customerImportRow struct {
+	Name     string `json:"name" binding:"required"`
+	Email    string `json:"email" binding:"required,email"`
+	Phone    string `json:"phone" binding:"required"`
+	PackSKU  string `json:"pack_sku"`                                 // assigned as an active subscription when set
+	Currency string `json:"currency" binding:"omitempty,len=3,alpha"` // of the pack price; the default currency when empty
+}
+
+// parsedImportRow is a row of an import file, or why it couldn't be read
+type parsedImportRow struct {
+	number int
+	row    customerImportRow
+	err    *models.JobError
+}
+
+// ImportCustomers starts a job creating the customers in a CSV (text/csv,
+// with a header row) or NDJSON (application/x-ndjson) body. Rows with a
+// pack_sku get an active subscription to that pack. With dry_run=true rows
+// are only checked. The job is returned with 202; poll GET /jobs/:job_id for
+// the outcome and each created customer's password setup token.
+func ImportCustomers(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apierror.AbortCode(c, apierror.PayloadTooLarge, fmt.Sprintf("Import files are limited to %d MB", maxImportBytes>>20))
+		return
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.ValidationFailed, "Request body could not be read")
+		return
+	}
+
+	var rows []parsedImportRow
+	switch c.ContentType() {
+	case "text/csv":
+		rows, err = parseImportCSV(body)
+	case "application/x-ndjson", "application/ndjson":
+		rows, err = parseImportNDJSON(body)
+	default:
+		apierror.AbortCode(c, apierror.UnsupportedMediaType, "Send customers as text/csv or application/x-ndjson")
+		return
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.ValidationFailed, err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		apierror.AbortCode(c, apierror.ValidationFailed, "The file has no customers")
+		return
+	}
+	if len(rows) > maxImportRows {
+		apierror.AbortCode(c, apierror.PayloadTooLarge, fmt.Sprintf("Imports are limited to %d customers", maxImportRows))
+		return
+	}
+
+	role, _ := c.Get("role")
+	roleName, _ := role.(string)
+	for _, row := range rows {
+		if row.row.PackSKU != "" && !rbac.HasPermission(roleName, rbac.SubscriptionsWrite) {
+			apierror.AbortCode(c, apierror.PermissionDenied, "Missing permission: "+string(rbac.SubscriptionsWrite)+" (to assign pack_sku)")
+			return
+		}
+	}
+
+	job := models.Job{Kind: JobKindCustomerImport, DryRun: dryRun, CreatedBy: currentUserID(c)}
+	err = jobs.Start(&job, len(rows), func(ctx context.Context, progress *jobs.Progress) error {
+		return importCustomers(ctx, progress, rows)
+	})
+	if err != nil {
+		logDBError(c, "start customer import", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to start import")
+		return
+	}
+
+	c.Header("Location", fmt.Sprintf("/api/v1/admin/jobs/%d", job.ID))
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"job":     job,
+	})
+}
+
+// parseImportCSV reads a CSV file whose header names the columns of
+// customerImportRow. Unknown columns are ignored, so exports can be
+// imported.
+func parseImportCSV(body []byte) ([]parsedImportRow, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("CSV header could not be read: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"name", "email", "phone"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header must have name, email and phone columns; %s is missing", required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []parsedImportRow
+	for number := 1; ; number++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, parsedImportRow{number: number, err: &models.JobError{
+				Row: number, Code: string(apierror.ValidationFailed), Message: "Row is not valid CSV: " + parseErr.Err.Error(),
+			}})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, parsedImportRow{number: number, row: customerImportRow{
+			Name:     field(record, "name"),
+			Email:    field(record, "email"),
+			Phone:    field(record, "phone"),
+			PackSKU:  field(record, "pack_sku"),
+			Currency: field(record, "currency"),
+		}})
+	}
+}
+
+// parseImportNDJSON reads one JSON object per line; blank lines are skipped
+// but counted, so row numbers are line numbers
+func parseImportNDJSON(body []byte) ([]parsedImportRow, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+
+	var rows []parsedImportRow
+	for number := 1; scanner.Scan(); number++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var row customerImportRow
+		if err := json.Unmarshal(line, &row); err != nil {
+			rows = append(rows, parsedImportRow{number: number, err: &models.JobError{
+				Row: number, Code: string(apierror.ValidationFailed), Message: "Line is not a valid JSON object",
+			}})
+			continue
+		}
+		rows = append(rows, parsedImportRow{number: number, row: row})
+	}
+	return rows, scanner.Err()
+}
+
+// importCustomers checks every row and, unless the job is a dry run, creates
+// the customers that pass. Each row is created in its own transaction, so a
+// failed row leaves nothing behind and doesn't stop the others.
+func importCustomers(ctx context.Context, progress *jobs.Progress, rows []parsedImportRow) error {
+	db := database.DB.WithContext(ctx)
+	emails := make(map[string]int, len(rows)) // row each email first appeared in
+	packs := make(map[string]*models.SubscriptionPack)
+
+	for _, parsed := range rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if parsed.err != nil {
+			progress.Failed(*parsed.err)
+			continue
+		}
+		row, number := parsed.row, parsed.number
+
+		if err := binding.Validator.ValidateStruct(&row); err != nil {
+			var rowErrs []models.JobError
+			for _, detail := range apierror.Validation(err).Details {
+				rowErrs = append(rowErrs, models.JobError{Row: number, Code: string(apierror.ValidationFailed), Field: detail.Field, Message: detail.Message})
+			}
+			progress.Failed(rowErrs...)
+			continue
+		}
+
+		email := strings.ToLower(row.Email)
+		if first, seen := emails[email]; seen {
+			progress.Failed(models.JobError{Row: number, Code: string(apierror.EmailAlreadyRegistered), Field: "email", Message: fmt.Sprintf("Email is already used in row %d", first)})
+			continue
+		}
+		emails[email] = number
+
+		var pack *models.SubscriptionPack
+		var price models.PackPrice
+		if row.PackSKU != "" {
+			var err error
+			if pack, err = importPack(db, packs, row.PackSKU); err != nil {
+				return err
+			}
+			if pack == nil {
+				progress.Failed(models.JobError{Row: number, Code: string(apierror.PackNotFound), Field: "pack_sku", Message: "No subscription pack has this SKU"})
+				continue
+			}
+			price, err = resolvePackPrice(pack.ID, row.Currency)
+			if errors.Is(err, errPackNotPriced) {
+				progress.Failed(models.JobError{Row: number, Code: string(apierror.PackCurrencyUnavailable), Field: "currency", Message: "Subscription pack is not available in this currency"})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if progress.DryRun() {
+			var existing int64
+			if err := db.Model(&models.User{}).Where("email = ?", row.Email).Count(&existing).Error; err != nil {
+				return err
+			}
+			if existing > 0 {
+				progress.Failed(models.JobError{Row: number, Code: string(apierror.EmailAlreadyRegistered), Field: "email", Message: "Email already registered"})
+				continue
+			}
+			progress.Succeeded()
+			continue
+		}
+
+		var result models.JobResult
+		err := db.Transaction(func(tx *gorm.DB) error {
+			customer, setupToken, setup, err := newCustomer(tx, row.Name, row.Email, row.Phone)
+			if err != nil {
+				return err
+			}
+			result = models.JobResult{Row: number, CustomerID: customer.ID, SetupToken: setupToken, SetupExpiresAt: &setup.ExpiresAt}
+			if pack == nil {
+				return nil
+			}
+			now := time.Now()
+			expiresAt := now.AddDate(0, pack.ValidityMonths, 0)
+			return createSubscription(tx, &models.Subscription{
+				CustomerID:    customer.ID,
+				PackID:        pack.ID,
+				Status:        "active",
+				RequestedAt:   now,
+				AssignedAt:    &now,
+				ExpiresAt:     &expiresAt,
+				PriceAmount:   price.Amount,
+				PriceCurrency: price.Currency,
+			}, "")
+		})
+		switch {
+		case errors.Is(err, errEmailRegistered):
+			progress.Failed(models.JobError{Row: number, Code: string(apierror.EmailAlreadyRegistered), Field: "email", Message: "Email already registered"})
+		case err != nil:
+			return err
+		default:
+			progress.Succeeded(result)
+		}
+	}
+	return nil
+}
+
+// importPack looks up a live pack by SKU, caching the result in packs.
+// It returns nil when there is no such pack.
+func importPack(db *gorm.DB, packs map[string]*models.SubscriptionPack, sku string) (*models.SubscriptionPack, error) {
+	if pack, ok := packs[sku]; ok {
+		return pack, nil
+	}
+	var pack models.SubscriptionPack
+	err := db.Where("sku = ? AND deleted_at IS NULL", sku).First(&pack).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		packs[sku] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	packs[sku] = &pack
+	return &pack, nil
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"license-mnm/database/dbtest"
+	"license-mnm/jobs"
+	"license-mnm/lockout"
+	"license-mnm/middleware"
+	"license-mnm/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// importSetupToken imports one customer and returns its setup token from the job
+func importSetupToken(t *testing.T, db *gorm.DB, r *gin.Engine, email string) string {
+	t.Helper()
+	body := fmt.Sprintf(`{"name":"Imported","email":%q,"phone":"+15550100"}`, email)
+	req := httptest.NewRequest(http.MethodPost, "/customers/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var started struct{ Job models.Job }
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil || w.Code != http.StatusAccepted {
+		t.Fatalf("import: got %d %s", w.Code, w.Body)
+	}
+
+	var job models.Job
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		db.First(&job, started.Job.ID)
+		if job.Status == jobs.StatusSucceeded || job.Status == jobs.StatusFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("import job still %s", job.Status)
+		}
+	}
+	if job.Status != jobs.StatusSucceeded || len(job.Results) != 1 || job.Results[0].SetupToken == "" || job.Results[0].SetupExpiresAt == nil {
+		t.Fatalf("import job: %+v", job)
+	}
+	return job.Results[0].SetupToken
+}
+
+// createSetupToken creates one customer and returns its setup token from the response
+func createSetupToken(t *testing.T, r *gin.Engine, email string) string {
+	t.Helper()
+	body := fmt.Sprintf(`{"name":"Created","email":%q,"phone":"+15550100"}`, email)
+	req := httptest.NewRequest(http.MethodPost, "/customers", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var created struct {
+		SetupToken string `json:"setup_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated || created.SetupToken == "" {
+		t.Fatalf("create: got %d %s", w.Code, w.Body)
+	}
+	return created.SetupToken
+}
+
+func TestNewCustomersHaveNoDefaultPassword(t *testing.T) {
+	tests := []struct {
+		name   string
+		create func(t *testing.T, db *gorm.DB, r *gin.Engine, email string) string
+	}{
+		{"import", importSetupToken},
+		{"create", func(t *testing.T, _ *gorm.DB, r *gin.Engine, email string) string {
+			return createSetupToken(t, r, email)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			saved := lockout.Logins
+			t.Cleanup(func() { lockout.Logins = saved })
+			lockout.Logins = lockout.NewGuard(lockout.NewMemoryStore(),
+				lockout.Policy{MaxFailures: 100, Lockout: time.Minute},
+				lockout.Policy{MaxFailures: 100, Lockout: time.Minute})
+
+			r := gin.New()
+			r.Use(middleware.Errors(false))
+			r.POST("/customers", CreateCustomer)
+			r.POST("/customers/import", ImportCustomers)
+			r.POST("/customer/login", CustomerLogin)
+			r.POST("/customer/password-setup", SetupCustomerPassword)
+			r.POST("/admin/password-setup", SetupAdminPassword)
+			send := func(target, body string) int {
+				req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			email := tt.name + "@example.com"
+			token := tt.create(t, db, r, email)
+			var user models.User
+			db.Where("email = ?", email).First(&user)
+			if user.PasswordHash != "" {
+				t.Errorf("new user has a password hash")
+			}
+
+			steps := []struct {
+				name       string
+				target     string
+				body       string
+				wantStatus int
+			}{
+				{"default password", "/customer/login", fmt.Sprintf(`{"email":%q,"password":"password123"}`, email), http.StatusUnauthorized},
+				{"token at the admin endpoint", "/admin/password-setup", fmt.Sprintf(`{"token":%q,"password":"chosen-secret"}`, token), http.StatusBadRequest},
+				{"token at the customer endpoint", "/customer/password-setup", fmt.Sprintf(`{"token":%q,"password":"chosen-secret"}`, token), http.StatusOK},
+				{"token reused", "/customer/password-setup", fmt.Sprintf(`{"token":%q,"password":"another-secret"}`, token), http.StatusBadRequest},
+				{"chosen password", "/customer/login", fmt.Sprintf(`{"email":%q,"password":"chosen-secret"}`, email), http.StatusOK},
+			}
+			for _, step := range steps {
+				if got := send(step.target, step.body); got != step.wantStatus {
+					t.Errorf("%s: got %d, want %d", step.name, got, step.wantStatus)
+				}
+			}
+		})
+	}
+}
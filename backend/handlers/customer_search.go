@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"html"
+	"license-mnm/database"
+	"license-mnm/models"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Matched search terms are wrapped in these markers in highlights, whose
+// text is HTML-escaped so clients can render them as HTML
+const (
+	highlightStart = "<mark>"
+	highlightEnd   = "</mark>"
+)
+
+// ftsHighlightStart and ftsHighlightEnd delimit matches in FTS5 highlight()
+// output. They are control characters, so they survive HTML escaping and are
+// then replaced with the HTML markers.
+const (
+	ftsHighlightStart = "\x02"
+	ftsHighlightEnd   = "\x03"
+)
+
+var ftsHighlightMarkers = strings.NewReplacer(ftsHighlightStart, highlightStart, ftsHighlightEnd, highlightEnd)
+
+// customerSearchFields are the fields search matches, in customer_search
+// column order
+var customerSearchFields = []string{"name", "email", "phone"}
+
+// customerSearchRank orders full-text matches best first. Name matches
+// weigh most, then email, then phone.
+const customerSearchRank = "bm25(customer_search, 10.0, 5.0, 1.0)"
+
+// searchCustomers restricts a customers query joined with users to rows
+// where every search term prefixes a word of the name, email or phone, or,
+// without the full-text index, appears anywhere in one of them
+func searchCustomers(query *gorm.DB, terms []string) *gorm.DB {
+	if database.FullTextSearch() {
+		return query.Joins("JOIN customer_search ON customer_search.rowid = customers.id").
+			Where("customer_search MATCH ?", ftsQuery(terms))
+	}
+	for _, term := range terms {
+		pattern := "%" + likeEscaper.Replace(term) + "%"
+		query = query.Where(`(customers.name LIKE ? ESCAPE '\' OR users.email LIKE ? ESCAPE '\' OR customers.phone LIKE ? ESCAPE '\')`,
+			pattern, pattern, pattern)
+	}
+	return query
+}
+
+// ftsQuery quotes each term so FTS5 syntax in it isn't interpreted, and
+// matches it as a prefix
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// likeEscaper escapes LIKE wildcards in a search term
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// customerHighlights returns, per customer ID, the fields that matched the
+// search with the matches marked
+func customerHighlights(db *gorm.DB, terms []string, customers []models.Customer) (map[uint]map[string]string, error) {
+	highlights := make(map[uint]map[string]string, len(customers))
+	if len(customers) == 0 {
+		return highlights, nil
+	}
+
+	if !database.FullTextSearch() {
+		pattern := termPattern(terms)
+		for _, customer := range customers {
+			highlights[customer.ID] = markedFields(
+				markMatches(pattern, customer.Name),
+				markMatches(pattern, customer.User.Email),
+				markMatches(pattern, customer.Phone),
+			)
+		}
+		return highlights, nil
+	}
+
+	ids := make([]uint, len(customers))
+	for i, customer := range customers {
+		ids[i] = customer.ID
+	}
+	var rows []struct {
+		ID    uint
+		Name  string
+		Email string
+		Phone string
+	}
+	err := db.Raw(`SELECT rowid AS id,
+		highlight(customer_search, 0, ?, ?) AS name,
+		highlight(customer_search, 1, ?, ?) AS email,
+		highlight(customer_search, 2, ?, ?) AS phone
+		FROM customer_search WHERE customer_search MATCH ? AND rowid IN ?`,
+		ftsHighlightStart, ftsHighlightEnd, ftsHighlightStart, ftsHighlightEnd, ftsHighlightStart, ftsHighlightEnd, ftsQuery(terms), ids).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		highlights[row.ID] = markedFields(
+			ftsHighlightMarkers.Replace(html.EscapeString(row.Name)),
+			ftsHighlightMarkers.Replace(html.EscapeString(row.Email)),
+			ftsHighlightMarkers.Replace(html.EscapeString(row.Phone)),
+		)
+	}
+	return highlights, nil
+}
+
+// markedFields maps customerSearchFields to their marked values, in the
+// same order, leaving out fields without a match
+func markedFields(values ...string) map[string]string {
+	fields := make(map[string]string)
+	for i, value := range values {
+		if strings.Contains(value, highlightStart) {
+			fields[customerSearchFields[i]] = value
+		}
+	}
+	return fields
+}
+
+// markMatches HTML-escapes value and wraps the matches of pattern in the
+// highlight markers. Matching runs on the raw value, so terms never match
+// inside the escapes.
+func markMatches(pattern *regexp.Regexp, value string) string {
+	var marked strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringIndex(value, -1) {
+		if match[0] == match[1] {
+			continue
+		}
+		marked.WriteString(html.EscapeString(value[last:match[0]]))
+		marked.WriteString(highlightStart + html.EscapeString(value[match[0]:match[1]]) + highlightEnd)
+		last = match[1]
+	}
+	marked.WriteString(html.EscapeString(value[last:]))
+	return marked.String()
+}
+
+// termPattern matches any of the terms, ignoring case
+func termPattern(terms []string) *regexp.Regexp {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"license-mnm/database/dbtest"
+	"license-mnm/middleware"
+	"license-mnm/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMarkMatches(t *testing.T) {
+	tests := []struct {
+		terms []string
+		value string
+		want  string
+	}{
+		{[]string{"acme"}, "Acme & ACME", "<mark>Acme</mark> &amp; <mark>ACME</mark>"},
+		{[]string{"amp"}, "A & B", "A &amp; B"},
+		{[]string{"<b>"}, "x<b>y", "x<mark>&lt;b&gt;</mark>y"},
+		{[]string{"a.c"}, "abc a.c", "abc <mark>a.c</mark>"},
+		{[]string{"zz"}, `"quoted" 'text'`, "&#34;quoted&#34; &#39;text&#39;"},
+	}
+	for _, tt := range tests {
+		if got := markMatches(termPattern(tt.terms), tt.value); got != tt.want {
+			t.Errorf("markMatches(%v, %q) = %q, want %q", tt.terms, tt.value, got, tt.want)
+		}
+	}
+}
+
+// The same highlights come back with and without the FTS5 index; run with
+// -tags sqlite_fts5 to cover both
+func TestCustomerSearchHighlightsAreEscaped(t *testing.T) {
+	db := dbtest.Open(t)
+	customer := testCustomer(t, db, "evil@example.com")
+	name := `<img src=x onerror=alert(1)> Acme & Co`
+	if err := db.Model(&models.Customer{}).Where("id = ?", customer.ID).Update("name", name).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(middleware.Errors(false))
+	r.GET("/customers", ListCustomers)
+
+	tests := []struct {
+		search string
+		want   map[string]string
+	}{
+		{"acme", map[string]string{"name": "&lt;img src=x onerror=alert(1)&gt; <mark>Acme</mark> &amp; Co"}},
+		{"onerror", map[string]string{"name": "&lt;img src=x <mark>onerror</mark>=alert(1)&gt; Acme &amp; Co"}},
+		{"evil", map[string]string{"email": "<mark>evil</mark>@example.com"}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/customers?search="+url.QueryEscape(tt.search), nil))
+		var body struct {
+			Customers []struct {
+				Name       string
+				Highlights map[string]string
+			}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Customers) != 1 {
+			t.Fatalf("search %q: got %d %s", tt.search, w.Code, w.Body)
+		}
+		if got := body.Customers[0]; got.Name != name || !reflect.DeepEqual(got.Highlights, tt.want) {
+			t.Errorf("search %q: name %q, highlights %q; want highlights %q", tt.search, got.Name, got.Highlights, tt.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"license-mnm/database"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// requestDB returns the database bound to the request's context, so its
+// queries are traced as children of the request span
+func requestDB(c *gin.Context) *gorm.DB {
+	return database.DB.WithContext(c.Request.Context())
+}
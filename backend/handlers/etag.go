@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"license-mnm/apierror"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errVersionConflict means another request changed a row after it was loaded
+var errVersionConflict = errors.New("row was changed by another request")
+
+// etag is the entity tag of a row at version
+func etag(version uint) string {
+	return `"` + strconv.FormatUint(uint64(version), 10) + `"`
+}
+
+// setETag sends a row's version as the response's ETag
+func setETag(c *gin.Context, version uint) {
+	c.Header("ETag", etag(version))
+}
+
+// ifMatch checks the If-Match header against the version of the row a
+// request changes. Without the header any version matches. It writes 412
+// and returns false when none of the listed tags is the row's.
+func ifMatch(c *gin.Context, version uint) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	abortVersionConflict(c)
+	return false
+}
+
+// saveVersioned saves every field of row, but not its associations, and
+// increments *version, the version row was loaded at. It fails with
+// errVersionConflict, leaving *version as it was, when the row was changed
+// after it was loaded.
+func saveVersioned(tx *gorm.DB, row interface{}, version *uint) error {
+	loaded := *version
+	*version = loaded + 1
+
+	result := tx.Model(row).Where("version = ?", loaded).Select("*").Omit(clause.Associations).Updates(row)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = errVersionConflict
+	}
+	if result.Error != nil {
+		*version = loaded
+	}
+	return result.Error
+}
+
+// abortVersionConflict rejects a change to a row that was changed meanwhile:
+// 412 when the client sent If-Match, 409 when its update just lost a race
+func abortVersionConflict(c *gin.Context) {
+	if c.GetHeader("If-Match") != "" {
+		apierror.AbortCode(c, apierror.PreconditionFailed, "The resource was changed since it was fetched; fetch it again and retry")
+		return
+	}
+	apierror.AbortCode(c, apierror.ConcurrentUpdate, "The resource was changed by another request; retry")
+}
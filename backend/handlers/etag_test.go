@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"fmt"
+	"license-mnm/apierror"
+	"license-mnm/database/dbtest"
+	"license-mnm/middleware"
+	"license-mnm/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		wantOK     bool
+		wantStatus int
+	}{
+		{"no header", "", true, http.StatusOK},
+		{"current version", `"3"`, true, http.StatusOK},
+		{"any version", "*", true, http.StatusOK},
+		{"one of several", `"2", "3"`, true, http.StatusOK},
+		{"stale version", `"2"`, false, http.StatusPreconditionFailed},
+		{"unquoted tag", "3", false, http.StatusPreconditionFailed},
+		{"weak tag", `W/"3"`, false, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(middleware.Errors(false))
+			var ok bool
+			r.PUT("/", func(c *gin.Context) {
+				if ok = ifMatch(c, 3); ok {
+					c.Status(http.StatusOK)
+				}
+			})
+			req := httptest.NewRequest(http.MethodPut, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("If-Match", tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if ok != tt.wantOK || w.Code != tt.wantStatus {
+				t.Errorf("ifMatch() = %v with %d; want %v with %d", ok, w.Code, tt.wantOK, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSaveVersioned(t *testing.T) {
+	db := dbtest.Open(t)
+	customer := testCustomer(t, db, "versioned@example.com")
+
+	// Two requests load the customer at version 1
+	var first, second models.Customer
+	db.First(&first, customer.ID)
+	db.First(&second, customer.ID)
+
+	first.Name = "First"
+	if err := saveVersioned(db, &first, &first.Version); err != nil || first.Version != 2 {
+		t.Fatalf("first save: %v, version %d; want version 2", err, first.Version)
+	}
+
+	second.Name = "Second"
+	if err := saveVersioned(db, &second, &second.Version); err != errVersionConflict || second.Version != 1 {
+		t.Errorf("stale save: %v, version %d; want errVersionConflict, version 1", err, second.Version)
+	}
+
+	var stored models.Customer
+	db.First(&stored, customer.ID)
+	if stored.Name != "First" || stored.Version != 2 {
+		t.Errorf("stored %q at version %d, want %q at 2", stored.Name, stored.Version, "First")
+	}
+
+	// Reloaded, the second request's change applies
+	db.First(&second, customer.ID)
+	second.Name = "Second"
+	if err := saveVersioned(db, &second, &second.Version); err != nil || second.Version != 3 {
+		t.Errorf("save after reload: %v, version %d; want version 3", err, second.Version)
+	}
+}
+
+func TestCustomerVersionConflicts(t *testing.T) {
+	db := dbtest.Open(t)
+	customer := testCustomer(t, db, "etag@example.com")
+
+	r := gin.New()
+	r.Use(middleware.Errors(false))
+	r.PATCH("/customers/:customer_id", PatchCustomer)
+	// stale saves a customer loaded before the current version
+	stale := customer
+	r.PUT("/stale", func(c *gin.Context) { saveCustomer(c, stale) })
+
+	send := func(method, target, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(`{"phone":"+15551234"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	target := fmt.Sprintf("/customers/%d", customer.ID)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		ifMatch    string
+		wantStatus int
+		wantCode   apierror.Code
+		wantETag   string
+	}{
+		{"matching If-Match", http.MethodPatch, target, `"1"`, http.StatusOK, "", `"2"`},
+		{"stale If-Match", http.MethodPatch, target, `"1"`, http.StatusPreconditionFailed, apierror.PreconditionFailed, ""},
+		{"no If-Match", http.MethodPatch, target, "", http.StatusOK, "", `"3"`},
+		{"lost race", http.MethodPut, "/stale", "", http.StatusConflict, apierror.ConcurrentUpdate, ""},
+		{"lost race with If-Match", http.MethodPut, "/stale", `"1"`, http.StatusPreconditionFailed, apierror.PreconditionFailed, ""},
+	}
+	for _, tt := range tests {
+		w := send(tt.method, tt.target, tt.ifMatch)
+		if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), string(tt.wantCode)) || w.Header().Get("ETag") != tt.wantETag {
+			t.Errorf("%s: got %d, ETag %q, %s; want %d %s, ETag %q",
+				tt.name, w.Code, w.Header().Get("ETag"), w.Body, tt.wantStatus, tt.wantCode, tt.wantETag)
+		}
+	}
+}
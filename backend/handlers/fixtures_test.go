@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"license-mnm/lockout"
+	"license-mnm/models"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	if err := lockout.Init(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testCustomer creates a customer, its owner user and membership
+func testCustomer(t *testing.T, db *gorm.DB, email string) models.Customer {
+	t.Helper()
+	customer, _, _, err := newCustomer(db, "Customer "+email, email, "+15550000")
+	if err != nil {
+		t.Fatalf("create customer %s: %v", email, err)
+	}
+	return customer
+}
+
+// testPack creates a subscription pack priced at 1000 USD minor units
+func testPack(t *testing.T, db *gorm.DB, sku string) models.SubscriptionPack {
+	t.Helper()
+	pack := models.SubscriptionPack{Name: sku, SKU: sku, ValidityMonths: 1}
+	if err := db.Create(&pack).Error; err != nil {
+		t.Fatalf("create pack %s: %v", sku, err)
+	}
+	if err := db.Create(&models.PackPrice{PackID: pack.ID, Currency: "USD", Amount: 1000}).Error; err != nil {
+		t.Fatalf("price pack %s: %v", sku, err)
+	}
+	return pack
+}
+
+// testSubscription creates a subscription in status, assigned unless it is
+// still requested
+func testSubscription(t *testing.T, db *gorm.DB, customer models.Customer, pack models.SubscriptionPack, status, couponCode string) models.Subscription {
+	t.Helper()
+	now := time.Now()
+	subscription := models.Subscription{
+		CustomerID:    customer.ID,
+		PackID:        pack.ID,
+		Status:        status,
+		RequestedAt:   now,
+		PriceAmount:   1000,
+		PriceCurrency: "USD",
+	}
+	if status != "requested" {
+		expiresAt := now.AddDate(0, pack.ValidityMonths, 0)
+		subscription.AssignedAt, subscription.ExpiresAt = &now, &expiresAt
+	}
+	if err := createSubscription(db, &subscription, couponCode); err != nil {
+		t.Fatalf("create subscription: %v", err)
+	}
+	return subscription
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"license-mnm/database"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readyCheckTimeout bounds the database checks of a readiness probe
+const readyCheckTimeout = 2 * time.Second
+
+// draining is set on shutdown so load balancers stop sending new requests
+var draining atomic.Bool
+
+// StartDraining makes Readyz fail from now on
+func StartDraining() {
+	draining.Store(true)
+}
+
+// Healthz is the liveness probe: the process is up and serving
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz is the readiness probe: the database answers and is migrated, and
+// the server isn't shutting down
+func Readyz(c *gin.Context) {
+	if draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyCheckTimeout)
+	defer cancel()
+	if err := database.Ready(ctx); err != nil {
+		logDBError(c, "readiness check", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "database": "unavailable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "database": "ok"})
+}
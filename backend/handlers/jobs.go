@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"errors"
+	"license-mnm/apierror"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// jobPermissions is the permission needed to see each kind of job
+var jobPermissions = map[string]rbac.Permission{
+	JobKindCustomerImport: rbac.CustomersRead,
+}
+
+// GetJob returns a background job's status, counts and row errors
+func GetJob(c *gin.Context) {
+	var job models.Job
+	err := requestDB(c).First(&job, "id = ?", c.Param("job_id")).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		apierror.AbortCode(c, apierror.JobNotFound, "Job not found")
+		return
+	}
+	if err != nil {
+		logDBError(c, "get job", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to fetch job")
+		return
+	}
+
+	role, _ := c.Get("role")
+	roleName, _ := role.(string)
+	if permission, ok := jobPermissions[job.Kind]; !ok || !rbac.HasPermission(roleName, permission) {
+		apierror.AbortCode(c, apierror.JobNotFound, "Job not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"job":     job,
+	})
+}
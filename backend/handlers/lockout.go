@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"license-mnm/apierror"
+	"license-mnm/lockout"
+	"license-mnm/logging"
+	"license-mnm/metrics"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginAllowed rejects the request with 429 while the account or client IP
+// must wait after failed logins. It runs before the password check so
+// blocked attempts cost no bcrypt work.
+func loginAllowed(c *gin.Context, email string) bool {
+	wait, err := lockout.Logins.Check(email, c.ClientIP())
+	if err != nil {
+		logging.FromContext(c).Error("failed to check login lockout", "error", err)
+		return true
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	metrics.Logins.WithLabelValues(metricsRole(""), "blocked").Inc()
+
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	apierror.AbortCode(c, apierror.TooManyLoginAttempts, "Too many failed login attempts. Try again later.")
+	return false
+}
+
+// metricsRole is the role label of login metrics; "" is a login for no known user
+func metricsRole(role string) string {
+	if role == "" {
+		return "unknown"
+	}
+	return role
+}
+
+// loginFailed records a failed login and audits any lockout it causes. role
+// is the matched user's role, or "" when the email matched no user.
+func loginFailed(c *gin.Context, email, role string) {
+	metrics.Logins.WithLabelValues(metricsRole(role), "failure").Inc()
+
+	result, err := lockout.Logins.Fail(email, c.ClientIP())
+	if err != nil {
+		logging.FromContext(c).Error("failed to record login failure", "error", err)
+		return
+	}
+
+	if result.AccountLocked {
+		recordAudit(c, "login.locked", lockout.AccountKey(email), gin.H{
+			"failures":     result.Account.Failures,
+			"locked_until": result.Account.BlockedUntil,
+		})
+	}
+	if result.IPLocked {
+		recordAudit(c, "login.locked", lockout.IPKey(c.ClientIP()), gin.H{
+			"failures":     result.IP.Failures,
+			"locked_until": result.IP.BlockedUntil,
+		})
+	}
+}
+
+// loginSucceeded counts the login and clears the account's failed logins
+func loginSucceeded(c *gin.Context, user models.User) {
+	metrics.Logins.WithLabelValues(metricsRole(user.Role), "success").Inc()
+
+	if err := lockout.Logins.Succeed(user.Email); err != nil {
+		logging.FromContext(c).Error("failed to reset login failures", "error", err)
+	}
+}
+
+// lockoutTarget reads the email or ip query parameter and checks the caller
+// may manage it: staff accounts need admins permissions, other accounts and
+// IPs need customers permissions
+func lockoutTarget(c *gin.Context, write bool) (email, ip string, ok bool) {
+	email, ip = c.Query("email"), c.Query("ip")
+	if (email == "") == (ip == "") {
+		apierror.AbortCode(c, apierror.ValidationFailed, "Give exactly one of email or ip")
+		return "", "", false
+	}
+
+	perm := rbac.CustomersRead
+	if write {
+		perm = rbac.CustomersWrite
+	}
+	if email != "" {
+		var user models.User
+		if err := requestDB(c).Select("id", "role").Where("email = ?", email).First(&user).Error; err == nil && rbac.IsStaffRole(user.Role) {
+			perm = rbac.AdminsRead
+			if write {
+				perm = rbac.AdminsWrite
+			}
+		}
+	}
+
+	role, _ := c.Get("role")
+	roleName, _ := role.(string)
+	if !rbac.HasPermission(roleName, perm) {
+		apierror.AbortCode(c, apierror.PermissionDenied, "Missing permission: "+string(perm))
+		return "", "", false
+	}
+	return email, ip, true
+}
+
+// GetLoginLockout returns the failed-login state of an account (?email=) or client IP (?ip=)
+func GetLoginLockout(c *gin.Context) {
+	email, ip, ok := lockoutTarget(c, false)
+	if !ok {
+		return
+	}
+
+	var status lockout.Status
+	var err error
+	if email != "" {
+		status, err = lockout.Logins.AccountStatus(email)
+	} else {
+		status, err = lockout.Logins.IPStatus(ip)
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to load lockout")
+		return
+	}
+
+	var blockedUntil *time.Time
+	if !status.BlockedUntil.IsZero() {
+		blockedUntil = &status.BlockedUntil
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"failures":      status.Failures,
+		"locked":        status.Locked,
+		"blocked_until": blockedUntil,
+	})
+}
+
+// UnlockLogin clears the failed logins and lockout of an account (?email=) or client IP (?ip=)
+func UnlockLogin(c *gin.Context) {
+	email, ip, ok := lockoutTarget(c, true)
+	if !ok {
+		return
+	}
+
+	var subject string
+	var err error
+	if email != "" {
+		subject = lockout.AccountKey(email)
+		err = lockout.Logins.UnlockAccount(email)
+	} else {
+		subject = lockout.IPKey(ip)
+		err = lockout.Logins.UnlockIP(ip)
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to unlock")
+		return
+	}
+
+	recordAudit(c, "login.unlocked", subject, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Unlocked successfully",
+	})
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"fmt"
+	"license-mnm/database/dbtest"
+	"license-mnm/lockout"
+	"license-mnm/middleware"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginIPLockoutIgnoresSpoofedForwardedFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		proxies    []string
+		wantLocked bool
+	}{
+		{"no trusted proxies", nil, true},
+		{"peer is a trusted proxy", []string{"192.0.2.1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbtest.Open(t)
+			saved := lockout.Logins
+			t.Cleanup(func() { lockout.Logins = saved })
+			lockout.Logins = lockout.NewGuard(lockout.NewMemoryStore(),
+				lockout.Policy{MaxFailures: 100, Lockout: time.Minute},
+				lockout.Policy{MaxFailures: 3, Lockout: time.Minute})
+
+			r := gin.New()
+			if err := r.SetTrustedProxies(tt.proxies); err != nil {
+				t.Fatal(err)
+			}
+			r.Use(middleware.Errors(false))
+			r.POST("/login", AdminLogin)
+
+			// Each attempt uses a new account and claims a new client IP
+			var last int
+			for i := 0; i < 4; i++ {
+				body := fmt.Sprintf(`{"email":"user%d@example.com","password":"wrong"}`, i)
+				req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+				req.RemoteAddr = "192.0.2.1:40000"
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				last = w.Code
+			}
+			if locked := last == http.StatusTooManyRequests; locked != tt.wantLocked {
+				t.Errorf("fourth attempt got %d; want locked %v", last, tt.wantLocked)
+			}
+		})
+	}
+}
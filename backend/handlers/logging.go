@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"license-mnm/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logDBError logs a failed database operation with the request's fields.
+// It does nothing when err is nil, so queries whose failure the response
+// doesn't report can be wrapped directly.
+func logDBError(c *gin.Context, operation string, err error) {
+	if err != nil {
+		logging.FromContext(c).Error("database error", "operation", operation, "error", err)
+	}
+}
@@ -0,0 +1,432 @@
+package handlers
+
+import (
+	"errors"
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/models"
+	"license-mnm/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// invitationTTL is how long an invitation link stays valid
+const invitationTTL = 7 * 24 * time.Hour
+
+var (
+	errEmailRegistered = errors.New("email already registered")
+	errMemberNotFound  = errors.New("member not found")
+	errLastOwner       = errors.New("organization must keep at least one owner")
+)
+
+// membershipForUser returns the user's membership in their customer
+// organization. Members of a deleted or erased organization have none.
+func membershipForUser(userID interface{}) (models.CustomerMember, error) {
+	var member models.CustomerMember
+	err := database.DB.Joins("JOIN customers ON customers.id = customer_members.customer_id AND customers.deleted_at IS NULL AND customers.erased_at IS NULL").
+		Where("customer_members.user_id = ?", userID).Preload("Customer").First(&member).Error
+	return member, err
+}
+
+// canManageSubscriptions reports whether a member may request or deactivate the organization's subscription
+func canManageSubscriptions(member models.CustomerMember) bool {
+	return member.Role == "owner" || member.Role == "billing"
+}
+
+// organizationSummary describes a member's organization in login responses
+func organizationSummary(member models.CustomerMember) gin.H {
+	return gin.H{
+		"id":   member.CustomerID,
+		"name": member.Customer.Name,
+		"role": member.Role,
+	}
+}
+
+// inviteMember creates an invitation for email to join the customer organization.
+// The returned token is only available here; the invitation stores its hash.
+func inviteMember(customerID uint, email, role string, invitedBy uint) (models.CustomerInvitation, string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	var existingUser models.User
+	if err := database.DB.Where("email = ?", email).First(&existingUser).Error; err == nil {
+		return models.CustomerInvitation{}, "", errEmailRegistered
+	}
+
+	token, err := utils.GenerateRandomToken()
+	if err != nil {
+		return models.CustomerInvitation{}, "", err
+	}
+
+	invitation := models.CustomerInvitation{
+		CustomerID: customerID,
+		Email:      email,
+		Role:       role,
+		TokenHash:  utils.HashToken(token),
+		InvitedBy:  invitedBy,
+		ExpiresAt:  time.Now().Add(invitationTTL),
+	}
+	if err := database.DB.Create(&invitation).Error; err != nil {
+		return invitation, "", err
+	}
+	return invitation, token, nil
+}
+
+// removeMember removes a user from the customer organization and revokes their API key
+func removeMember(customerID, userID uint) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var member models.CustomerMember
+		if err := tx.Where("customer_id = ? AND user_id = ?", customerID, userID).First(&member).Error; err != nil {
+			return errMemberNotFound
+		}
+
+		if member.Role == "owner" {
+			var owners int64
+			if err := tx.Model(&models.CustomerMember{}).Where("customer_id = ? AND role = ?", customerID, "owner").Count(&owners).Error; err != nil {
+				return err
+			}
+			if owners <= 1 {
+				return errLastOwner
+			}
+		}
+
+		if err := tx.Delete(&member).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.APIKey{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).Update("api_key", "").Error
+	})
+}
+
+// respondMemberError writes the response for errors from inviteMember and removeMember
+func respondMemberError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errEmailRegistered):
+		apierror.AbortCode(c, apierror.EmailAlreadyRegistered, "Email already registered")
+	case errors.Is(err, errMemberNotFound):
+		apierror.AbortCode(c, apierror.MemberNotFound, "Member not found")
+	case errors.Is(err, errLastOwner):
+		apierror.AbortCode(c, apierror.LastOwner, "Organization must keep at least one owner")
+	default:
+		apierror.AbortCode(c, apierror.Internal, "Failed to update organization members")
+	}
+}
+
+// organizationOwner loads the caller's membership and rejects non-owners
+func organizationOwner(c *gin.Context) (models.CustomerMember, bool) {
+	userID, _ := c.Get("user_id")
+
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return member, false
+	}
+	if member.Role != "owner" {
+		apierror.AbortCode(c, apierror.Forbidden, "Organization owner access required")
+		return member, false
+	}
+	return member, true
+}
+
+// GetOrganization returns the caller's organization and its members
+func GetOrganization(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+
+	var members []models.CustomerMember
+	logDBError(c, "list members", requestDB(c).Where("customer_id = ?", member.CustomerID).Preload("User").Order("id").Find(&members).Error)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"organization": organizationSummary(member),
+		"members":      members,
+	})
+}
+
+// InviteMember invites a new user to the caller's organization
+func InviteMember(c *gin.Context) {
+	owner, ok := organizationOwner(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+		Role  string `json:"role" binding:"required,oneof=owner billing member"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	invitation, token, err := inviteMember(owner.CustomerID, req.Email, req.Role, owner.UserID)
+	if err != nil {
+		respondMemberError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":    true,
+		"invitation": invitation,
+		"token":      token,
+	})
+}
+
+// ListInvitations returns the caller's organization's pending invitations
+func ListInvitations(c *gin.Context) {
+	owner, ok := organizationOwner(c)
+	if !ok {
+		return
+	}
+
+	var invitations []models.CustomerInvitation
+	err := requestDB(c).Where("customer_id = ? AND accepted_at IS NULL AND expires_at > ?", owner.CustomerID, time.Now()).
+		Order("created_at DESC").Find(&invitations).Error
+	logDBError(c, "list invitations", err)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"invitations": invitations,
+	})
+}
+
+// RevokeInvitation deletes a pending invitation
+func RevokeInvitation(c *gin.Context) {
+	owner, ok := organizationOwner(c)
+	if !ok {
+		return
+	}
+
+	result := requestDB(c).Where("id = ? AND customer_id = ? AND accepted_at IS NULL", c.Param("invitation_id"), owner.CustomerID).
+		Delete(&models.CustomerInvitation{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		apierror.AbortCode(c, apierror.InvitationNotFound, "Invitation not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Invitation revoked successfully",
+	})
+}
+
+// UpdateMemberRole changes a member's role in the caller's organization
+func UpdateMemberRole(c *gin.Context) {
+	owner, ok := organizationOwner(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required,oneof=owner billing member"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var member models.CustomerMember
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("customer_id = ? AND user_id = ?", owner.CustomerID, c.Param("user_id")).Preload("User").First(&member).Error; err != nil {
+			return errMemberNotFound
+		}
+		if member.Role == "owner" && req.Role != "owner" {
+			var owners int64
+			if err := tx.Model(&models.CustomerMember{}).Where("customer_id = ? AND role = ?", owner.CustomerID, "owner").Count(&owners).Error; err != nil {
+				return err
+			}
+			if owners <= 1 {
+				return errLastOwner
+			}
+		}
+		member.Role = req.Role
+		return tx.Save(&member).Error
+	})
+	if err != nil {
+		respondMemberError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"member":  member,
+	})
+}
+
+// RemoveMember removes a member from the caller's organization
+func RemoveMember(c *gin.Context) {
+	owner, ok := organizationOwner(c)
+	if !ok {
+		return
+	}
+
+	if err := removeMember(owner.CustomerID, uint(parseInt(c.Param("user_id")))); err != nil {
+		respondMemberError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Member removed successfully",
+	})
+}
+
+// AcceptInvitation creates the invited user's account and adds them to the organization
+func AcceptInvitation(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Name     string `json:"name" binding:"required"`
+		Password string `json:"password" binding:"required,min=6"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var invitation models.CustomerInvitation
+	if err := requestDB(c).Where("token_hash = ? AND accepted_at IS NULL AND expires_at > ?", utils.HashToken(req.Token), time.Now()).
+		First(&invitation).Error; err != nil {
+		apierror.AbortCode(c, apierror.InvitationInvalid, "Invalid or expired invitation")
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(req.Password)
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to hash password")
+		return
+	}
+
+	var user models.User
+	var member models.CustomerMember
+	err = requestDB(c).Transaction(func(tx *gorm.DB) error {
+		var existingUser models.User
+		if err := tx.Where("email = ?", invitation.Email).First(&existingUser).Error; err == nil {
+			return errEmailRegistered
+		}
+
+		user = models.User{
+			Email:        invitation.Email,
+			PasswordHash: hashedPassword,
+			Role:         "customer",
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+
+		member = models.CustomerMember{
+			CustomerID: invitation.CustomerID,
+			UserID:     user.ID,
+			Role:       invitation.Role,
+			Name:       req.Name,
+		}
+		if err := tx.Create(&member).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		return tx.Model(&invitation).Update("accepted_at", now).Error
+	})
+	if err != nil {
+		respondMemberError(c, err)
+		return
+	}
+
+	member, _ = membershipForUser(user.ID)
+
+	token, err := utils.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to generate token")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":      true,
+		"message":      "Invitation accepted successfully",
+		"token":        token,
+		"name":         member.Name,
+		"organization": organizationSummary(member),
+		"expires_in":   3600,
+	})
+}
+
+// ListCustomerMembers returns the members of a customer organization
+func ListCustomerMembers(c *gin.Context) {
+	id := c.Param("customer_id")
+
+	var customer models.Customer
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+
+	var members []models.CustomerMember
+	logDBError(c, "list members", requestDB(c).Where("customer_id = ?", customer.ID).Preload("User").Order("id").Find(&members).Error)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"members": members,
+	})
+}
+
+// InviteCustomerMember invites a new user to a customer organization
+func InviteCustomerMember(c *gin.Context) {
+	id := c.Param("customer_id")
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+		Role  string `json:"role" binding:"required,oneof=owner billing member"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var customer models.Customer
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+
+	invitation, token, err := inviteMember(customer.ID, req.Email, req.Role, currentUserID(c))
+	if err != nil {
+		respondMemberError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":    true,
+		"invitation": invitation,
+		"token":      token,
+	})
+}
+
+// RemoveCustomerMember removes a member from a customer organization
+func RemoveCustomerMember(c *gin.Context) {
+	customerID := uint(parseInt(c.Param("customer_id")))
+	userID := uint(parseInt(c.Param("user_id")))
+
+	if err := removeMember(customerID, userID); err != nil {
+		respondMemberError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Member removed successfully",
+	})
+}
@@ -0,0 +1,511 @@
+package handlers
+
+import (
+	"errors"
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"license-mnm/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// recoveryCodeCount is how many recovery codes an enrollment issues
+const recoveryCodeCount = 10
+
+// Login clients, recorded in MFA tokens so the second step answers like the first
+const (
+	loginClientAdmin    = "admin"
+	loginClientCustomer = "customer"
+	loginClientSDK      = "sdk"
+)
+
+var (
+	errMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	errMFANotEnrolled    = errors.New("two-factor authentication enrollment not started")
+	errMFANotEnabled     = errors.New("two-factor authentication is not enabled")
+	errInvalidMFACode    = errors.New("invalid two-factor authentication code")
+	errMFARequired       = errors.New("two-factor authentication is required for admin accounts")
+)
+
+// respondMFAError writes the response for errors from MFA operations
+func respondMFAError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errMFAAlreadyEnabled):
+		apierror.AbortCode(c, apierror.MFAAlreadyEnabled, "Two-factor authentication is already enabled")
+	case errors.Is(err, errMFANotEnrolled):
+		apierror.AbortCode(c, apierror.MFAEnrollmentNotStarted, "Start two-factor enrollment first")
+	case errors.Is(err, errMFANotEnabled):
+		apierror.AbortCode(c, apierror.MFANotEnabled, "Two-factor authentication is not enabled")
+	case errors.Is(err, errInvalidMFACode):
+		apierror.AbortCode(c, apierror.InvalidMFACode, "Invalid code")
+	case errors.Is(err, errMFARequired):
+		apierror.AbortCode(c, apierror.MFARequired, "Two-factor authentication is required for admin accounts")
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		apierror.AbortCode(c, apierror.UserNotFound, "User not found")
+	default:
+		apierror.AbortCode(c, apierror.Internal, "Failed to update two-factor authentication")
+	}
+}
+
+// replaceRecoveryCodes discards a user's recovery codes and stores hashes of new ones
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		recovery := models.MFARecoveryCode{
+			UserID:   userID,
+			CodeHash: utils.HashToken(utils.NormalizeRecoveryCode(code)),
+		}
+		if err := tx.Create(&recovery).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// beginMFAEnrollment gives the user a new TOTP secret and recovery codes.
+// 2FA stays off until confirmMFAEnrollment sees a valid code.
+func beginMFAEnrollment(user *models.User) (gin.H, error) {
+	if user.MFAEnabledAt != nil {
+		return nil, errMFAAlreadyEnabled
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{"mfa_secret": secret, "mfa_last_step": 0}).Error; err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"secret":           secret,
+		"provisioning_uri": utils.TOTPProvisioningURI(user.Email, secret),
+		"recovery_codes":   codes,
+	}, nil
+}
+
+// consumeTOTP checks a TOTP code against the user's secret and records its
+// time step, so each code works once
+func consumeTOTP(user *models.User, code string) error {
+	if user.MFASecret == "" {
+		return errMFANotEnrolled
+	}
+
+	step, ok := utils.ValidateTOTP(user.MFASecret, code, user.MFALastStep, time.Now())
+	if !ok {
+		return errInvalidMFACode
+	}
+
+	// The condition makes concurrent use of the same code fail
+	result := database.DB.Model(&models.User{}).Where("id = ? AND mfa_last_step < ?", user.ID, step).Update("mfa_last_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errInvalidMFACode
+	}
+	user.MFALastStep = step
+	return nil
+}
+
+// confirmMFAEnrollment turns 2FA on once the user proves their authenticator works
+func confirmMFAEnrollment(user *models.User, code string) error {
+	if user.MFAEnabledAt != nil {
+		return errMFAAlreadyEnabled
+	}
+	if err := consumeTOTP(user, code); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := database.DB.Model(user).Update("mfa_enabled_at", now).Error; err != nil {
+		return err
+	}
+	user.MFAEnabledAt = &now
+	return nil
+}
+
+// verifyMFACode accepts a TOTP code or an unused recovery code
+func verifyMFACode(user *models.User, code string) error {
+	if user.MFAEnabledAt == nil {
+		return errMFANotEnabled
+	}
+
+	err := consumeTOTP(user, code)
+	if !errors.Is(err, errInvalidMFACode) {
+		return err
+	}
+
+	result := database.DB.Model(&models.MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, utils.HashToken(utils.NormalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errInvalidMFACode
+	}
+	return nil
+}
+
+// resetMFA turns 2FA off and discards the user's secret and recovery codes
+func resetMFA(tx *gorm.DB, userID uint) error {
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"mfa_secret": "", "mfa_enabled_at": nil, "mfa_last_step": 0}).Error; err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error
+}
+
+// startMFALogin answers a password login with an MFA step when one is
+// needed and reports whether it did
+func startMFALogin(c *gin.Context, user models.User, client string) bool {
+	purpose := ""
+	response := gin.H{"success": true}
+	switch {
+	case user.MFAEnabledAt != nil:
+		purpose = utils.PurposeMFAChallenge
+		response["mfa_required"] = true
+	case client == loginClientAdmin && adminMFARequired():
+		purpose = utils.PurposeMFASetup
+		response["mfa_setup_required"] = true
+		response["message"] = "Two-factor authentication is required for admin accounts"
+	default:
+		return false
+	}
+
+	token, err := utils.GenerateMFAToken(user.ID, user.Email, user.Role, purpose, client)
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to generate token")
+		return true
+	}
+
+	response["mfa_token"] = token
+	c.JSON(http.StatusOK, response)
+	return true
+}
+
+// mfaLoginUser loads the user an MFA token was issued to, checking they can
+// still use the login client it was issued by
+func mfaLoginUser(mfaToken string) (*utils.Claims, models.User, bool) {
+	var user models.User
+	claims, err := utils.ValidateMFAToken(mfaToken)
+	if err != nil {
+		return nil, user, false
+	}
+	if err := database.DB.Where("id = ?", claims.UserID).Preload("Customer").First(&user).Error; err != nil {
+		return nil, user, false
+	}
+
+	switch claims.Client {
+	case loginClientAdmin:
+		return claims, user, rbac.IsStaffRole(user.Role) && user.DisabledAt == nil
+	case loginClientCustomer, loginClientSDK:
+		return claims, user, user.Role == rbac.RoleCustomer
+	}
+	return nil, user, false
+}
+
+// completeLogin answers a login whose password was accepted: with an MFA
+// step when one is needed, otherwise with the client's login response
+func completeLogin(c *gin.Context, user models.User, client string) {
+	if startMFALogin(c, user, client) {
+		return
+	}
+	finishLogin(c, user, client)
+}
+
+// finishLogin sends the response the login client would have sent without 2FA
+func finishLogin(c *gin.Context, user models.User, client string) {
+	loginSucceeded(c, user)
+
+	switch client {
+	case loginClientAdmin:
+		respondAdminLogin(c, user)
+	case loginClientSDK:
+		respondSDKLogin(c, user)
+	default:
+		respondCustomerLogin(c, user)
+	}
+}
+
+// VerifyMFALogin completes a login with the MFA token from the login response
+// and a TOTP or recovery code. For a setup token it also confirms enrollment.
+func VerifyMFALogin(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	claims, user, ok := mfaLoginUser(req.MFAToken)
+	if !ok {
+		apierror.AbortCode(c, apierror.InvalidToken, "Invalid or expired token")
+		return
+	}
+
+	if !loginAllowed(c, user.Email) {
+		return
+	}
+
+	var err error
+	switch claims.Purpose {
+	case utils.PurposeMFAChallenge:
+		err = verifyMFACode(&user, req.Code)
+	case utils.PurposeMFASetup:
+		err = confirmMFAEnrollment(&user, req.Code)
+	}
+	if errors.Is(err, errInvalidMFACode) {
+		loginFailed(c, user.Email, user.Role)
+	}
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	finishLogin(c, user, claims.Client)
+}
+
+// EnrollMFALogin starts enrollment for an admin who must set up 2FA before
+// they can log in, using the setup token from the login response
+func EnrollMFALogin(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	claims, user, ok := mfaLoginUser(req.MFAToken)
+	if !ok || claims.Purpose != utils.PurposeMFASetup {
+		apierror.AbortCode(c, apierror.InvalidToken, "Invalid or expired token")
+		return
+	}
+
+	enrollment, err := beginMFAEnrollment(&user)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	enrollment["success"] = true
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// currentUser loads the authenticated user
+func currentUser(c *gin.Context) (models.User, error) {
+	var user models.User
+	err := requestDB(c).Where("id = ?", currentUserID(c)).First(&user).Error
+	return user, err
+}
+
+// GetMFAStatus returns the authenticated user's 2FA status
+func GetMFAStatus(c *gin.Context) {
+	user, err := currentUser(c)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	var remaining int64
+	err = requestDB(c).Model(&models.MFARecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&remaining).Error
+	logDBError(c, "count recovery codes", err)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":                  true,
+		"enabled":                  user.MFAEnabledAt != nil,
+		"enabled_at":               user.MFAEnabledAt,
+		"required":                 rbac.IsStaffRole(user.Role) && adminMFARequired(),
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// EnrollMFA starts 2FA enrollment for the authenticated user and returns the
+// secret, its provisioning URI and recovery codes. The recovery codes are
+// only shown here.
+func EnrollMFA(c *gin.Context) {
+	user, err := currentUser(c)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	enrollment, err := beginMFAEnrollment(&user)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	enrollment["success"] = true
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// ConfirmMFA turns 2FA on with a code from the newly enrolled authenticator
+func ConfirmMFA(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	if err := confirmMFAEnrollment(&user, req.Code); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"message":    "Two-factor authentication enabled",
+		"enabled_at": user.MFAEnabledAt,
+	})
+}
+
+// DisableMFA turns 2FA off for the authenticated user after checking a code
+func DisableMFA(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	if rbac.IsStaffRole(user.Role) && adminMFARequired() {
+		respondMFAError(c, errMFARequired)
+		return
+	}
+	if err := verifyMFACode(&user, req.Code); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+	if err := resetMFA(requestDB(c), user.ID); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// RegenerateRecoveryCodes replaces the authenticated user's recovery codes
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	if err := verifyMFACode(&user, req.Code); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	var codes []string
+	err = requestDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// ResetAdminMFA turns 2FA off for another admin who lost their authenticator
+// and recovery codes. They must enroll again if 2FA is required.
+func ResetAdminMFA(c *gin.Context) {
+	admin, err := findAdmin(requestDB(c), c)
+	if err != nil {
+		respondAdminError(c, err, "reset two-factor authentication")
+		return
+	}
+
+	if err := resetMFA(requestDB(c), admin.ID); err != nil {
+		respondAdminError(c, err, "reset two-factor authentication")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Two-factor authentication reset",
+	})
+}
+
+// ResetCustomerMemberMFA turns 2FA off for a member of a customer organization
+func ResetCustomerMemberMFA(c *gin.Context) {
+	var member models.CustomerMember
+	if err := requestDB(c).Where("customer_id = ? AND user_id = ?", c.Param("customer_id"), c.Param("user_id")).First(&member).Error; err != nil {
+		apierror.AbortCode(c, apierror.MemberNotFound, "Member not found")
+		return
+	}
+
+	if err := resetMFA(requestDB(c), member.UserID); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Two-factor authentication reset",
+	})
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"license-mnm/database/dbtest"
+	"license-mnm/models"
+	"testing"
+	"time"
+)
+
+// totpAt computes the code an authenticator app shows for secret at now
+func totpAt(t *testing.T, secret string, now time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestConsumeTOTP(t *testing.T) {
+	db := dbtest.Open(t)
+	customer := testCustomer(t, db, "mfa@example.com")
+
+	var user models.User
+	db.First(&user, customer.UserID)
+	if _, err := beginMFAEnrollment(&user); err != nil {
+		t.Fatal(err)
+	}
+	db.First(&user, user.ID)
+	code := totpAt(t, user.MFASecret, time.Now())
+
+	// Two requests that loaded the user before either used the code
+	first, second := user, user
+	if err := consumeTOTP(&first, code); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := consumeTOTP(&second, code); err != errInvalidMFACode {
+		t.Errorf("concurrent reuse: got %v, want errInvalidMFACode", err)
+	}
+	if err := consumeTOTP(&first, code); err != errInvalidMFACode {
+		t.Errorf("replay: got %v, want errInvalidMFACode", err)
+	}
+
+	var stored models.User
+	db.First(&stored, user.ID)
+	if stored.MFALastStep != first.MFALastStep || stored.MFALastStep == 0 {
+		t.Errorf("stored last step %d, want %d", stored.MFALastStep, first.MFALastStep)
+	}
+
+	none := models.User{}
+	if err := consumeTOTP(&none, code); err != errMFANotEnrolled {
+		t.Errorf("without a secret: got %v, want errMFANotEnrolled", err)
+	}
+}
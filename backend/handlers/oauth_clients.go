@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"license-mnm/apierror"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"license-mnm/utils"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newClientCredentials generates a client ID and secret
+func newClientCredentials() (string, string, error) {
+	id, err := utils.GenerateRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := utils.GenerateRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return "cl_" + id[:24], "cs_" + secret, nil
+}
+
+// ownedOAuthClient loads an active client of the caller's organization by the :client_id path parameter
+func ownedOAuthClient(c *gin.Context) (models.OAuthClient, bool) {
+	owner, ok := organizationOwner(c)
+	if !ok {
+		return models.OAuthClient{}, false
+	}
+
+	var client models.OAuthClient
+	if err := requestDB(c).Where("client_id = ? AND customer_id = ? AND revoked_at IS NULL", c.Param("client_id"), owner.CustomerID).
+		First(&client).Error; err != nil {
+		apierror.AbortCode(c, apierror.OAuthClientNotFound, "OAuth client not found")
+		return client, false
+	}
+	return client, true
+}
+
+// ListOAuthClients returns the active OAuth clients of the owner's organization
+func ListOAuthClients(c *gin.Context) {
+	owner, ok := organizationOwner(c)
+	if !ok {
+		return
+	}
+
+	var clients []models.OAuthClient
+	logDBError(c, "list oauth clients", requestDB(c).Where("customer_id = ? AND revoked_at IS NULL", owner.CustomerID).Order("id").Find(&clients).Error)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"clients": clients,
+	})
+}
+
+// CreateOAuthClient registers an OAuth client for the owner's organization.
+// The client secret is only returned here.
+func CreateOAuthClient(c *gin.Context) {
+	owner, ok := organizationOwner(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name   string   `json:"name" binding:"required"`
+		Scopes []string `json:"scopes" binding:"required,min=1,dive,oneof=subscription:read subscription:write history:read"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	clientID, secret, err := newClientCredentials()
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to create OAuth client")
+		return
+	}
+
+	client := models.OAuthClient{
+		CustomerID: owner.CustomerID,
+		Name:       req.Name,
+		ClientID:   clientID,
+		SecretHash: utils.HashToken(secret),
+		Scopes:     strings.Join(req.Scopes, " "),
+		CreatedBy:  owner.UserID,
+	}
+	if err := requestDB(c).Create(&client).Error; err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to create OAuth client")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":       true,
+		"client":        client,
+		"client_secret": secret,
+	})
+}
+
+// RotateOAuthClientSecret replaces a client's secret. Tokens already issued
+// stay valid until they expire.
+func RotateOAuthClientSecret(c *gin.Context) {
+	client, ok := ownedOAuthClient(c)
+	if !ok {
+		return
+	}
+
+	_, secret, err := newClientCredentials()
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to rotate secret")
+		return
+	}
+
+	if err := requestDB(c).Model(&client).Update("secret_hash", utils.HashToken(secret)).Error; err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to rotate secret")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"client":        client,
+		"client_secret": secret,
+	})
+}
+
+// RevokeOAuthClient revokes a client; its tokens stop working immediately
+func RevokeOAuthClient(c *gin.Context) {
+	client, ok := ownedOAuthClient(c)
+	if !ok {
+		return
+	}
+
+	if err := requestDB(c).Model(&client).Update("revoked_at", time.Now()).Error; err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to revoke OAuth client")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "OAuth client revoked successfully",
+	})
+}
+
+// oauthError writes an RFC 6749 error response, the format OAuth client
+// libraries expect from a token endpoint
+func oauthError(c *gin.Context, status int, code, description string) {
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// OAuthToken is the OAuth2 token endpoint for the client credentials grant.
+// Clients authenticate with HTTP Basic auth or client_id and client_secret
+// form parameters, and may ask for a subset of their scopes.
+func OAuthToken(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	if c.PostForm("grant_type") != "client_credentials" {
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "Only the client_credentials grant is supported")
+		return
+	}
+
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// Basic auth credentials are form-encoded (RFC 6749 section 2.3.1)
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+
+	var client models.OAuthClient
+	err := requestDB(c).Where("client_id = ? AND revoked_at IS NULL", clientID).First(&client).Error
+	if err != nil || subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(utils.HashToken(secret))) != 1 {
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="sdk"`)
+		}
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "Invalid client credentials")
+		return
+	}
+
+	scope := client.Scopes
+	if requested := strings.Fields(c.PostForm("scope")); len(requested) > 0 {
+		for _, s := range requested {
+			if !rbac.HasScope(client.Scopes, s) {
+				oauthError(c, http.StatusBadRequest, "invalid_scope", "Scope not granted to this client: "+s)
+				return
+			}
+		}
+		scope = strings.Join(requested, " ")
+	}
+
+	token, err := utils.GenerateClientToken(client.ClientID, client.CustomerID, scope)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Failed to generate token")
+		return
+	}
+	logDBError(c, "update oauth client last use", requestDB(c).Model(&client).Update("last_used_at", time.Now()).Error)
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(utils.ClientTokenTTL.Seconds()),
+		"scope":        scope,
+	})
+}
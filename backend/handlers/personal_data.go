@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"license-mnm/apierror"
+	"license-mnm/lockout"
+	"license-mnm/logging"
+	"license-mnm/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errCustomerErased = errors.New("customer already erased")
+
+// personalData is everything stored about a customer organization's users,
+// for data subject access requests
+type personalData struct {
+	ExportedAt   time.Time             `json:"exported_at"`
+	Organization *personalOrganization `json:"organization,omitempty"` // only when the archive covers the whole organization
+	Users        []personalUser        `json:"users"`
+	AuditLog     []models.AuditLog     `json:"audit_log"` // events by the users or about them
+}
+
+// personalOrganization is the customer organization in a personal data
+// archive, with its subscriptions and other records
+type personalOrganization struct {
+	ID                uint                        `json:"id"`
+	Name              string                      `json:"name"`
+	Phone             string                      `json:"phone"`
+	CreatedAt         time.Time                   `json:"created_at"`
+	UpdatedAt         time.Time                   `json:"updated_at"`
+	DeletedAt         *time.Time                  `json:"deleted_at,omitempty"`
+	ErasedAt          *time.Time                  `json:"erased_at,omitempty"`
+	Subscriptions     []personalSubscription      `json:"subscriptions"`
+	CouponRedemptions []models.CouponRedemption   `json:"coupon_redemptions"`
+	Invitations       []models.CustomerInvitation `json:"invitations"`
+	OAuthClients      []models.OAuthClient        `json:"oauth_clients"`
+}
+
+// personalUser is a user account in a personal data archive
+type personalUser struct {
+	ID               uint                  `json:"id"`
+	Email            string                `json:"email"`
+	Name             string                `json:"name"`              // as a member of the organization
+	OrganizationRole string                `json:"organization_role"` // 'owner', 'billing' or 'member'
+	CreatedAt        time.Time             `json:"created_at"`
+	DisabledAt       *time.Time            `json:"disabled_at,omitempty"`
+	MFAEnabledAt     *time.Time            `json:"mfa_enabled_at,omitempty"`
+	APIKeys          []models.APIKey       `json:"api_keys"`
+	Identities       []models.UserIdentity `json:"identities"` // single sign-on accounts
+}
+
+// personalSubscription is a subscription in a personal data archive
+type personalSubscription struct {
+	ID             uint       `json:"id"`
+	PackSKU        string     `json:"pack_sku"`
+	PackName       string     `json:"pack_name"`
+	Status         string     `json:"status"`
+	RequestedAt    time.Time  `json:"requested_at"`
+	ApprovedAt     *time.Time `json:"approved_at,omitempty"`
+	AssignedAt     *time.Time `json:"assigned_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	RejectedAt     *time.Time `json:"rejected_at,omitempty"`
+	DeactivatedAt  *time.Time `json:"deactivated_at,omitempty"`
+	PriceAmount    int64      `json:"price_amount"`
+	PriceCurrency  string     `json:"price_currency"`
+	CouponID       *uint      `json:"coupon_id,omitempty"`
+	DiscountAmount int64      `json:"discount_amount"`
+}
+
+// collectPersonalData gathers what is stored about the members of customer
+// in userIDs and, with wholeOrganization, about the organization itself
+func collectPersonalData(db *gorm.DB, customer models.Customer, userIDs []uint, wholeOrganization bool) (personalData, error) {
+	data := personalData{
+		ExportedAt: time.Now(),
+		Users:      []personalUser{},
+		AuditLog:   []models.AuditLog{},
+	}
+
+	var users []models.User
+	if err := db.Where("id IN ?", userIDs).Order("id").Find(&users).Error; err != nil {
+		return data, err
+	}
+	var members []models.CustomerMember
+	if err := db.Where("customer_id = ? AND user_id IN ?", customer.ID, userIDs).Find(&members).Error; err != nil {
+		return data, err
+	}
+	memberships := make(map[uint]models.CustomerMember, len(members))
+	for _, member := range members {
+		memberships[member.UserID] = member
+	}
+
+	subjects := []string{}
+	for _, user := range users {
+		exported := personalUser{
+			ID:               user.ID,
+			Email:            user.Email,
+			Name:             memberships[user.ID].Name,
+			OrganizationRole: memberships[user.ID].Role,
+			CreatedAt:        user.CreatedAt,
+			DisabledAt:       user.DisabledAt,
+			MFAEnabledAt:     user.MFAEnabledAt,
+			APIKeys:          []models.APIKey{},
+			Identities:       []models.UserIdentity{},
+		}
+		if err := db.Where("user_id = ?", user.ID).Order("id").Find(&exported.APIKeys).Error; err != nil {
+			return data, err
+		}
+		if err := db.Where("user_id = ?", user.ID).Order("id").Find(&exported.Identities).Error; err != nil {
+			return data, err
+		}
+		data.Users = append(data.Users, exported)
+		subjects = append(subjects, lockout.AccountKey(user.Email))
+	}
+
+	if wholeOrganization {
+		organization := &personalOrganization{
+			ID:                customer.ID,
+			Name:              customer.Name,
+			Phone:             customer.Phone,
+			CreatedAt:         customer.CreatedAt,
+			UpdatedAt:         customer.UpdatedAt,
+			DeletedAt:         customer.DeletedAt,
+			ErasedAt:          customer.ErasedAt,
+			Subscriptions:     []personalSubscription{},
+			CouponRedemptions: []models.CouponRedemption{},
+			Invitations:       []models.CustomerInvitation{},
+			OAuthClients:      []models.OAuthClient{},
+		}
+		data.Organization = organization
+		subjects = append(subjects, fmt.Sprintf("customer:%d", customer.ID))
+
+		var subscriptions []models.Subscription
+		if err := db.Where("customer_id = ?", customer.ID).Preload("Pack").Order("id").Find(&subscriptions).Error; err != nil {
+			return data, err
+		}
+		for _, subscription := range subscriptions {
+			organization.Subscriptions = append(organization.Subscriptions, personalSubscription{
+				ID:             subscription.ID,
+				PackSKU:        subscription.Pack.SKU,
+				PackName:       subscription.Pack.Name,
+				Status:         subscription.Status,
+				RequestedAt:    subscription.RequestedAt,
+				ApprovedAt:     subscription.ApprovedAt,
+				AssignedAt:     subscription.AssignedAt,
+				ExpiresAt:      subscription.ExpiresAt,
+				RejectedAt:     subscription.RejectedAt,
+				DeactivatedAt:  subscription.DeactivatedAt,
+				PriceAmount:    subscription.PriceAmount,
+				PriceCurrency:  subscription.PriceCurrency,
+				CouponID:       subscription.CouponID,
+				DiscountAmount: subscription.DiscountAmount,
+			})
+		}
+		for _, records := range []any{&organization.CouponRedemptions, &organization.Invitations, &organization.OAuthClients} {
+			if err := db.Where("customer_id = ?", customer.ID).Order("id").Find(records).Error; err != nil {
+				return data, err
+			}
+		}
+	}
+
+	err := db.Where("actor_id IN ? OR subject IN ?", userIDs, subjects).Order("id").Find(&data.AuditLog).Error
+	return data, err
+}
+
+// sendPersonalData writes data as a JSON file download
+func sendPersonalData(c *gin.Context, data personalData, filename string) {
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.IndentedJSON(http.StatusOK, data)
+}
+
+// customerUserIDs returns the IDs of a customer's members and account owner
+func customerUserIDs(db *gorm.DB, customer models.Customer) ([]uint, error) {
+	var userIDs []uint
+	if err := db.Model(&models.CustomerMember{}).Where("customer_id = ? AND user_id <> ?", customer.ID, customer.UserID).Pluck("user_id", &userIDs).Error; err != nil {
+		return nil, err
+	}
+	return append(userIDs, customer.UserID), nil
+}
+
+// ExportMyPersonalData returns an archive of the personal data stored about
+// the caller. Organization owners get the whole organization's data.
+func ExportMyPersonalData(c *gin.Context) {
+	userID := currentUserID(c)
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+
+	userIDs := []uint{userID}
+	wholeOrganization := member.Role == "owner"
+	if wholeOrganization {
+		if userIDs, err = customerUserIDs(requestDB(c), member.Customer); err != nil {
+			logDBError(c, "list customer users", err)
+			apierror.AbortCode(c, apierror.Internal, "Failed to export personal data")
+			return
+		}
+	}
+
+	data, err := collectPersonalData(requestDB(c), member.Customer, userIDs, wholeOrganization)
+	if err != nil {
+		logDBError(c, "export personal data", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to export personal data")
+		return
+	}
+	sendPersonalData(c, data, fmt.Sprintf("personal-data-%d.json", userID))
+}
+
+// ExportCustomerPersonalData returns an archive of the personal data stored
+// about a customer organization, deleted ones included
+func ExportCustomerPersonalData(c *gin.Context) {
+	var customer models.Customer
+	if err := requestDB(c).Where("id = ?", c.Param("customer_id")).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+
+	userIDs, err := customerUserIDs(requestDB(c), customer)
+	if err != nil {
+		logDBError(c, "list customer users", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to export personal data")
+		return
+	}
+	data, err := collectPersonalData(requestDB(c), customer, userIDs, true)
+	if err != nil {
+		logDBError(c, "export personal data", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to export personal data")
+		return
+	}
+
+	recordAudit(c, "customer.personal_data_exported", fmt.Sprintf("customer:%d", customer.ID), nil)
+	sendPersonalData(c, data, fmt.Sprintf("customer-%d-personal-data.json", customer.ID))
+}
+
+// erasedEmail is the pseudonym an erased user's email is replaced with
+func erasedEmail(userID uint) string {
+	return fmt.Sprintf("erased-%d@erased.invalid", userID)
+}
+
+// eraseCustomer pseudonymizes a customer organization: names, emails and
+// phone are replaced, sign-in methods and credentials are removed and
+// audit entries no longer show the users' emails or IP addresses.
+// Subscriptions and coupon redemptions are kept for accounting. It returns
+// the emails that were replaced.
+func eraseCustomer(tx *gorm.DB, customer *models.Customer, now time.Time) ([]string, error) {
+	if customer.ErasedAt != nil {
+		return nil, errCustomerErased
+	}
+	if err := revokeCustomerAccess(tx, customer.ID, now); err != nil {
+		return nil, err
+	}
+
+	userIDs, err := customerUserIDs(tx, *customer)
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	if err := tx.Where("id IN ? AND role = ?", userIDs, "customer").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	emails := make([]string, len(users))
+	subjects := make([]string, len(users))
+	for i, user := range users {
+		emails[i] = user.Email
+		email := erasedEmail(user.ID)
+		subjects[i] = lockout.AccountKey(email)
+		if err := tx.Model(&models.AuditLog{}).Where("subject = ?", lockout.AccountKey(user.Email)).Update("subject", subjects[i]).Error; err != nil {
+			return nil, err
+		}
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"email":          email,
+			"password_hash":  "",
+			"api_key":        "",
+			"mfa_secret":     "",
+			"mfa_enabled_at": nil,
+			"disabled_at":    now,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	callers := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		callers[i] = fmt.Sprintf("user:%d", id)
+	}
+	for _, step := range []struct {
+		model any
+		where string
+		args  []any
+	}{
+		{&models.UserIdentity{}, "user_id IN ?", []any{userIDs}},
+		{&models.PasswordSetupToken{}, "user_id IN ?", []any{userIDs}},
+		{&models.MFARecoveryCode{}, "user_id IN ?", []any{userIDs}},
+		{&models.IdempotencyKey{}, "caller IN ?", []any{callers}},
+		{&models.CustomerInvitation{}, "customer_id = ?", []any{customer.ID}},
+	} {
+		if err := tx.Where(step.where, step.args...).Delete(step.model).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Model(&models.CustomerMember{}).Where("customer_id = ?", customer.ID).Update("name", "").Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&models.AuditLog{}).Where("actor_id IN ? OR subject IN ?", userIDs, subjects).Update("ip", "").Error; err != nil {
+		return nil, err
+	}
+
+	customer.Name = fmt.Sprintf("Erased customer %d", customer.ID)
+	customer.Phone = ""
+	customer.ErasedAt = &now
+	return emails, saveVersioned(tx, customer, &customer.Version)
+}
+
+// EraseCustomer pseudonymizes a customer organization's personal data for
+// an erasure request. Its subscriptions and coupon redemptions are kept for
+// accounting; its users can no longer sign in. It can't be undone.
+func EraseCustomer(c *gin.Context) {
+	var customer models.Customer
+	if err := requestDB(c).Where("id = ?", c.Param("customer_id")).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return
+	}
+	if !ifMatch(c, customer.Version) {
+		return
+	}
+
+	var emails []string
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		emails, err = eraseCustomer(tx, &customer, time.Now())
+		return err
+	})
+	switch {
+	case errors.Is(err, errCustomerErased):
+		apierror.AbortCode(c, apierror.CustomerErased, "Customer has already been erased")
+		return
+	case errors.Is(err, errVersionConflict):
+		abortVersionConflict(c)
+		return
+	case err != nil:
+		logDBError(c, "erase customer", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to erase customer")
+		return
+	}
+	for _, email := range emails {
+		if err := lockout.Logins.UnlockAccount(email); err != nil {
+			logging.FromContext(c).Error("failed to clear login failures", "error", err)
+		}
+	}
+	recordAudit(c, "customer.erased", fmt.Sprintf("customer:%d", customer.ID), nil)
+
+	setETag(c, customer.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"customer": customer,
+	})
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"fmt"
+	"license-mnm/database/dbtest"
+	"license-mnm/lockout"
+	"license-mnm/middleware"
+	"license-mnm/models"
+	"license-mnm/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestEraseCustomer(t *testing.T) {
+	db := dbtest.Open(t)
+	admin := models.User{Email: "admin@example.com", Role: "super_admin"}
+	db.Create(&admin)
+	pack := testPack(t, db, "ERASE")
+	db.Create(&models.Coupon{Code: "KEEP", DiscountType: "percentage", PercentOff: 10, Active: true})
+
+	customer := testCustomer(t, db, "owner@example.com")
+	other := testCustomer(t, db, "other@example.com")
+	subscription := testSubscription(t, db, customer, pack, "active", "KEEP")
+
+	hash, _ := utils.HashPassword("secret123")
+	db.Model(&models.User{}).Where("id = ?", customer.UserID).Updates(map[string]any{
+		"password_hash": hash, "api_key": "key-owner", "mfa_secret": "SECRET", "mfa_enabled_at": time.Now(),
+	})
+	member := models.User{Email: "member@example.com", Role: "customer", PasswordHash: hash}
+	db.Create(&member)
+	db.Create(&models.CustomerMember{CustomerID: customer.ID, UserID: member.ID, Role: "member", Name: "Mem Ber"})
+
+	owner := customer.UserID
+	ip := "203.0.113.9"
+	for _, row := range []any{
+		&models.UserIdentity{UserID: owner, Issuer: "https://idp.test", Subject: "owner", Email: "owner@example.com"},
+		&models.PasswordSetupToken{UserID: member.ID, TokenHash: "setup", ExpiresAt: time.Now().Add(time.Hour)},
+		&models.MFARecoveryCode{UserID: owner, CodeHash: "recovery"},
+		&models.IdempotencyKey{Caller: fmt.Sprintf("user:%d", owner), Key: "k", RequestHash: "h", ExpiresAt: time.Now().Add(time.Hour)},
+		&models.CustomerInvitation{CustomerID: customer.ID, Email: "invitee@example.com", Role: "member", TokenHash: "invite", ExpiresAt: time.Now().Add(time.Hour)},
+		&models.AuditLog{Action: "subscription.requested", ActorID: &owner, Subject: "subscriptions", IP: ip},
+		&models.AuditLog{Action: "login.locked", Subject: lockout.AccountKey("member@example.com"), IP: ip},
+		&models.AuditLog{Action: "customer.updated", ActorID: &admin.ID, Subject: fmt.Sprintf("customer:%d", customer.ID), IP: "198.51.100.1"},
+		&models.AuditLog{Action: "subscription.requested", ActorID: &other.UserID, Subject: "subscriptions", IP: ip},
+	} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := lockout.Logins.Fail("owner@example.com", ip); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(middleware.Errors(false))
+	r.Use(func(c *gin.Context) { c.Set("user_id", admin.ID) })
+	r.POST("/customers/:customer_id/erase", EraseCustomer)
+	erase := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/customers/%d/erase", customer.ID), nil)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := erase(`"7"`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Match: got %d %s", w.Code, w.Body)
+	}
+	if w := erase(`"1"`); w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("erase: got %d, ETag %q, %s", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+	if w := erase(""); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "CUSTOMER_ERASED") {
+		t.Errorf("second erase: got %d %s", w.Code, w.Body)
+	}
+
+	var erased models.Customer
+	db.First(&erased, customer.ID)
+	if erased.Name != fmt.Sprintf("Erased customer %d", customer.ID) || erased.Phone != "" || erased.ErasedAt == nil {
+		t.Errorf("customer after erasure: %+v", erased)
+	}
+
+	for _, id := range []uint{owner, member.ID} {
+		var user models.User
+		db.First(&user, id)
+		if user.Email != erasedEmail(id) || user.PasswordHash != "" || user.APIKey != "" ||
+			user.MFASecret != "" || user.MFAEnabledAt != nil || user.DisabledAt == nil {
+			t.Errorf("user %d after erasure: %+v", id, user)
+		}
+	}
+
+	count := func(query *gorm.DB) int64 {
+		var n int64
+		query.Count(&n)
+		return n
+	}
+	tests := []struct {
+		name  string
+		query *gorm.DB
+		want  int64
+	}{
+		{"emails anywhere in users", db.Model(&models.User{}).Where("email IN ?", []string{"owner@example.com", "member@example.com"}), 0},
+		{"identity links", db.Model(&models.UserIdentity{}), 0},
+		{"password setup tokens", db.Model(&models.PasswordSetupToken{}).Where("user_id IN ?", []uint{owner, member.ID}), 0},
+		{"recovery codes", db.Model(&models.MFARecoveryCode{}), 0},
+		{"idempotency keys", db.Model(&models.IdempotencyKey{}), 0},
+		{"invitations", db.Model(&models.CustomerInvitation{}), 0},
+		{"member names", db.Model(&models.CustomerMember{}).Where("customer_id = ? AND name <> ''", customer.ID), 0},
+		{"audit subjects with old emails", db.Model(&models.AuditLog{}).Where("subject LIKE ?", "%@example.com"), 0},
+		{"audit subjects with pseudonyms", db.Model(&models.AuditLog{}).Where("subject = ?", lockout.AccountKey(erasedEmail(member.ID))), 1},
+		{"audit IPs of erased users", db.Model(&models.AuditLog{}).Where("ip = ? AND (actor_id IS NULL OR actor_id <> ?)", ip, other.UserID), 0},
+		{"audit IPs of other customers", db.Model(&models.AuditLog{}).Where("ip = ? AND actor_id = ?", ip, other.UserID), 1},
+		{"audit IPs of admins", db.Model(&models.AuditLog{}).Where("ip = ?", "198.51.100.1"), 1},
+		{"erasure audited", db.Model(&models.AuditLog{}).Where("action = ? AND actor_id = ?", "customer.erased", admin.ID), 1},
+		{"subscriptions kept for accounting", db.Model(&models.Subscription{}).Where("id = ?", subscription.ID), 1},
+		{"coupon redemptions kept", db.Model(&models.CouponRedemption{}).Where("subscription_id = ?", subscription.ID), 1},
+		{"other customer untouched", db.Model(&models.User{}).Where("email = ? AND disabled_at IS NULL", "other@example.com"), 1},
+	}
+	for _, tt := range tests {
+		if got := count(tt.query); got != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	var open int64
+	db.Model(&models.Subscription{}).Where("customer_id = ? AND status = ?", customer.ID, "active").Count(&open)
+	if open != 0 {
+		t.Errorf("%d active subscriptions after erasure, want 0", open)
+	}
+	if status, _ := lockout.Logins.AccountStatus("owner@example.com"); status.Failures != 0 {
+		t.Errorf("login failures of the old email kept: %d", status.Failures)
+	}
+}
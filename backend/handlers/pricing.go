@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"errors"
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/models"
+	"license-mnm/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// priceInput is a price in one currency as sent by admins
+type priceInput struct {
+	Currency string `json:"currency" binding:"required,len=3,alpha"`
+	Amount   int64  `json:"amount" binding:"min=0"` // minor units
+}
+
+// majorUnitPrice converts the legacy float "price" field, given in major
+// units, to a priceInput in the given or default currency
+func majorUnitPrice(amount float64, currency string) priceInput {
+	currency = utils.NormalizeCurrency(currency)
+	if currency == "" {
+		currency = utils.DefaultCurrency()
+	}
+	return priceInput{Currency: currency, Amount: utils.ToMinorUnits(amount, currency)}
+}
+
+var errPackNotPriced = errors.New("subscription pack has no price in this currency")
+
+// setPackPrice creates or updates a pack's price in one currency and records
+// the change in the price history
+func setPackPrice(tx *gorm.DB, packID uint, currency string, amount int64, changedBy uint) error {
+	currency = utils.NormalizeCurrency(currency)
+
+	var price models.PackPrice
+	err := tx.Where("pack_id = ? AND currency = ?", packID, currency).First(&price).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		price = models.PackPrice{PackID: packID, Currency: currency, Amount: amount}
+		if err := tx.Create(&price).Error; err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case price.Amount == amount:
+		return nil
+	default:
+		price.Amount = amount
+		if err := tx.Save(&price).Error; err != nil {
+			return err
+		}
+	}
+
+	history := models.PackPriceHistory{
+		PackID:      packID,
+		Currency:    currency,
+		Amount:      &amount,
+		EffectiveAt: time.Now(),
+		ChangedBy:   changedBy,
+	}
+	return tx.Create(&history).Error
+}
+
+// resolvePackPrice returns the current price of a pack in the given currency,
+// falling back to the default currency when none is given
+func resolvePackPrice(packID uint, currency string) (models.PackPrice, error) {
+	currency = utils.NormalizeCurrency(currency)
+	if currency == "" {
+		currency = utils.DefaultCurrency()
+	}
+
+	var price models.PackPrice
+	if err := database.DB.Where("pack_id = ? AND currency = ?", packID, currency).First(&price).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return price, errPackNotPriced
+		}
+		return price, err
+	}
+	return price, nil
+}
+
+// currentUserID returns the authenticated user's ID from the JWT claims
+func currentUserID(c *gin.Context) uint {
+	userID, _ := c.Get("user_id")
+	id, _ := userID.(uint)
+	return id
+}
+
+// ListPackPrices returns the current prices of a subscription pack
+func ListPackPrices(c *gin.Context) {
+	id := c.Param("pack_id")
+
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).Preload("Prices").First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+
+	setETag(c, pack.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"prices":  pack.Prices,
+	})
+}
+
+// SetPackPrice sets a subscription pack's price in one currency. Prices are
+// part of the pack, so If-Match is checked against the pack's version.
+func SetPackPrice(c *gin.Context) {
+	id := c.Param("pack_id")
+
+	var req priceInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+	if !ifMatch(c, pack.Version) {
+		return
+	}
+
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &pack, &pack.Version); err != nil {
+			return err
+		}
+		return setPackPrice(tx, pack.ID, req.Currency, req.Amount, currentUserID(c))
+	})
+	if errors.Is(err, errVersionConflict) {
+		abortVersionConflict(c)
+		return
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to update price")
+		return
+	}
+
+	logDBError(c, "load pack prices", requestDB(c).Where("pack_id = ?", pack.ID).Find(&pack.Prices).Error)
+
+	setETag(c, pack.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"prices":  pack.Prices,
+	})
+}
+
+// DeletePackPrice removes a subscription pack's price in one currency.
+// If-Match is checked against the pack's version.
+func DeletePackPrice(c *gin.Context) {
+	id := c.Param("pack_id")
+	currency := utils.NormalizeCurrency(c.Param("currency"))
+
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", id).Preload("Prices").First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+
+	if len(pack.Prices) == 1 && pack.Prices[0].Currency == currency {
+		apierror.AbortCode(c, apierror.LastPrice, "A subscription pack must keep at least one price")
+		return
+	}
+	if !ifMatch(c, pack.Version) {
+		return
+	}
+
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &pack, &pack.Version); err != nil {
+			return err
+		}
+		result := tx.Where("pack_id = ? AND currency = ?", pack.ID, currency).Delete(&models.PackPrice{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errPackNotPriced
+		}
+		return tx.Create(&models.PackPriceHistory{
+			PackID:      pack.ID,
+			Currency:    currency,
+			EffectiveAt: time.Now(),
+			ChangedBy:   currentUserID(c),
+		}).Error
+	})
+	if errors.Is(err, errPackNotPriced) {
+		apierror.AbortCode(c, apierror.PriceNotFound, "Price not found")
+		return
+	}
+	if errors.Is(err, errVersionConflict) {
+		abortVersionConflict(c)
+		return
+	}
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to delete price")
+		return
+	}
+
+	setETag(c, pack.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Price deleted successfully",
+	})
+}
+
+// GetPackPriceHistory returns every price change of a subscription pack
+func GetPackPriceHistory(c *gin.Context) {
+	id := c.Param("pack_id")
+	currency := utils.NormalizeCurrency(c.Query("currency"))
+
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ?", id).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+		return
+	}
+
+	query := requestDB(c).Where("pack_id = ?", pack.ID)
+	if currency != "" {
+		query = query.Where("currency = ?", currency)
+	}
+
+	var history []models.PackPriceHistory
+	logDBError(c, "list price history", query.Order("effective_at DESC, id DESC").Find(&history).Error)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"history": history,
+	})
+}
@@ -1,33 +1,48 @@
 package handlers
 
 import (
-	"license-mnm/database"
+	"errors"
+	"license-mnm/apierror"
 	"license-mnm/models"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// SDKGetSubscription returns current subscription for SDK
-func SDKGetSubscription(c *gin.Context) {
-	apiKey := c.GetHeader("X-API-Key")
+// sdkMembership resolves the caller to an organization membership. API keys
+// act as the key's owner; OAuth client tokens act as a billing member of the
+// client's organization. SDKAuth and RequireScope have checked the scopes.
+func sdkMembership(c *gin.Context) (models.CustomerMember, bool) {
+	if clientID, exists := c.Get("oauth_client_id"); exists {
+		var client models.OAuthClient
+		if err := requestDB(c).Where("client_id = ? AND revoked_at IS NULL", clientID).First(&client).Error; err != nil {
+			apierror.AbortCode(c, apierror.InvalidToken, "Invalid or expired token")
+			return models.CustomerMember{}, false
+		}
+		return models.CustomerMember{CustomerID: client.CustomerID, Role: "billing"}, true
+	}
 
-	var user models.User
-	if err := database.DB.Where("api_key = ?", apiKey).Preload("Customer").First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid API key"})
-		return
+	userID, _ := c.Get("user_id")
+
+	member, err := membershipForUser(userID)
+	if err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Customer not found")
+		return member, false
 	}
+	return member, true
+}
 
-	if user.Customer == nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+// SDKGetSubscription returns current subscription for SDK
+func SDKGetSubscription(c *gin.Context) {
+	member, ok := sdkMembership(c)
+	if !ok {
 		return
 	}
 
 	var subscription models.Subscription
-	if err := database.DB.Where("customer_id = ? AND status = ?", user.Customer.ID, "active").Preload("Pack").First(&subscription).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "No active subscription found"})
+	if err := requestDB(c).Where("customer_id = ? AND status = ?", member.CustomerID, "active").Preload("Pack").First(&subscription).Error; err != nil {
+		apierror.AbortCode(c, apierror.NoActiveSubscription, "No active subscription found")
 		return
 	}
 
@@ -39,7 +54,8 @@ func SDKGetSubscription(c *gin.Context) {
 			"id":         subscription.ID,
 			"pack_name":  subscription.Pack.Name,
 			"pack_sku":   subscription.Pack.SKU,
-			"price":      subscription.Pack.Price,
+			"price":      subscription.PriceAmount,
+			"currency":   subscription.PriceCurrency,
 			"status":     subscription.Status,
 			"assigned_at": subscription.AssignedAt,
 			"expires_at":  subscription.ExpiresAt,
@@ -50,51 +66,63 @@ func SDKGetSubscription(c *gin.Context) {
 
 // SDKRequestSubscription creates a subscription request via SDK
 func SDKRequestSubscription(c *gin.Context) {
-	apiKey := c.GetHeader("X-API-Key")
-
-	var user models.User
-	if err := database.DB.Where("api_key = ?", apiKey).Preload("Customer").First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid API key"})
+	member, ok := sdkMembership(c)
+	if !ok {
 		return
 	}
 
-	if user.Customer == nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	if !canManageSubscriptions(member) {
+		apierror.AbortCode(c, apierror.Forbidden, "Only organization owners and billing members can change the subscription")
 		return
 	}
 
 	var req struct {
-		PackSKU string `json:"pack_sku" binding:"required"`
+		PackSKU    string `json:"pack_sku" binding:"required"`
+		Currency   string `json:"currency" binding:"omitempty,len=3,alpha"`
+		CouponCode string `json:"coupon_code"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
 		return
 	}
 
 	// Check if customer has active subscription
 	var activeSub models.Subscription
-	if err := database.DB.Where("customer_id = ? AND status = ?", user.Customer.ID, "active").First(&activeSub).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Customer already has an active subscription"})
+	if err := requestDB(c).Where("customer_id = ? AND status = ?", member.CustomerID, "active").First(&activeSub).Error; err == nil {
+		apierror.AbortCode(c, apierror.SubscriptionAlreadyActive, "Customer already has an active subscription")
 		return
 	}
 
 	// Get pack by SKU
 	var pack models.SubscriptionPack
-	if err := database.DB.Where("sku = ? AND deleted_at IS NULL", req.PackSKU).First(&pack).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Subscription pack not found"})
+	if err := requestDB(c).Where("sku = ? AND deleted_at IS NULL", req.PackSKU).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
 		return
 	}
 
-	subscription := models.Subscription{
-		CustomerID:  user.Customer.ID,
-		PackID:      pack.ID,
-		Status:      "requested",
-		RequestedAt: time.Now(),
+	price, err := resolvePackPrice(pack.ID, req.Currency)
+	if err != nil {
+		apierror.AbortCode(c, apierror.PackCurrencyUnavailable, "Subscription pack is not available in this currency")
+		return
 	}
 
-	if err := database.DB.Create(&subscription).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create subscription request"})
+	subscription := models.Subscription{
+		CustomerID:    member.CustomerID,
+		PackID:        pack.ID,
+		Status:        "requested",
+		RequestedAt:   time.Now(),
+		PriceAmount:   price.Amount,
+		PriceCurrency: price.Currency,
+	}
+
+	if err := createSubscription(requestDB(c), &subscription, req.CouponCode); err != nil {
+		var couponErr *apierror.Error
+		if errors.As(err, &couponErr) {
+			apierror.Abort(c, couponErr)
+			return
+		}
+		apierror.AbortCode(c, apierror.Internal, "Failed to create subscription request")
 		return
 	}
 
@@ -102,38 +130,42 @@ func SDKRequestSubscription(c *gin.Context) {
 		"success": true,
 		"message": "Subscription request submitted successfully",
 		"subscription": gin.H{
-			"id":           subscription.ID,
-			"status":       subscription.Status,
-			"requested_at": subscription.RequestedAt,
+			"id":              subscription.ID,
+			"status":          subscription.Status,
+			"requested_at":    subscription.RequestedAt,
+			"price":           subscription.PriceAmount,
+			"currency":        subscription.PriceCurrency,
+			"discount_amount": subscription.DiscountAmount,
 		},
 	})
 }
 
 // SDKDeactivateSubscription deactivates subscription via SDK
 func SDKDeactivateSubscription(c *gin.Context) {
-	apiKey := c.GetHeader("X-API-Key")
-
-	var user models.User
-	if err := database.DB.Where("api_key = ?", apiKey).Preload("Customer").First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid API key"})
+	member, ok := sdkMembership(c)
+	if !ok {
 		return
 	}
 
-	if user.Customer == nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	if !canManageSubscriptions(member) {
+		apierror.AbortCode(c, apierror.Forbidden, "Only organization owners and billing members can change the subscription")
 		return
 	}
 
 	var subscription models.Subscription
-	if err := database.DB.Where("customer_id = ? AND status = ?", user.Customer.ID, "active").First(&subscription).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "No active subscription found"})
+	if err := requestDB(c).Where("customer_id = ? AND status = ?", member.CustomerID, "active").First(&subscription).Error; err != nil {
+		apierror.AbortCode(c, apierror.NoActiveSubscription, "No active subscription found")
 		return
 	}
 
 	now := time.Now()
 	subscription.Status = "inactive"
 	subscription.DeactivatedAt = &now
-	database.DB.Save(&subscription)
+	if err := requestDB(c).Save(&subscription).Error; err != nil {
+		logDBError(c, "deactivate subscription", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to deactivate subscription")
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success":       true,
@@ -144,35 +176,24 @@ func SDKDeactivateSubscription(c *gin.Context) {
 
 // SDKGetSubscriptionHistory returns subscription history for SDK
 func SDKGetSubscriptionHistory(c *gin.Context) {
-	apiKey := c.GetHeader("X-API-Key")
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	sort := c.DefaultQuery("sort", "desc")
-	offset := (page - 1) * limit
-
-	var user models.User
-	if err := database.DB.Where("api_key = ?", apiKey).Preload("Customer").First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid API key"})
+	page, apiErr := historyList.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
 		return
 	}
 
-	if user.Customer == nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Customer not found"})
+	member, ok := sdkMembership(c)
+	if !ok {
 		return
 	}
 
 	var subscriptions []models.Subscription
 	var total int64
 
-	query := database.DB.Model(&models.Subscription{}).Where("customer_id = ?", user.Customer.ID)
-	query.Count(&total)
-
-	orderBy := "created_at DESC"
-	if sort == "asc" {
-		orderBy = "created_at ASC"
-	}
-
-	query.Order(orderBy).Offset(offset).Limit(limit).Preload("Pack").Find(&subscriptions)
+	query := requestDB(c).Model(&models.Subscription{}).Where("customer_id = ?", member.CustomerID)
+	logDBError(c, "count subscription history", query.Count(&total).Error)
+	logDBError(c, "list subscription history", page.Apply(query).Preload("Pack").Find(&subscriptions).Error)
+	subscriptions, meta := page.Result(subscriptions, total)
 
 	var history []map[string]interface{}
 	for _, sub := range subscriptions {
@@ -188,11 +209,7 @@ func SDKGetSubscriptionHistory(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"history": history,
-		"pagination": gin.H{
-			"page":  page,
-			"limit": limit,
-			"total": total,
-		},
+		"pagination": meta,
 	})
 }
 
@@ -1,7 +1,7 @@
 package handlers
 
 import (
-	"license-mnm/database"
+	"license-mnm/apierror"
 	"license-mnm/models"
 	"license-mnm/utils"
 	"net/http"
@@ -17,39 +17,54 @@ func SDKLogin(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	if !loginAllowed(c, req.Email) {
 		return
 	}
 
 	var user models.User
-	if err := database.DB.Where("email = ? AND role = ?", req.Email, "customer").Preload("Customer").First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid credentials"})
+	if err := requestDB(c).Where("email = ? AND role = ?", req.Email, "customer").Preload("Customer").First(&user).Error; err != nil {
+		loginFailed(c, req.Email, "")
+		apierror.AbortCode(c, apierror.InvalidCredentials, "Invalid credentials")
 		return
 	}
 
 	if !utils.CheckPasswordHash(req.Password, user.PasswordHash) {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid credentials"})
+		loginFailed(c, req.Email, user.Role)
+		apierror.AbortCode(c, apierror.InvalidCredentials, "Invalid credentials")
 		return
 	}
 
+	completeLogin(c, user, loginClientSDK)
+}
+
+// respondSDKLogin returns the API key and JWT for an authenticated customer user
+func respondSDKLogin(c *gin.Context, user models.User) {
 	// Generate or retrieve API key
 	var apiKey string
 	if user.APIKey == "" {
 		newKey, err := utils.GenerateAPIKey()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to generate API key"})
+			apierror.AbortCode(c, apierror.Internal, "Failed to generate API key")
 			return
 		}
 		apiKey = newKey
 		user.APIKey = apiKey
-		database.DB.Save(&user)
+		if err := requestDB(c).Save(&user).Error; err != nil {
+			logDBError(c, "save api key", err)
+			apierror.AbortCode(c, apierror.Internal, "Failed to generate API key")
+			return
+		}
 	} else {
 		apiKey = user.APIKey
 	}
 
 	token, err := utils.GenerateToken(user.ID, user.Email, user.Role)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to generate token"})
+		apierror.AbortCode(c, apierror.Internal, "Failed to generate token")
 		return
 	}
 
@@ -59,13 +74,22 @@ func SDKLogin(c *gin.Context) {
 		phone = user.Customer.Phone
 	}
 
+	var organization gin.H
+	if member, err := membershipForUser(user.ID); err == nil {
+		organization = organizationSummary(member)
+		if name == "" {
+			name = member.Name
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success":    true,
 		"api_key":    apiKey,
 		"token":      token,
-		"name":       name,
-		"phone":      phone,
-		"expires_in": 3600,
+		"name":         name,
+		"phone":        phone,
+		"organization": organization,
+		"expires_in":   3600,
 	})
 }
 
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Setting keys
+const (
+	settingRequireAdminMFA = "require_admin_mfa"
+)
+
+// getSetting returns a setting's value, or "" when it has never been set
+func getSetting(key string) string {
+	var setting models.Setting
+	if err := database.DB.Where(&models.Setting{Key: key}).First(&setting).Error; err != nil {
+		return ""
+	}
+	return setting.Value
+}
+
+// setSetting creates or updates a setting
+func setSetting(tx *gorm.DB, key, value string) error {
+	return tx.Save(&models.Setting{Key: key, Value: value}).Error
+}
+
+// adminMFARequired reports whether every admin account must use 2FA
+func adminMFARequired() bool {
+	required, _ := strconv.ParseBool(getSetting(settingRequireAdminMFA))
+	return required
+}
+
+// GetSecuritySettings returns the security settings
+func GetSecuritySettings(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success":           true,
+		"require_admin_mfa": adminMFARequired(),
+	})
+}
+
+// UpdateSecuritySettings changes the security settings
+func UpdateSecuritySettings(c *gin.Context) {
+	var req struct {
+		RequireAdminMFA *bool `json:"require_admin_mfa" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+
+	// Whoever turns enforcement on must already use 2FA, so they can't lock
+	// themselves out on their next login
+	if *req.RequireAdminMFA {
+		var user models.User
+		if err := requestDB(c).Where("id = ?", currentUserID(c)).First(&user).Error; err != nil || user.MFAEnabledAt == nil {
+			apierror.AbortCode(c, apierror.MFARequired, "Enable two-factor authentication on your own account first")
+			return
+		}
+	}
+
+	if err := setSetting(requestDB(c), settingRequireAdminMFA, strconv.FormatBool(*req.RequireAdminMFA)); err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to update settings")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":           true,
+		"require_admin_mfa": *req.RequireAdminMFA,
+	})
+}
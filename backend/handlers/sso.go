@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"errors"
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/logging"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"license-mnm/sso"
+	"license-mnm/utils"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// ssoStateTTL is how long the user has to sign in at the identity provider
+const ssoStateTTL = 10 * time.Minute
+
+var (
+	errSSONoEmail         = errors.New("identity provider returned no email")
+	errSSONoAdminGroup    = errors.New("identity is not in an admin group")
+	errSSOAccountConflict = errors.New("email belongs to a different kind of account")
+	errSSODisabled        = errors.New("account is disabled")
+	errSSOEmailUnverified = errors.New("identity provider has not verified the email of an existing account")
+)
+
+// respondSSOError writes the response for errors from an SSO callback
+func respondSSOError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errSSONoEmail):
+		apierror.AbortCode(c, apierror.IdentityEmailMissing, "The identity provider did not return an email address")
+	case errors.Is(err, errSSONoAdminGroup):
+		apierror.AbortCode(c, apierror.Forbidden, "Your account is not in an admin group")
+	case errors.Is(err, errSSOAccountConflict):
+		apierror.AbortCode(c, apierror.AccountKindConflict, "This email is registered to a different kind of account")
+	case errors.Is(err, errSSOEmailUnverified):
+		apierror.AbortCode(c, apierror.IdentityEmailUnverified, "An account with this email already exists and the identity provider has not verified the email")
+	case errors.Is(err, errSSODisabled):
+		apierror.AbortCode(c, apierror.AccountDisabled, "Account is disabled")
+	default:
+		apierror.AbortCode(c, apierror.Internal, "Failed to sign in")
+	}
+}
+
+// ssoUser finds or provisions the user for an identity. Known identities
+// and verified emails of existing users are linked; anyone else is created
+// just in time. Admin logins take their role from the IdP groups.
+func ssoUser(provider *sso.Provider, identity sso.Identity, client string) (models.User, error) {
+	var user models.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var link models.UserIdentity
+		err := tx.Where("issuer = ? AND subject = ?", identity.Issuer, identity.Subject).First(&link).Error
+		switch {
+		case err == nil:
+			if err := tx.Where("id = ?", link.UserID).First(&user).Error; err != nil {
+				return err
+			}
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		case identity.Email == "":
+			return errSSONoEmail
+		default:
+			err := tx.Where("email = ?", identity.Email).First(&user).Error
+			if err == nil && !identity.EmailVerified {
+				// Only a verified email proves the identity owns this account
+				return errSSOEmailUnverified
+			}
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			link = models.UserIdentity{Issuer: identity.Issuer, Subject: identity.Subject}
+		}
+
+		if client == loginClientAdmin {
+			err = ssoAdmin(tx, provider, identity, &user)
+		} else {
+			err = ssoCustomer(tx, identity, &user)
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		link.UserID = user.ID
+		link.Email = identity.Email
+		link.LastLoginAt = &now
+		return tx.Save(&link).Error
+	})
+	if err != nil {
+		return user, err
+	}
+
+	err = database.DB.Where("id = ?", user.ID).Preload("Customer").First(&user).Error
+	return user, err
+}
+
+// ssoAdmin provisions a staff user or syncs an existing one's role with the
+// identity's groups. The last super admin keeps their role.
+func ssoAdmin(tx *gorm.DB, provider *sso.Provider, identity sso.Identity, user *models.User) error {
+	role := provider.AdminRole(identity.Groups)
+	if role == "" {
+		return errSSONoAdminGroup
+	}
+
+	if user.ID == 0 {
+		*user = models.User{Email: identity.Email, Role: role}
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		slog.Info("provisioned admin from single sign-on", "email", user.Email, "role", role)
+		return nil
+	}
+
+	if !rbac.IsStaffRole(user.Role) {
+		return errSSOAccountConflict
+	}
+	if user.DisabledAt != nil {
+		return errSSODisabled
+	}
+	if user.Role == role {
+		return nil
+	}
+	if role != rbac.RoleSuperAdmin {
+		err := ensureOtherSuperAdmin(tx, *user)
+		if errors.Is(err, errLastSuperAdmin) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	user.Role = role
+	return tx.Model(user).Update("role", role).Error
+}
+
+// ssoCustomer provisions a customer organization owned by the identity, as
+// CustomerSignup does, unless the user already exists
+func ssoCustomer(tx *gorm.DB, identity sso.Identity, user *models.User) error {
+	if user.ID != 0 {
+		if user.Role != rbac.RoleCustomer {
+			return errSSOAccountConflict
+		}
+		return nil
+	}
+
+	name := identity.Name
+	if name == "" {
+		name = identity.Email
+	}
+
+	*user = models.User{Email: identity.Email, Role: rbac.RoleCustomer}
+	if err := tx.Create(user).Error; err != nil {
+		return err
+	}
+	customer := models.Customer{UserID: user.ID, Name: name}
+	if err := tx.Create(&customer).Error; err != nil {
+		return err
+	}
+	member := models.CustomerMember{
+		CustomerID: customer.ID,
+		UserID:     user.ID,
+		Role:       "owner",
+		Name:       name,
+	}
+	return tx.Create(&member).Error
+}
+
+// SSOLogin redirects the browser to the identity provider. The :client path
+// parameter is "admin" or "customer"; an optional return_to query parameter
+// is where the browser is sent with the token afterwards.
+func SSOLogin(c *gin.Context) {
+	client := c.Param("client")
+	if client != loginClientAdmin && client != loginClientCustomer {
+		apierror.AbortCode(c, apierror.NotFound, "Unknown login type")
+		return
+	}
+
+	provider, err := sso.Get(c.Request.Context())
+	if errors.Is(err, sso.ErrNotConfigured) {
+		apierror.AbortCode(c, apierror.SSONotConfigured, "Single sign-on is not configured")
+		return
+	}
+	if err != nil {
+		logging.FromContext(c).Error("OIDC discovery failed", "error", err)
+		apierror.AbortCode(c, apierror.IdentityProviderUnavailable, "Identity provider unavailable")
+		return
+	}
+
+	returnTo := c.Query("return_to")
+	if returnTo != "" && !provider.ReturnURLAllowed(returnTo) {
+		apierror.AbortCode(c, apierror.ValidationFailed, "return_to is not an allowed URL")
+		return
+	}
+
+	state, err := utils.GenerateRandomToken()
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to start sign-in")
+		return
+	}
+	nonce, err := utils.GenerateRandomToken()
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to start sign-in")
+		return
+	}
+
+	login := models.OIDCLoginState{
+		StateHash:    utils.HashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Client:       client,
+		ReturnTo:     returnTo,
+		ExpiresAt:    time.Now().Add(ssoStateTTL),
+	}
+	logDBError(c, "delete expired sign-ins", requestDB(c).Where("expires_at < ?", time.Now()).Delete(&models.OIDCLoginState{}).Error)
+	if err := requestDB(c).Create(&login).Error; err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to start sign-in")
+		return
+	}
+
+	c.Redirect(http.StatusFound, provider.AuthCodeURL(state, nonce, login.CodeVerifier))
+}
+
+// SSOCallback completes a sign-in at the identity provider. Without
+// return_to it answers like the password login; with it, it redirects the
+// browser to return_to with the token in the URL fragment.
+func SSOCallback(c *gin.Context) {
+	if idpError := c.Query("error"); idpError != "" {
+		message := c.Query("error_description")
+		if message == "" {
+			message = idpError
+		}
+		apierror.AbortCode(c, apierror.SSOFailed, "Sign-in failed: "+message)
+		return
+	}
+
+	var login models.OIDCLoginState
+	result := requestDB(c).Where("state_hash = ? AND expires_at > ?", utils.HashToken(c.Query("state")), time.Now()).
+		First(&login)
+	if result.Error != nil {
+		apierror.AbortCode(c, apierror.LoginChallengeInvalid, "Invalid or expired sign-in")
+		return
+	}
+	// Each state is used once
+	result = requestDB(c).Delete(&login)
+	logDBError(c, "consume sign-in state", result.Error)
+	if result.RowsAffected == 0 {
+		apierror.AbortCode(c, apierror.LoginChallengeInvalid, "Invalid or expired sign-in")
+		return
+	}
+
+	provider, err := sso.Get(c.Request.Context())
+	if err != nil {
+		apierror.AbortCode(c, apierror.IdentityProviderUnavailable, "Identity provider unavailable")
+		return
+	}
+
+	identity, err := provider.Exchange(c.Request.Context(), c.Query("code"), login.CodeVerifier, login.Nonce)
+	if err != nil {
+		logging.FromContext(c).Warn("OIDC code exchange failed", "error", err)
+		apierror.AbortCode(c, apierror.SSOFailed, "Sign-in failed")
+		return
+	}
+
+	user, err := ssoUser(provider, identity, login.Client)
+	if err != nil {
+		respondSSOError(c, err)
+		return
+	}
+
+	// The identity provider is responsible for 2FA on SSO logins
+	if login.ReturnTo == "" {
+		finishLogin(c, user, login.Client)
+		return
+	}
+
+	token, err := utils.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		apierror.AbortCode(c, apierror.Internal, "Failed to generate token")
+		return
+	}
+	loginSucceeded(c, user)
+
+	fragment := url.Values{}
+	fragment.Set("token", token)
+	fragment.Set("expires_in", "3600")
+	c.Redirect(http.StatusFound, login.ReturnTo+"#"+fragment.Encode())
+}
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"license-mnm/database/dbtest"
+	"license-mnm/middleware"
+	"license-mnm/models"
+	"license-mnm/rbac"
+	"license-mnm/sso"
+	"license-mnm/sso/mockidp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ssoTest is a router with the SSO endpoints, configured against a mock
+// identity provider
+type ssoTest struct {
+	t      *testing.T
+	db     *gorm.DB
+	router *gin.Engine
+}
+
+func newSSOTest(t *testing.T) *ssoTest {
+	t.Helper()
+	db := dbtest.Open(t)
+
+	idp, err := mockidp.New("alice@example.com", "Alice", []string{"it-admins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(idp)
+	t.Cleanup(server.Close)
+	idp.Issuer = server.URL
+
+	t.Setenv("OIDC_ISSUER_URL", server.URL)
+	t.Setenv("OIDC_CLIENT_ID", "license-mnm")
+	t.Setenv("OIDC_REDIRECT_URL", "http://api.test/api/auth/oidc/callback")
+	t.Setenv("OIDC_ADMIN_ROLE_GROUPS", "it-admins=super_admin,finance=billing_admin")
+	t.Setenv("OIDC_RETURN_URLS", "https://app.example.com/")
+	if err := sso.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(middleware.Errors(false))
+	r.GET("/api/auth/oidc/:client/login", SSOLogin)
+	r.GET("/api/auth/oidc/callback", SSOCallback)
+	return &ssoTest{t: t, db: db, router: r}
+}
+
+func (s *ssoTest) get(target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+// start begins a login and returns the IdP authorization URL it redirects to
+func (s *ssoTest) start(client, returnTo string) string {
+	s.t.Helper()
+	target := "/api/auth/oidc/" + client + "/login"
+	if returnTo != "" {
+		target += "?return_to=" + url.QueryEscape(returnTo)
+	}
+	w := s.get(target)
+	if w.Code != http.StatusFound {
+		s.t.Fatalf("login: got %d %s", w.Code, w.Body)
+	}
+	authURL, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	query := authURL.Query()
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		s.t.Errorf("authorization request without PKCE: %s", authURL)
+	}
+	return authURL.String()
+}
+
+// authorize signs in at the IdP as the identity in mock and returns the
+// callback path and query the IdP redirects back to
+func (s *ssoTest) authorize(authURL string, mock url.Values) string {
+	s.t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL + "&" + mock.Encode())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		s.t.Fatalf("authorize: got %d, %v", resp.StatusCode, err)
+	}
+	return callback.RequestURI()
+}
+
+// login runs the whole flow and returns the callback response
+func (s *ssoTest) login(client, returnTo string, mock url.Values) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.get(s.authorize(s.start(client, returnTo), mock))
+}
+
+func identityAs(email, name, groups string) url.Values {
+	return url.Values{"mock_email": {email}, "mock_name": {name}, "mock_groups": {groups}}
+}
+
+func TestSSOLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   string
+		identity url.Values
+		existing string // role of a user already registered with the email
+		wantCode string // error code; empty for a successful login
+		wantRole string
+	}{
+		{"admin group maps to super admin", "admin", identityAs("alice@example.com", "Alice", "it-admins"), "", "", rbac.RoleSuperAdmin},
+		{"highest mapped role wins", "admin", identityAs("bob@example.com", "Bob", "staff,finance"), "", "", rbac.RoleBillingAdmin},
+		{"admin without an admin group", "admin", identityAs("eve@example.com", "Eve", "staff"), "", "FORBIDDEN", ""},
+		{"customer provisioned just in time", "customer", identityAs("carol@example.com", "Carol Jones", ""), "", "", rbac.RoleCustomer},
+		{"existing customer is linked", "customer", identityAs("dave@example.com", "Dave", ""), rbac.RoleCustomer, "", rbac.RoleCustomer},
+		{"customer email at the admin login", "admin", identityAs("dave@example.com", "Dave", "it-admins"), rbac.RoleCustomer, "ACCOUNT_KIND_CONFLICT", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSSOTest(t)
+			email := tt.identity.Get("mock_email")
+			if tt.existing == rbac.RoleCustomer {
+				testCustomer(t, s.db, email)
+			}
+
+			w := s.login(tt.client, "", tt.identity)
+			var body struct {
+				Code  string `json:"code"`
+				Token string `json:"token"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body.Code != tt.wantCode {
+				t.Fatalf("callback: got %d %s, want code %q", w.Code, w.Body, tt.wantCode)
+			}
+
+			var users []models.User
+			s.db.Where("email = ?", email).Find(&users)
+			if tt.wantCode != "" {
+				if tt.existing == "" && len(users) != 0 {
+					t.Errorf("refused login provisioned %d users", len(users))
+				}
+				return
+			}
+			if w.Code != http.StatusOK || body.Token == "" {
+				t.Fatalf("callback: got %d %s", w.Code, w.Body)
+			}
+			if len(users) != 1 || users[0].Role != tt.wantRole {
+				t.Fatalf("users with %s: %+v, want one %s", email, users, tt.wantRole)
+			}
+
+			var links int64
+			s.db.Model(&models.UserIdentity{}).Where("user_id = ? AND email = ?", users[0].ID, email).Count(&links)
+			if links != 1 {
+				t.Errorf("%d identity links, want 1", links)
+			}
+
+			if tt.client == "customer" {
+				var customers []models.Customer
+				s.db.Where("user_id = ?", users[0].ID).Find(&customers)
+				wantName := tt.identity.Get("mock_name")
+				if tt.existing != "" {
+					wantName = "Customer " + email
+				}
+				if len(customers) != 1 || customers[0].Name != wantName {
+					t.Fatalf("customers: %+v, want one named %q", customers, wantName)
+				}
+				var member models.CustomerMember
+				if err := s.db.Where("customer_id = ? AND user_id = ?", customers[0].ID, users[0].ID).First(&member).Error; err != nil || member.Role != "owner" {
+					t.Errorf("membership %+v, %v; want owner", member, err)
+				}
+			}
+
+			// Signing in again reuses the linked account
+			if w := s.login(tt.client, "", tt.identity); w.Code != http.StatusOK {
+				t.Fatalf("second login: got %d %s", w.Code, w.Body)
+			}
+			var count int64
+			s.db.Model(&models.User{}).Where("email = ?", email).Count(&count)
+			if count != 1 {
+				t.Errorf("%d users after a second login, want 1", count)
+			}
+		})
+	}
+}
+
+func TestSSOAdminRoleFollowsGroups(t *testing.T) {
+	s := newSSOTest(t)
+	if err := s.db.Create(&models.User{Email: "root@example.com", Role: rbac.RoleSuperAdmin}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		groups string
+		want   string
+	}{
+		{"it-admins", rbac.RoleSuperAdmin},
+		{"finance", rbac.RoleBillingAdmin},
+		{"finance,it-admins", rbac.RoleSuperAdmin},
+	} {
+		w := s.login("admin", "", identityAs("alice@example.com", "Alice", step.groups))
+		var user models.User
+		s.db.Where("email = ?", "alice@example.com").First(&user)
+		if w.Code != http.StatusOK || user.Role != step.want {
+			t.Errorf("groups %s: got %d, role %q; want %q", step.groups, w.Code, user.Role, step.want)
+		}
+	}
+}
+
+func TestSSOCallbackChecks(t *testing.T) {
+	s := newSSOTest(t)
+	alice := identityAs("alice@example.com", "Alice", "it-admins")
+
+	// The code of one login can't complete another: its PKCE verifier differs
+	first := s.authorize(s.start("admin", ""), alice)
+	second := s.authorize(s.start("admin", ""), alice)
+	firstURL, _ := url.Parse(first)
+	secondURL, _ := url.Parse(second)
+	swapped := firstURL.Query()
+	swapped.Set("code", secondURL.Query().Get("code"))
+	if w := s.get(firstURL.Path + "?" + swapped.Encode()); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "SSO_FAILED") {
+		t.Errorf("code from another login: got %d %s", w.Code, w.Body)
+	}
+
+	// The failed redemption used up the code
+	if w := s.get(second); w.Code != http.StatusUnauthorized {
+		t.Errorf("login whose code was tried elsewhere: got %d %s", w.Code, w.Body)
+	}
+
+	// Each state completes one login
+	third := s.authorize(s.start("admin", ""), alice)
+	if w := s.get(third); w.Code != http.StatusOK {
+		t.Fatalf("third login: got %d %s", w.Code, w.Body)
+	}
+	if w := s.get(third); !strings.Contains(w.Body.String(), "LOGIN_CHALLENGE_INVALID") {
+		t.Errorf("replayed callback: got %d %s", w.Code, w.Body)
+	}
+
+	// return_to gets the token in the fragment, and must be allowed
+	w := s.get(s.authorize(s.start("customer", "https://app.example.com/signed-in"), identityAs("carol@example.com", "Carol", "")))
+	if location := w.Header().Get("Location"); w.Code != http.StatusFound || !strings.HasPrefix(location, "https://app.example.com/signed-in#") || !strings.Contains(location, "token=") {
+		t.Errorf("return_to: got %d, Location %q", w.Code, location)
+	}
+	for _, returnTo := range []string{"https://app.example.com.evil.com/", "https://evil.com/https://app.example.com/"} {
+		if w := s.get("/api/auth/oidc/customer/login?return_to=" + url.QueryEscape(returnTo)); w.Code != http.StatusBadRequest {
+			t.Errorf("return_to %s: got %d, want 400", returnTo, w.Code)
+		}
+	}
+}
+
+func TestSSOAdminKeepsLastSuperAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		otherAdmin bool
+		dbFails    bool
+		wantRole   string
+		wantErr    bool
+	}{
+		{"another super admin remains", true, false, rbac.RoleBillingAdmin, false},
+		{"last super admin keeps the role", false, false, rbac.RoleSuperAdmin, false},
+		{"database error", true, true, rbac.RoleSuperAdmin, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSSOTest(t)
+			provider, err := sso.Get(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := models.User{Email: "alice@example.com", Role: rbac.RoleSuperAdmin}
+			s.db.Create(&user)
+			if tt.otherAdmin {
+				s.db.Create(&models.User{Email: "root@example.com", Role: rbac.RoleSuperAdmin})
+			}
+
+			tx := s.db
+			if tt.dbFails {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				tx = s.db.WithContext(ctx)
+			}
+			err = ssoAdmin(tx, provider, sso.Identity{Email: user.Email, Groups: []string{"finance"}}, &user)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ssoAdmin() = %v, want error: %v", err, tt.wantErr)
+			}
+			var stored models.User
+			s.db.First(&stored, user.ID)
+			if stored.Role != tt.wantRole || user.Role != tt.wantRole {
+				t.Errorf("stored role %q, user role %q; want %q", stored.Role, user.Role, tt.wantRole)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"license-mnm/apierror"
+	"license-mnm/models"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxBulkItems is the most subscriptions or customers one bulk request acts on
+const maxBulkItems = 500
+
+// Bulk modes
+const (
+	bulkBestEffort   = "best_effort"
+	bulkAllOrNothing = "all_or_nothing"
+)
+
+// Statuses of one item of a bulk request
+const (
+	bulkSucceeded  = "succeeded"
+	bulkFailed     = "failed"
+	bulkRolledBack = "rolled_back" // would have succeeded, but another item failed in all_or_nothing mode
+)
+
+// bulkSourceStatuses are the statuses each subscription action applies to.
+// Subscriptions picked by customer_ids or filter are limited to them.
+var bulkSourceStatuses = map[string][]string{
+	"approve":    {"requested"},
+	"reject":     {"requested"},
+	"extend":     {"active"},
+	"deactivate": {"active"},
+}
+
+// errBulkRolledBack rolls back an all_or_nothing bulk request with failed items
+var errBulkRolledBack = errors.New("bulk request rolled back")
+
+type bulkSubscriptionRequest struct {
+	Action          string         `json:"action" binding:"required,oneof=approve reject extend deactivate assign"`
+	Mode            string         `json:"mode" binding:"omitempty,oneof=best_effort all_or_nothing"`
+	SubscriptionIDs []uint         `json:"subscription_ids" binding:"omitempty,max=500,dive,min=1"`
+	CustomerIDs     []uint         `json:"customer_ids" binding:"omitempty,max=500,dive,min=1"`
+	Filter          map[string]any `json:"filter"` // ListSubscriptions filter parameters
+	ExtendMonths    int            `json:"extend_months" binding:"min=0,max=120"`
+	ExtendDays      int            `json:"extend_days" binding:"min=0,max=3650"`
+	PackID          uint           `json:"pack_id"`
+	Currency        string         `json:"currency" binding:"omitempty,len=3,alpha"`
+	CouponCode      string         `json:"coupon_code"`
+}
+
+// bulkResult is the outcome for one subscription or customer
+type bulkResult struct {
+	SubscriptionID uint          `json:"subscription_id,omitempty"`
+	CustomerID     uint          `json:"customer_id,omitempty"`
+	Status         string        `json:"status"`
+	Code           apierror.Code `json:"code,omitempty"`
+	Message        string        `json:"message,omitempty"`
+}
+
+// bulkSummary counts the results of a bulk request by status
+type bulkSummary struct {
+	Total      int `json:"total"`
+	Succeeded  int `json:"succeeded"`
+	Failed     int `json:"failed"`
+	RolledBack int `json:"rolled_back"`
+}
+
+// bulkAssignment is the pack and price every customer of an assign action gets
+type bulkAssignment struct {
+	pack  models.SubscriptionPack
+	price models.PackPrice
+}
+
+// BulkUpdateSubscriptions approves, rejects, extends or deactivates
+// subscriptions picked by subscription_ids, customer_ids or filter, or
+// assigns a pack to customer_ids. Each item is reported in results. In
+// best_effort mode (the default) items succeed or fail on their own; in
+// all_or_nothing mode any failure rolls back every item.
+func BulkUpdateSubscriptions(c *gin.Context) {
+	var req bulkSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.AbortBind(c, err)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = bulkBestEffort
+	}
+	if apiErr := req.validate(); apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
+
+	var assignment bulkAssignment
+	if req.Action == "assign" {
+		if err := requestDB(c).Where("id = ? AND deleted_at IS NULL", req.PackID).First(&assignment.pack).Error; err != nil {
+			apierror.AbortCode(c, apierror.PackNotFound, "Subscription pack not found")
+			return
+		}
+		price, err := resolvePackPrice(assignment.pack.ID, req.Currency)
+		if err != nil {
+			apierror.AbortCode(c, apierror.PackCurrencyUnavailable, "Subscription pack is not available in this currency")
+			return
+		}
+		assignment.price = price
+	}
+
+	results, apiErr := bulkTargets(c, req)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
+
+	// Each item runs in its own transaction, nested in one for the whole
+	// request in all_or_nothing mode, so a failed item leaves nothing behind
+	apply := func(db *gorm.DB) bool {
+		ok := true
+		for i := range results {
+			if results[i].Status == bulkFailed {
+				ok = false
+				continue
+			}
+			err := db.Transaction(func(tx *gorm.DB) error {
+				return req.apply(tx, &results[i], assignment)
+			})
+			if err != nil {
+				ok = false
+				results[i].fail(c, req.Action, err)
+				continue
+			}
+			results[i].Status = bulkSucceeded
+		}
+		return ok
+	}
+
+	committed := true
+	if req.Mode == bulkAllOrNothing {
+		err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+			if !apply(tx) {
+				return errBulkRolledBack
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errBulkRolledBack) {
+			logDBError(c, "bulk "+req.Action+" subscriptions", err)
+			apierror.AbortCode(c, apierror.Internal, "Failed to update subscriptions")
+			return
+		}
+		if err != nil {
+			committed = false
+			for i := range results {
+				if results[i].Status == bulkSucceeded {
+					results[i].Status = bulkRolledBack
+				}
+			}
+		}
+	} else {
+		apply(requestDB(c))
+	}
+
+	summary := bulkSummary{Total: len(results)}
+	var succeeded []uint
+	for _, result := range results {
+		switch result.Status {
+		case bulkSucceeded:
+			summary.Succeeded++
+			succeeded = append(succeeded, result.SubscriptionID)
+		case bulkFailed:
+			summary.Failed++
+		case bulkRolledBack:
+			summary.RolledBack++
+		}
+	}
+	if len(succeeded) > 0 {
+		recordAudit(c, "subscriptions.bulk_"+req.Action, "subscriptions", gin.H{
+			"mode":             req.Mode,
+			"subscription_ids": succeeded,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   summary.Failed == 0,
+		"action":    req.Action,
+		"mode":      req.Mode,
+		"committed": committed,
+		"summary":   summary,
+		"results":   results,
+	})
+}
+
+// validate checks the fields each action needs
+func (req *bulkSubscriptionRequest) validate() *apierror.Error {
+	var details []apierror.FieldError
+	selectors := 0
+	for _, set := range []bool{req.SubscriptionIDs != nil, req.CustomerIDs != nil, req.Filter != nil} {
+		if set {
+			selectors++
+		}
+	}
+
+	switch {
+	case req.Action == "assign":
+		if req.CustomerIDs == nil || selectors > 1 {
+			details = append(details, apierror.FieldError{Field: "customer_ids", Rule: "required", Message: "assign takes customer_ids only"})
+		}
+		if req.PackID == 0 {
+			details = append(details, apierror.FieldError{Field: "pack_id", Rule: "required", Message: "is required"})
+		}
+	case selectors != 1:
+		details = append(details, apierror.FieldError{Field: "subscription_ids", Rule: "required", Message: "exactly one of subscription_ids, customer_ids or filter is required"})
+	}
+	if req.Action == "extend" && req.ExtendMonths == 0 && req.ExtendDays == 0 {
+		details = append(details, apierror.FieldError{Field: "extend_months", Rule: "required", Message: "extend_months or extend_days is required"})
+	}
+
+	if details != nil {
+		return apierror.Fields(details...)
+	}
+	return nil
+}
+
+// bulkTargets lists the items of a bulk request, with customers that have
+// no subscription to act on already failed
+func bulkTargets(c *gin.Context, req bulkSubscriptionRequest) ([]bulkResult, *apierror.Error) {
+	results := []bulkResult{}
+	switch {
+	case req.Action == "assign":
+		for _, id := range dedupe(req.CustomerIDs) {
+			results = append(results, bulkResult{CustomerID: id})
+		}
+		return results, nil
+
+	case req.SubscriptionIDs != nil:
+		for _, id := range dedupe(req.SubscriptionIDs) {
+			results = append(results, bulkResult{SubscriptionID: id})
+		}
+		return results, nil
+	}
+
+	query := requestDB(c).Model(&models.Subscription{}).Where("status IN ?", bulkSourceStatuses[req.Action])
+	if req.CustomerIDs != nil {
+		query = query.Where("customer_id IN ?", req.CustomerIDs)
+	} else {
+		filter, apiErr := parseBulkFilter(req.Filter)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		query = filter.apply(query)
+	}
+
+	var subscriptions []models.Subscription
+	if err := query.Order("id").Limit(maxBulkItems + 1).Find(&subscriptions).Error; err != nil {
+		logDBError(c, "select bulk subscriptions", err)
+		return nil, apierror.New(apierror.Internal, "Failed to select subscriptions")
+	}
+	if len(subscriptions) > maxBulkItems {
+		return nil, apierror.Fields(apierror.FieldError{Field: "filter", Rule: "max", Message: fmt.Sprintf("matches more than %d subscriptions; narrow it", maxBulkItems)})
+	}
+	for _, subscription := range subscriptions {
+		results = append(results, bulkResult{SubscriptionID: subscription.ID, CustomerID: subscription.CustomerID})
+	}
+
+	for _, id := range dedupe(req.CustomerIDs) {
+		if !slices.ContainsFunc(subscriptions, func(s models.Subscription) bool { return s.CustomerID == id }) {
+			code, message := apierror.SubscriptionNotFound, "Customer has no requested subscription"
+			if req.Action == "extend" || req.Action == "deactivate" {
+				code, message = apierror.NoActiveSubscription, "Customer has no active subscription"
+			}
+			results = append(results, bulkResult{CustomerID: id, Status: bulkFailed, Code: code, Message: message})
+		}
+	}
+	return results, nil
+}
+
+// parseBulkFilter reads a filter object with the parameters of
+// ListSubscriptions. Unknown keys are rejected rather than ignored, so a
+// misspelled key can't widen the filter.
+func parseBulkFilter(filter map[string]any) (subscriptionFilter, *apierror.Error) {
+	query := url.Values{}
+	var details []apierror.FieldError
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys) // report errors in a stable order
+	for _, key := range keys {
+		value := filter[key]
+		if !slices.Contains(subscriptionFilterParams, key) {
+			details = append(details, apierror.FieldError{Field: "filter." + key, Rule: "oneof", Message: "is not a subscription filter"})
+			continue
+		}
+		values, ok := value.([]any)
+		if ok && key != "status" {
+			details = append(details, apierror.FieldError{Field: "filter." + key, Rule: "type", Message: "must be a single value; only status takes several"})
+			continue
+		}
+		if !ok {
+			values = []any{value}
+		}
+		for _, value := range values {
+			switch value := value.(type) {
+			case string:
+				query.Add(key, value)
+			case float64:
+				query.Add(key, strconv.FormatFloat(value, 'f', -1, 64))
+			default:
+				details = append(details, apierror.FieldError{Field: "filter." + key, Rule: "type", Message: "must be a string or a number"})
+			}
+		}
+	}
+	if details != nil {
+		return subscriptionFilter{}, apierror.Fields(details...)
+	}
+
+	parsed, apiErr := parseSubscriptionFilter(query)
+	if apiErr != nil {
+		for i := range apiErr.Details {
+			apiErr.Details[i].Field = "filter." + apiErr.Details[i].Field
+		}
+	}
+	return parsed, apiErr
+}
+
+// apply performs the action on one item
+func (req *bulkSubscriptionRequest) apply(tx *gorm.DB, result *bulkResult, assignment bulkAssignment) error {
+	now := time.Now()
+	if req.Action == "assign" {
+		var customer models.Customer
+		if err := tx.Where("id = ? AND deleted_at IS NULL", result.CustomerID).First(&customer).Error; err != nil {
+			return err
+		}
+		var active int64
+		if err := tx.Model(&models.Subscription{}).Where("customer_id = ? AND status = ?", customer.ID, "active").Count(&active).Error; err != nil {
+			return err
+		}
+		if active > 0 {
+			return apierror.New(apierror.SubscriptionAlreadyActive, "Customer already has an active subscription")
+		}
+
+		expiresAt := now.AddDate(0, assignment.pack.ValidityMonths, 0)
+		subscription := models.Subscription{
+			CustomerID:    customer.ID,
+			PackID:        assignment.pack.ID,
+			Status:        "active",
+			RequestedAt:   now,
+			AssignedAt:    &now,
+			ExpiresAt:     &expiresAt,
+			PriceAmount:   assignment.price.Amount,
+			PriceCurrency: assignment.price.Currency,
+		}
+		if err := createSubscription(tx, &subscription, req.CouponCode); err != nil {
+			return err
+		}
+		result.SubscriptionID = subscription.ID
+		return nil
+	}
+
+	var subscription models.Subscription
+	if err := tx.First(&subscription, result.SubscriptionID).Error; err != nil {
+		return err
+	}
+	result.CustomerID = subscription.CustomerID
+	if !slices.Contains(bulkSourceStatuses[req.Action], subscription.Status) {
+		if req.Action == "approve" || req.Action == "reject" {
+			return apierror.New(apierror.SubscriptionNotRequested, "Subscription is not in requested status")
+		}
+		return apierror.New(apierror.SubscriptionNotActive, "Subscription is not active")
+	}
+
+	switch req.Action {
+	case "approve":
+		subscription.Status = "approved"
+		subscription.ApprovedAt = &now
+	case "reject":
+		subscription.Status = "rejected"
+		subscription.RejectedAt = &now
+		if err := releaseCoupon(tx, subscription); err != nil {
+			return err
+		}
+	case "extend":
+		base := now
+		if subscription.ExpiresAt != nil {
+			base = *subscription.ExpiresAt
+		}
+		expiresAt := base.AddDate(0, req.ExtendMonths, req.ExtendDays)
+		subscription.ExpiresAt = &expiresAt
+	case "deactivate":
+		subscription.Status = "inactive"
+		subscription.DeactivatedAt = &now
+	}
+	return tx.Save(&subscription).Error
+}
+
+// fail records why an item failed. Errors other than API errors and
+// missing rows are logged and reported as internal errors.
+func (result *bulkResult) fail(c *gin.Context, action string, err error) {
+	result.Status = bulkFailed
+	var apiErr *apierror.Error
+	switch {
+	case errors.As(err, &apiErr):
+		result.Code, result.Message = apiErr.Code, apiErr.Message
+	case errors.Is(err, gorm.ErrRecordNotFound) && action == "assign":
+		result.Code, result.Message = apierror.CustomerNotFound, "Customer not found"
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		result.Code, result.Message = apierror.SubscriptionNotFound, "Subscription not found"
+	default:
+		logDBError(c, "bulk "+action+" subscription", err)
+		result.Code, result.Message = apierror.Internal, "Failed to update subscription"
+	}
+}
+
+// dedupe returns ids without repeats, in their first order
+func dedupe(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
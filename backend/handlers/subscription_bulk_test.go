@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"license-mnm/database/dbtest"
+	"license-mnm/middleware"
+	"license-mnm/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBulkUpdateSubscriptionsModes(t *testing.T) {
+	// Each case starts from: requested (with a coupon) for customer a,
+	// requested for b, active for c. IDs in bodies are placeholders for
+	// these: "$a" etc. for customers and "$sa" etc. for subscriptions.
+	tests := []struct {
+		name          string
+		body          string
+		wantCommitted bool
+		wantResults   []string        // status of each item, in order
+		wantStatuses  [3]string       // status of the subscriptions of a, b and c afterwards
+		wantCoupon    int64           // coupon redemptions afterwards
+		wantAudit     bool            // whether a bulk audit entry was written
+		wantAssigned  map[string]bool // customers that end up with a new active subscription
+	}{
+		{
+			name:          "all_or_nothing commits when every item succeeds",
+			body:          `{"action":"approve","mode":"all_or_nothing","subscription_ids":[$sa,$sb]}`,
+			wantCommitted: true,
+			wantResults:   []string{bulkSucceeded, bulkSucceeded},
+			wantStatuses:  [3]string{"approved", "approved", "active"},
+			wantCoupon:    1,
+			wantAudit:     true,
+		},
+		{
+			name:         "all_or_nothing rolls back on a failed item",
+			body:         `{"action":"approve","mode":"all_or_nothing","subscription_ids":[$sa,$sc,$sb]}`,
+			wantResults:  []string{bulkRolledBack, bulkFailed, bulkRolledBack},
+			wantStatuses: [3]string{"requested", "requested", "active"},
+			wantCoupon:   1,
+		},
+		{
+			name:         "all_or_nothing rollback restores released coupons",
+			body:         `{"action":"reject","mode":"all_or_nothing","subscription_ids":[$sa,999]}`,
+			wantResults:  []string{bulkRolledBack, bulkFailed},
+			wantStatuses: [3]string{"requested", "requested", "active"},
+			wantCoupon:   1,
+		},
+		{
+			name:         "all_or_nothing rolls back when a customer has nothing to act on",
+			body:         `{"action":"approve","mode":"all_or_nothing","customer_ids":[$a,$c]}`,
+			wantResults:  []string{bulkRolledBack, bulkFailed},
+			wantStatuses: [3]string{"requested", "requested", "active"},
+			wantCoupon:   1,
+		},
+		{
+			name:         "all_or_nothing assign rolls back created subscriptions",
+			body:         `{"action":"assign","mode":"all_or_nothing","customer_ids":[$b,$c],"pack_id":$pack}`,
+			wantResults:  []string{bulkRolledBack, bulkFailed},
+			wantStatuses: [3]string{"requested", "requested", "active"},
+			wantCoupon:   1,
+			wantAssigned: map[string]bool{},
+		},
+		{
+			name:          "best_effort keeps the items that succeeded",
+			body:          `{"action":"reject","subscription_ids":[$sa,999]}`,
+			wantCommitted: true,
+			wantResults:   []string{bulkSucceeded, bulkFailed},
+			wantStatuses:  [3]string{"rejected", "requested", "active"},
+			wantCoupon:    0,
+			wantAudit:     true,
+		},
+		{
+			name:          "best_effort assign keeps created subscriptions",
+			body:          `{"action":"assign","customer_ids":[$b,$c],"pack_id":$pack}`,
+			wantCommitted: true,
+			wantResults:   []string{bulkSucceeded, bulkFailed},
+			wantStatuses:  [3]string{"requested", "requested", "active"},
+			wantCoupon:    1,
+			wantAudit:     true,
+			wantAssigned:  map[string]bool{"b": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			pack := testPack(t, db, "BULK")
+			if err := db.Create(&models.Coupon{Code: "BULK10", DiscountType: "percentage", PercentOff: 10, Active: true}).Error; err != nil {
+				t.Fatal(err)
+			}
+			customers := map[string]models.Customer{}
+			subscriptions := map[string]models.Subscription{}
+			for _, setup := range []struct{ name, status, coupon string }{
+				{"a", "requested", "BULK10"},
+				{"b", "requested", ""},
+				{"c", "active", ""},
+			} {
+				customers[setup.name] = testCustomer(t, db, setup.name+"@example.com")
+				subscriptions[setup.name] = testSubscription(t, db, customers[setup.name], pack, setup.status, setup.coupon)
+			}
+
+			replacements := []string{"$pack", fmt.Sprint(pack.ID)}
+			for name := range customers {
+				replacements = append(replacements, "$s"+name, fmt.Sprint(subscriptions[name].ID), "$"+name, fmt.Sprint(customers[name].ID))
+			}
+			body := strings.NewReplacer(replacements...).Replace(tt.body)
+
+			r := gin.New()
+			r.Use(middleware.Errors(false))
+			r.POST("/subscriptions/bulk", BulkUpdateSubscriptions)
+			req := httptest.NewRequest(http.MethodPost, "/subscriptions/bulk", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			var resp struct {
+				Committed bool
+				Results   []bulkResult
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("got %d %s", w.Code, w.Body)
+			}
+			statuses := make([]string, len(resp.Results))
+			for i, result := range resp.Results {
+				statuses[i] = result.Status
+			}
+			if resp.Committed != tt.wantCommitted || !reflect.DeepEqual(statuses, tt.wantResults) {
+				t.Errorf("committed %v, results %v; want %v, %v (%s)", resp.Committed, statuses, tt.wantCommitted, tt.wantResults, w.Body)
+			}
+
+			for i, name := range []string{"a", "b", "c"} {
+				var stored models.Subscription
+				db.First(&stored, subscriptions[name].ID)
+				if stored.Status != tt.wantStatuses[i] {
+					t.Errorf("subscription of %s is %s, want %s", name, stored.Status, tt.wantStatuses[i])
+				}
+			}
+
+			var redemptions int64
+			db.Model(&models.CouponRedemption{}).Count(&redemptions)
+			var coupon models.Coupon
+			db.Where("code = ?", "BULK10").First(&coupon)
+			if redemptions != tt.wantCoupon || int64(coupon.TimesRedeemed) != tt.wantCoupon {
+				t.Errorf("%d redemptions, times_redeemed %d; want %d", redemptions, coupon.TimesRedeemed, tt.wantCoupon)
+			}
+
+			var audits int64
+			db.Model(&models.AuditLog{}).Where("action LIKE ?", "subscriptions.bulk_%").Count(&audits)
+			if (audits > 0) != tt.wantAudit {
+				t.Errorf("%d bulk audit entries, want any: %v", audits, tt.wantAudit)
+			}
+
+			if tt.wantAssigned != nil {
+				for _, name := range []string{"a", "b"} {
+					var active int64
+					db.Model(&models.Subscription{}).Where("customer_id = ? AND status = ?", customers[name].ID, "active").Count(&active)
+					if (active > 0) != tt.wantAssigned[name] {
+						t.Errorf("customer %s has %d active subscriptions, want any: %v", name, active, tt.wantAssigned[name])
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"license-mnm/apierror"
+	"license-mnm/models"
+	"license-mnm/pagination"
+	"license-mnm/trash"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// revokeCustomerAccess deactivates a deleted customer's open subscriptions,
+// giving back the coupon uses of those never assigned, and revokes the API
+// keys and OAuth clients of its organization, so no credential keeps
+// working. Restoring the customer doesn't undo it.
+func revokeCustomerAccess(tx *gorm.DB, customerID uint, now time.Time) error {
+	var open []models.Subscription
+	if err := tx.Where("customer_id = ? AND status IN ?", customerID, []string{"requested", "approved", "active"}).Find(&open).Error; err != nil {
+		return err
+	}
+	for _, subscription := range open {
+		if err := releaseCoupon(tx, subscription); err != nil {
+			return err
+		}
+	}
+	err := tx.Model(&models.Subscription{}).
+		Where("customer_id = ? AND status IN ?", customerID, []string{"requested", "approved", "active"}).
+		Updates(map[string]interface{}{"status": "inactive", "deactivated_at": now}).Error
+	if err != nil {
+		return err
+	}
+
+	members := tx.Model(&models.CustomerMember{}).Select("user_id").Where("customer_id = ?", customerID)
+	if err := tx.Model(&models.APIKey{}).Where("user_id IN (?) AND revoked_at IS NULL", members).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.User{}).Where("id IN (?)", members).Update("api_key", "").Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.OAuthClient{}).Where("customer_id = ? AND revoked_at IS NULL", customerID).Update("revoked_at", now).Error
+}
+
+// purgeAt is when the trash sweeper will purge a record deleted at
+// deletedAt, or nil when records are only purged by hand
+func purgeAt(deletedAt *time.Time) *time.Time {
+	if trash.Retention() <= 0 || deletedAt == nil {
+		return nil
+	}
+	t := deletedAt.Add(trash.Retention())
+	return &t
+}
+
+// deletedCustomer is a customer in the trash
+type deletedCustomer struct {
+	models.Customer
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+// deletedPack is a subscription pack in the trash
+type deletedPack struct {
+	models.SubscriptionPack
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+// deletedCustomerList pages ListDeletedCustomers
+var deletedCustomerList = pagination.List[models.Customer]{
+	DefaultLimit: 20,
+	DefaultSort:  "deleted_at",
+	DefaultDesc:  true,
+	Sorts: map[string]pagination.Sort[models.Customer]{
+		"id":         {Column: "id", Value: func(c *models.Customer) any { return c.ID }},
+		"name":       {Column: "name", Value: func(c *models.Customer) any { return c.Name }},
+		"deleted_at": {Column: "deleted_at", Value: func(c *models.Customer) any { return c.DeletedAt }},
+	},
+	ID: func(c *models.Customer) uint { return c.ID },
+}
+
+// deletedPackList pages ListDeletedPacks
+var deletedPackList = pagination.List[models.SubscriptionPack]{
+	DefaultLimit: 20,
+	DefaultSort:  "deleted_at",
+	DefaultDesc:  true,
+	Sorts: map[string]pagination.Sort[models.SubscriptionPack]{
+		"id":         {Column: "id", Value: func(p *models.SubscriptionPack) any { return p.ID }},
+		"name":       {Column: "name", Value: func(p *models.SubscriptionPack) any { return p.Name }},
+		"sku":        {Column: "sku", Value: func(p *models.SubscriptionPack) any { return p.SKU }},
+		"deleted_at": {Column: "deleted_at", Value: func(p *models.SubscriptionPack) any { return p.DeletedAt }},
+	},
+	ID: func(p *models.SubscriptionPack) uint { return p.ID },
+}
+
+// ListDeletedCustomers lists soft-deleted customers, most recently deleted
+// first, with when each will be purged
+func ListDeletedCustomers(c *gin.Context) {
+	page, apiErr := deletedCustomerList.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
+
+	var customers []models.Customer
+	var total int64
+	query := requestDB(c).Model(&models.Customer{}).Where("deleted_at IS NOT NULL")
+	logDBError(c, "count deleted customers", query.Count(&total).Error)
+	logDBError(c, "list deleted customers", page.Apply(query).Preload("User").Find(&customers).Error)
+	customers, meta := page.Result(customers, total)
+
+	results := make([]deletedCustomer, len(customers))
+	for i, customer := range customers {
+		results[i] = deletedCustomer{Customer: customer}
+		if customer.ErasedAt == nil {
+			results[i].PurgeAt = purgeAt(customer.DeletedAt)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"customers":  results,
+		"pagination": meta,
+	})
+}
+
+// ListDeletedPacks lists soft-deleted subscription packs, most recently
+// deleted first, with when each will be purged
+func ListDeletedPacks(c *gin.Context) {
+	page, apiErr := deletedPackList.Parse(c)
+	if apiErr != nil {
+		apierror.Abort(c, apiErr)
+		return
+	}
+
+	var packs []models.SubscriptionPack
+	var total int64
+	query := requestDB(c).Model(&models.SubscriptionPack{}).Where("deleted_at IS NOT NULL")
+	logDBError(c, "count deleted subscription packs", query.Count(&total).Error)
+	logDBError(c, "list deleted subscription packs", page.Apply(query).Find(&packs).Error)
+	packs, meta := page.Result(packs, total)
+
+	results := make([]deletedPack, len(packs))
+	for i, pack := range packs {
+		results[i] = deletedPack{SubscriptionPack: pack, PurgeAt: purgeAt(pack.DeletedAt)}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"packs":      results,
+		"pagination": meta,
+	})
+}
+
+// RestoreCustomer takes a customer out of the trash. Its subscriptions stay
+// inactive and its API keys and OAuth clients stay revoked.
+func RestoreCustomer(c *gin.Context) {
+	var customer models.Customer
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NOT NULL", c.Param("customer_id")).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Deleted customer not found")
+		return
+	}
+	if !ifMatch(c, customer.Version) {
+		return
+	}
+
+	customer.DeletedAt = nil
+	if err := saveVersioned(requestDB(c), &customer, &customer.Version); err != nil {
+		if errors.Is(err, errVersionConflict) {
+			abortVersionConflict(c)
+			return
+		}
+		logDBError(c, "restore customer", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to restore customer")
+		return
+	}
+
+	setETag(c, customer.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"customer": customer,
+	})
+}
+
+// RestoreSubscriptionPack takes a subscription pack out of the trash
+func RestoreSubscriptionPack(c *gin.Context) {
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NOT NULL", c.Param("pack_id")).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Deleted subscription pack not found")
+		return
+	}
+	if !ifMatch(c, pack.Version) {
+		return
+	}
+
+	pack.DeletedAt = nil
+	if err := saveVersioned(requestDB(c), &pack, &pack.Version); err != nil {
+		if errors.Is(err, errVersionConflict) {
+			abortVersionConflict(c)
+			return
+		}
+		logDBError(c, "restore subscription pack", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to restore subscription pack")
+		return
+	}
+
+	setETag(c, pack.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"pack":    pack,
+	})
+}
+
+// PurgeCustomer permanently removes a deleted customer with its users,
+// subscriptions and credentials. It can't be undone. Erased customers can't
+// be purged.
+func PurgeCustomer(c *gin.Context) {
+	var customer models.Customer
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NOT NULL", c.Param("customer_id")).First(&customer).Error; err != nil {
+		apierror.AbortCode(c, apierror.CustomerNotFound, "Deleted customer not found")
+		return
+	}
+
+	err := trash.PurgeCustomer(requestDB(c), customer.ID)
+	if errors.Is(err, trash.ErrCustomerErased) {
+		apierror.AbortCode(c, apierror.CustomerErased, "Erased customers are kept for accounting and can't be purged")
+		return
+	}
+	if err != nil {
+		logDBError(c, "purge customer", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to purge customer")
+		return
+	}
+	recordAudit(c, "customer.purged", fmt.Sprintf("customer:%d", customer.ID), nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Customer purged successfully",
+	})
+}
+
+// PurgeSubscriptionPack permanently removes a deleted subscription pack with
+// its prices. Packs that subscriptions refer to can't be purged.
+func PurgeSubscriptionPack(c *gin.Context) {
+	var pack models.SubscriptionPack
+	if err := requestDB(c).Where("id = ? AND deleted_at IS NOT NULL", c.Param("pack_id")).First(&pack).Error; err != nil {
+		apierror.AbortCode(c, apierror.PackNotFound, "Deleted subscription pack not found")
+		return
+	}
+
+	err := trash.PurgePack(requestDB(c), pack.ID)
+	if errors.Is(err, trash.ErrPackInUse) {
+		apierror.AbortCode(c, apierror.PackInUse, "Subscriptions refer to this pack, so it can't be purged")
+		return
+	}
+	if err != nil {
+		logDBError(c, "purge subscription pack", err)
+		apierror.AbortCode(c, apierror.Internal, "Failed to purge subscription pack")
+		return
+	}
+	recordAudit(c, "pack.purged", fmt.Sprintf("pack:%d", pack.ID), gin.H{"sku": pack.SKU})
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Subscription pack purged successfully",
+	})
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"fmt"
+	"license-mnm/apierror"
+	"license-mnm/database/dbtest"
+	"license-mnm/middleware"
+	"license-mnm/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPurgeCustomer(t *testing.T) {
+	tests := []struct {
+		name       string
+		deleted    bool
+		erased     bool
+		wantStatus int
+		wantCode   apierror.Code
+		wantKept   bool // whether the customer and its subscription remain
+	}{
+		{"deleted customer", true, false, http.StatusOK, "", false},
+		{"erased customer", true, true, http.StatusConflict, apierror.CustomerErased, true},
+		{"live customer", false, false, http.StatusNotFound, apierror.CustomerNotFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			pack := testPack(t, db, "PURGE")
+			if err := db.Create(&models.Coupon{Code: "PURGE", DiscountType: "percentage", PercentOff: 10, Active: true}).Error; err != nil {
+				t.Fatal(err)
+			}
+			customer := testCustomer(t, db, "purge@example.com")
+			subscription := testSubscription(t, db, customer, pack, "active", "PURGE")
+			now := time.Now()
+			if tt.deleted {
+				db.Model(&customer).Update("deleted_at", now)
+			}
+			if tt.erased {
+				db.Model(&customer).Update("erased_at", now)
+			}
+
+			r := gin.New()
+			r.Use(middleware.Errors(false))
+			r.DELETE("/trash/customers/:customer_id", PurgeCustomer)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/trash/customers/%d", customer.ID), nil))
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), string(tt.wantCode)) {
+				t.Errorf("got %d %s, want %d %s", w.Code, w.Body, tt.wantStatus, tt.wantCode)
+			}
+
+			var customers, subscriptions, redemptions int64
+			db.Model(&models.Customer{}).Where("id = ?", customer.ID).Count(&customers)
+			db.Model(&models.Subscription{}).Where("id = ?", subscription.ID).Count(&subscriptions)
+			db.Model(&models.CouponRedemption{}).Where("subscription_id = ?", subscription.ID).Count(&redemptions)
+			if kept := customers == 1 && subscriptions == 1 && redemptions == 1; kept != tt.wantKept {
+				t.Errorf("%d customers, %d subscriptions, %d redemptions left; want kept: %v", customers, subscriptions, redemptions, tt.wantKept)
+			}
+			if !tt.wantKept && customers+subscriptions+redemptions != 0 {
+				t.Errorf("%d customers, %d subscriptions, %d redemptions left after purge", customers, subscriptions, redemptions)
+			}
+		})
+	}
+}
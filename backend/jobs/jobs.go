@@ -0,0 +1,163 @@
+// Package jobs runs bulk operations in the background and records their
+// progress in the jobs table, so clients can poll for the outcome.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"license-mnm/database"
+	"license-mnm/models"
+)
+
+// Job statuses
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// maxErrors bounds the row errors a job keeps; Failed still counts them all
+const maxErrors = 1000
+
+// saveInterval is how often a running job's progress is written
+const saveInterval = time.Second
+
+var (
+	// stopping is canceled by Shutdown; running jobs stop between rows
+	stopping, stop = context.WithCancel(context.Background())
+	running        sync.WaitGroup
+)
+
+// Func does a job's work, reporting each row to progress. It should return
+// ctx.Err() once ctx is canceled. Other errors fail the whole job.
+type Func func(ctx context.Context, progress *Progress) error
+
+// Init fails the jobs a previous server process left unfinished
+func Init() error {
+	return database.DB.Model(&models.Job{}).Where("status IN ?", []string{StatusQueued, StatusRunning}).
+		Updates(map[string]interface{}{
+			"status":      StatusFailed,
+			"message":     "Interrupted by a server restart",
+			"finished_at": time.Now(),
+		}).Error
+}
+
+// Start saves job as queued with total rows and runs fn in the background.
+// job holds the saved row when Start returns.
+func Start(job *models.Job, total int, fn Func) error {
+	job.Status = StatusQueued
+	job.Total = total
+	if err := database.DB.Create(job).Error; err != nil {
+		return err
+	}
+
+	running.Add(1)
+	go run(*job, fn)
+	return nil
+}
+
+// Shutdown stops running jobs between rows and waits for them to record
+// that they were interrupted, or for ctx to end
+func Shutdown(ctx context.Context) error {
+	stop()
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func run(job models.Job, fn Func) {
+	defer running.Done()
+	log := slog.With("job_id", job.ID, "kind", job.Kind)
+
+	started := time.Now()
+	job.Status = StatusRunning
+	job.StartedAt = &started
+	progress := &Progress{job: &job, log: log}
+	progress.save()
+
+	err := call(fn, progress)
+	finished := time.Now()
+	job.FinishedAt = &finished
+	switch {
+	case err == nil:
+		job.Status = StatusSucceeded
+	case errors.Is(err, context.Canceled):
+		job.Status = StatusFailed
+		job.Message = "Interrupted by server shutdown"
+	default:
+		log.Error("job failed", "error", err)
+		job.Status = StatusFailed
+		job.Message = "Internal error; rows processed before it were kept"
+	}
+	progress.save()
+	log.Info("job finished", "status", job.Status, "succeeded", job.Succeeded, "failed", job.Failed)
+}
+
+// call runs fn, turning a panic into an error so the job is still finished
+func call(fn Func, progress *Progress) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return fn(stopping, progress)
+}
+
+// Progress counts the rows a job has processed
+type Progress struct {
+	job     *models.Job
+	log     *slog.Logger
+	savedAt time.Time
+}
+
+// DryRun reports whether the job must not write anything
+func (p *Progress) DryRun() bool {
+	return p.job.DryRun
+}
+
+// Succeeded records that a row was processed, and what it created
+func (p *Progress) Succeeded(results ...models.JobResult) {
+	p.job.Processed++
+	p.job.Succeeded++
+	p.job.Results = append(p.job.Results, results...)
+	p.saveEvery()
+}
+
+// Failed records that a row failed, and why
+func (p *Progress) Failed(rowErrs ...models.JobError) {
+	p.job.Processed++
+	p.job.Failed++
+	for _, rowErr := range rowErrs {
+		if len(p.job.Errors) < maxErrors {
+			p.job.Errors = append(p.job.Errors, rowErr)
+		}
+	}
+	p.saveEvery()
+}
+
+func (p *Progress) saveEvery() {
+	if time.Since(p.savedAt) >= saveInterval {
+		p.save()
+	}
+}
+
+func (p *Progress) save() {
+	p.savedAt = time.Now()
+	if err := database.DB.Save(p.job).Error; err != nil {
+		p.log.Error("database error", "operation", "save job progress", "error", err)
+	}
+}
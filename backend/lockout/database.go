@@ -0,0 +1,60 @@
+package lockout
+
+import (
+	"errors"
+	"license-mnm/database"
+	"license-mnm/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DBStore keeps failure records in the login_attempts table, so they survive
+// restarts and are shared by every server instance using the database
+type DBStore struct{}
+
+// NewDBStore creates a DBStore using database.DB
+func NewDBStore() *DBStore {
+	return &DBStore{}
+}
+
+// Get returns the record for key
+func (s *DBStore) Get(key string) (Record, error) {
+	var attempt models.LoginAttempt
+	err := database.DB.Where(&models.LoginAttempt{Key: key}).First(&attempt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Record{}, nil
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Failures: attempt.Failures, LastFailureAt: attempt.LastFailureAt}, nil
+}
+
+// RecordFailure adds a failure for key
+func (s *DBStore) RecordFailure(key string, now time.Time, window time.Duration) (Record, error) {
+	var attempt models.LoginAttempt
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where(&models.LoginAttempt{Key: key}).First(&attempt).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		attempt.Key = key
+		if now.Sub(attempt.LastFailureAt) > window {
+			attempt.Failures = 0
+		}
+		attempt.Failures++
+		attempt.LastFailureAt = now
+		return tx.Save(&attempt).Error
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Failures: attempt.Failures, LastFailureAt: attempt.LastFailureAt}, nil
+}
+
+// Reset forgets all failures for key
+func (s *DBStore) Reset(key string) error {
+	return database.DB.Where(&models.LoginAttempt{Key: key}).Delete(&models.LoginAttempt{}).Error
+}
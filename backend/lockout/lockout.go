@@ -0,0 +1,236 @@
+// Package lockout tracks failed login attempts per account and per client IP
+// and decides when further attempts must wait.
+//
+// Each failure doubles the wait before the next attempt (exponential
+// backoff), and after MaxFailures the key is locked out for the Lockout
+// duration. Failures older than the Lockout duration are forgotten.
+package lockout
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record is the failure history of one key
+type Record struct {
+	Failures      int
+	LastFailureAt time.Time
+}
+
+// Store keeps failure records. Keys are opaque strings such as
+// "account:user@example.com" or "ip:203.0.113.7".
+type Store interface {
+	// Get returns the record for key, or a zero Record if there is none
+	Get(key string) (Record, error)
+	// RecordFailure adds a failure for key, first forgetting the previous
+	// failures if the last one is older than window
+	RecordFailure(key string, now time.Time, window time.Duration) (Record, error)
+	// Reset forgets all failures for key
+	Reset(key string) error
+}
+
+// Policy sets how failures turn into waits and lockouts
+type Policy struct {
+	MaxFailures int           // failures before the key is locked out
+	Lockout     time.Duration // how long a lockout lasts
+	BaseDelay   time.Duration // wait after the first failure, doubled after each further one; 0 disables backoff
+	MaxDelay    time.Duration // cap on the backoff wait
+}
+
+// BlockedUntil returns when the next attempt is allowed after record
+func (p Policy) BlockedUntil(record Record) time.Time {
+	if record.Failures == 0 {
+		return time.Time{}
+	}
+	if record.Failures >= p.MaxFailures {
+		return record.LastFailureAt.Add(p.Lockout)
+	}
+	if p.BaseDelay <= 0 {
+		return time.Time{}
+	}
+
+	delay := p.MaxDelay
+	if shift := record.Failures - 1; shift < 30 && p.BaseDelay<<shift < p.MaxDelay {
+		delay = p.BaseDelay << shift
+	}
+	return record.LastFailureAt.Add(delay)
+}
+
+// Status is the current state of one key
+type Status struct {
+	Failures     int
+	Locked       bool      // locked out, rather than waiting out a backoff
+	BlockedUntil time.Time // zero when attempts are allowed
+}
+
+// Result reports which keys a failure locked out
+type Result struct {
+	AccountLocked bool
+	IPLocked      bool
+	Account       Status
+	IP            Status
+}
+
+// Guard applies an account policy and an IP policy to a store
+type Guard struct {
+	store   Store
+	account Policy
+	ip      Policy
+	now     func() time.Time
+}
+
+// NewGuard creates a Guard
+func NewGuard(store Store, account, ip Policy) *Guard {
+	return &Guard{store: store, account: account, ip: ip, now: time.Now}
+}
+
+// AccountKey returns the store key for an account, identified by email
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// IPKey returns the store key for a client IP
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns how long the client must wait before trying to log in to the
+// account again; zero means the attempt may go ahead
+func (g *Guard) Check(email, ip string) (time.Duration, error) {
+	now := g.now()
+	var wait time.Duration
+
+	for _, check := range []struct {
+		key    string
+		policy Policy
+	}{
+		{AccountKey(email), g.account},
+		{IPKey(ip), g.ip},
+	} {
+		record, err := g.store.Get(check.key)
+		if err != nil {
+			return 0, err
+		}
+		if d := check.policy.BlockedUntil(record).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Fail records a failed attempt for the account and IP
+func (g *Guard) Fail(email, ip string) (Result, error) {
+	now := g.now()
+	var result Result
+
+	account, err := g.store.RecordFailure(AccountKey(email), now, g.account.Lockout)
+	if err != nil {
+		return result, err
+	}
+	result.Account = g.status(account, g.account, now)
+	result.AccountLocked = account.Failures == g.account.MaxFailures
+
+	addr, err := g.store.RecordFailure(IPKey(ip), now, g.ip.Lockout)
+	if err != nil {
+		return result, err
+	}
+	result.IP = g.status(addr, g.ip, now)
+	result.IPLocked = addr.Failures == g.ip.MaxFailures
+
+	return result, nil
+}
+
+// Succeed forgets the account's failures after a successful login. IP
+// failures are kept so one valid account can't be used to reset them.
+func (g *Guard) Succeed(email string) error {
+	return g.store.Reset(AccountKey(email))
+}
+
+// AccountStatus returns the state of an account
+func (g *Guard) AccountStatus(email string) (Status, error) {
+	return g.keyStatus(AccountKey(email), g.account)
+}
+
+// IPStatus returns the state of a client IP
+func (g *Guard) IPStatus(ip string) (Status, error) {
+	return g.keyStatus(IPKey(ip), g.ip)
+}
+
+// UnlockAccount clears an account's failures and lockout
+func (g *Guard) UnlockAccount(email string) error {
+	return g.store.Reset(AccountKey(email))
+}
+
+// UnlockIP clears a client IP's failures and lockout
+func (g *Guard) UnlockIP(ip string) error {
+	return g.store.Reset(IPKey(ip))
+}
+
+func (g *Guard) keyStatus(key string, policy Policy) (Status, error) {
+	record, err := g.store.Get(key)
+	if err != nil {
+		return Status{}, err
+	}
+	return g.status(record, policy, g.now()), nil
+}
+
+func (g *Guard) status(record Record, policy Policy, now time.Time) Status {
+	status := Status{Failures: record.Failures}
+	if until := policy.BlockedUntil(record); until.After(now) {
+		status.BlockedUntil = until
+		status.Locked = record.Failures >= policy.MaxFailures
+	}
+	if now.Sub(record.LastFailureAt) > policy.Lockout {
+		status.Failures = 0
+	}
+	return status
+}
+
+// Logins guards the login endpoints. It is set by Init.
+var Logins *Guard
+
+// Init sets up Logins from the environment:
+//
+//	LOGIN_LOCKOUT_STORE    memory (default) or database
+//	LOGIN_MAX_FAILURES     failures before an account is locked (default 5)
+//	LOGIN_LOCKOUT_MINUTES  lockout duration (default 15)
+//	LOGIN_IP_MAX_FAILURES  failures before a client IP is locked (default 50)
+//
+// The database store must be used when several server instances share a
+// database; it requires database.InitDB to have run.
+func Init() error {
+	var store Store
+	switch backend := os.Getenv("LOGIN_LOCKOUT_STORE"); backend {
+	case "", "memory":
+		store = NewMemoryStore()
+	case "database":
+		store = NewDBStore()
+	default:
+		return errors.New("unknown LOGIN_LOCKOUT_STORE: " + backend)
+	}
+
+	lockoutDuration := time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+	account := Policy{
+		MaxFailures: envInt("LOGIN_MAX_FAILURES", 5),
+		Lockout:     lockoutDuration,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+	}
+	ip := Policy{
+		MaxFailures: envInt("LOGIN_IP_MAX_FAILURES", 50),
+		Lockout:     lockoutDuration,
+	}
+
+	Logins = NewGuard(store, account, ip)
+	return nil
+}
+
+func envInt(name string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,145 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"license-mnm/database/dbtest"
+)
+
+var t0 = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestBlockedUntil(t *testing.T) {
+	policy := Policy{MaxFailures: 5, Lockout: 15 * time.Minute, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	tests := []struct {
+		name     string
+		policy   Policy
+		failures int
+		want     time.Duration // after the last failure; -1 for no wait
+	}{
+		{"no failures", policy, 0, -1},
+		{"first failure", policy, 1, time.Second},
+		{"second failure doubles", policy, 2, 2 * time.Second},
+		{"third failure doubles again", policy, 3, 4 * time.Second},
+		{"capped at max delay", policy, 4, 5 * time.Second},
+		{"locked out at max failures", policy, 5, 15 * time.Minute},
+		{"still locked out beyond", policy, 9, 15 * time.Minute},
+		{"no backoff without a base delay", Policy{MaxFailures: 5, Lockout: time.Minute}, 3, -1},
+		{"huge failure count doesn't overflow", Policy{MaxFailures: 1000, Lockout: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute}, 100, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.BlockedUntil(Record{Failures: tt.failures, LastFailureAt: t0})
+			want := time.Time{}
+			if tt.want >= 0 {
+				want = t0.Add(tt.want)
+			}
+			if !got.Equal(want) {
+				t.Errorf("BlockedUntil() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// stores returns a fresh store of each kind
+func stores(t *testing.T) map[string]Store {
+	dbtest.Open(t)
+	return map[string]Store{"memory": NewMemoryStore(), "database": NewDBStore()}
+}
+
+func TestGuard(t *testing.T) {
+	account := Policy{MaxFailures: 3, Lockout: 15 * time.Minute, BaseDelay: time.Second, MaxDelay: time.Minute}
+	ip := Policy{MaxFailures: 5, Lockout: 15 * time.Minute}
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := t0
+			guard := NewGuard(store, account, ip)
+			guard.now = func() time.Time { return now }
+			wait := func(email, addr string) time.Duration {
+				t.Helper()
+				d, err := guard.Check(email, addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return d
+			}
+			fail := func(email, addr string) Result {
+				t.Helper()
+				result, err := guard.Fail(email, addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return result
+			}
+
+			if d := wait("a@example.com", "192.0.2.1"); d != 0 {
+				t.Fatalf("fresh account waits %v", d)
+			}
+			fail("a@example.com", "192.0.2.1")
+			if d := wait("A@Example.com ", "192.0.2.1"); d != time.Second {
+				t.Errorf("after one failure: wait %v, want 1s", d)
+			}
+			now = now.Add(time.Second)
+			fail("a@example.com", "192.0.2.1")
+			if d := wait("a@example.com", "192.0.2.1"); d != 2*time.Second {
+				t.Errorf("after two failures: wait %v, want 2s", d)
+			}
+			now = now.Add(2 * time.Second)
+			if result := fail("a@example.com", "192.0.2.1"); !result.AccountLocked || !result.Account.Locked || result.IPLocked {
+				t.Errorf("third failure: %+v, want the account locked", result)
+			}
+			if d := wait("a@example.com", "198.51.100.1"); d != 15*time.Minute {
+				t.Errorf("locked account from another IP: wait %v, want 15m", d)
+			}
+
+			// The lockout and the failures expire together
+			now = now.Add(15*time.Minute + time.Second)
+			if d := wait("a@example.com", "192.0.2.1"); d != 0 {
+				t.Errorf("after the lockout: wait %v", d)
+			}
+			if result := fail("a@example.com", "192.0.2.1"); result.Account.Failures != 1 {
+				t.Errorf("failure after the window: %d failures, want 1", result.Account.Failures)
+			}
+
+			// Success and unlocking clear the account but not the IP
+			if err := guard.Succeed("a@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if status, _ := guard.AccountStatus("a@example.com"); status.Failures != 0 {
+				t.Errorf("after success: %+v", status)
+			}
+			if status, _ := guard.IPStatus("192.0.2.1"); status.Failures != 1 {
+				t.Errorf("IP after success: %d failures, want 1", status.Failures)
+			}
+
+			// Failures across many accounts lock the IP
+			var last Result
+			for i := 0; i < ip.MaxFailures-1; i++ {
+				last = fail(string(rune('b'+i))+"@example.com", "192.0.2.1")
+			}
+			if !last.IPLocked || last.AccountLocked {
+				t.Errorf("spread failures: %+v, want only the IP locked", last)
+			}
+			if d := wait("z@example.com", "192.0.2.1"); d != 15*time.Minute {
+				t.Errorf("locked IP: wait %v, want 15m", d)
+			}
+			if err := guard.UnlockIP("192.0.2.1"); err != nil {
+				t.Fatal(err)
+			}
+			if d := wait("z@example.com", "192.0.2.1"); d != 0 {
+				t.Errorf("unlocked IP: wait %v", d)
+			}
+
+			for i := 0; i < account.MaxFailures; i++ {
+				fail("c@example.com", "203.0.113.1")
+			}
+			if err := guard.UnlockAccount("c@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if status, _ := guard.AccountStatus("c@example.com"); status.Locked || status.Failures != 0 {
+				t.Errorf("unlocked account: %+v", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// maxMemoryEntries bounds the memory store; beyond it, stale entries are pruned
+const maxMemoryEntries = 10000
+
+// MemoryStore keeps failure records in process memory. Records are lost on
+// restart and are not shared between server instances.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+// Get returns the record for key
+func (s *MemoryStore) Get(key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[key], nil
+}
+
+// RecordFailure adds a failure for key
+func (s *MemoryStore) RecordFailure(key string, now time.Time, window time.Duration) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.records) >= maxMemoryEntries {
+		for k, record := range s.records {
+			if now.Sub(record.LastFailureAt) > window {
+				delete(s.records, k)
+			}
+		}
+	}
+
+	record := s.records[key]
+	if now.Sub(record.LastFailureAt) > window {
+		record.Failures = 0
+	}
+	record.Failures++
+	record.LastFailureAt = now
+	s.records[key] = record
+	return record, nil
+}
+
+// Reset forgets all failures for key
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
@@ -0,0 +1,69 @@
+// Package logging sets up structured logging with log/slog and builds
+// loggers that carry the fields of the request being served.
+package logging
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+
+	"license-mnm/tracing"
+	"license-mnm/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Init installs the default slog logger, which the log package also writes
+// through, so every log line is structured.
+//
+//	LOG_FORMAT  json (default) or text
+//	LOG_LEVEL   debug, info (default), warn or error
+func Init() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "text") {
+		handler = slog.NewTextHandler(os.Stdout, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// FromContext returns the default logger with the request and trace IDs and
+// whatever is known about the caller: user ID and role, API key prefix or
+// OAuth client
+func FromContext(c *gin.Context) *slog.Logger {
+	logger := slog.Default()
+	if c == nil {
+		return logger
+	}
+
+	var attrs []any
+	if requestID := c.GetString("request_id"); requestID != "" {
+		attrs = append(attrs, "request_id", requestID)
+	}
+	if traceID := tracing.TraceID(c.Request.Context()); traceID != "" {
+		attrs = append(attrs, "trace_id", traceID)
+	}
+	if userID, exists := c.Get("user_id"); exists {
+		attrs = append(attrs, "user_id", userID)
+	}
+	if role := c.GetString("role"); role != "" {
+		attrs = append(attrs, "role", role)
+	}
+	if apiKey := c.GetString("api_key"); apiKey != "" {
+		attrs = append(attrs, "api_key_prefix", utils.APIKeyPrefix(apiKey))
+	}
+	if clientID := c.GetString("oauth_client_id"); clientID != "" {
+		attrs = append(attrs, "oauth_client_id", clientID)
+	}
+	if len(attrs) == 0 {
+		return logger
+	}
+	return logger.With(attrs...)
+}
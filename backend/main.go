@@ -1,91 +1,384 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"license-mnm/database"
 	"license-mnm/handlers"
+	"license-mnm/jobs"
+	"license-mnm/lockout"
+	"license-mnm/logging"
+	"license-mnm/metrics"
 	"license-mnm/middleware"
+	"license-mnm/rbac"
+	"license-mnm/sso"
+	"license-mnm/tracing"
+	"license-mnm/trash"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	// Initialize structured logging before anything logs
+	logging.Init()
+
+	// Initialize tracing (spans are exported only when OTEL_TRACES_EXPORTER is set)
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		fatal("Failed to initialize tracing", err)
+	}
+
 	// Initialize database
 	if err := database.InitDB(); err != nil {
-		panic("Failed to connect to database: " + err.Error())
+		fatal("Failed to connect to database", err)
+	}
+
+	// Fail jobs a previous process left unfinished
+	if err := jobs.Init(); err != nil {
+		fatal("Failed to initialize background jobs", err)
 	}
 
-	// Create Gin router
-	r := gin.Default()
+	// Purge deleted customers and packs once they have been in the trash
+	// longer than TRASH_RETENTION (0 keeps them until purged by hand)
+	trash.Start(envDuration("TRASH_RETENTION", 30*24*time.Hour))
+
+	// Initialize single sign-on (no-op unless OIDC_ISSUER_URL is set)
+	if err := sso.Init(); err != nil {
+		fatal("Failed to initialize single sign-on", err)
+	}
+
+	// Initialize failed-login tracking
+	if err := lockout.Init(); err != nil {
+		fatal("Failed to initialize login lockout", err)
+	}
+
+	// Register Prometheus metrics
+	if err := metrics.Init(database.DB); err != nil {
+		fatal("Failed to initialize metrics", err)
+	}
+
+	// Create Gin router; requests are logged as JSON with their request ID
+	r := gin.New()
+	// X-Forwarded-For is only believed from TRUSTED_PROXIES; otherwise the
+	// client IP behind login lockout, rate limits and audit entries is the
+	// connection's peer address, which clients can't spoof
+	if err := r.SetTrustedProxies(envList("TRUSTED_PROXIES")); err != nil {
+		fatal("Invalid TRUSTED_PROXIES", err)
+	}
+	r.Use(middleware.RequestID())
+	r.Use(middleware.RequestLogger())
+	r.Use(middleware.Metrics())
+	r.Use(middleware.Tracing())
+	// Errors carry stable codes; ERROR_FORMAT=problem sends RFC 7807 documents
+	r.Use(middleware.Errors(os.Getenv("ERROR_FORMAT") == "problem"))
+	r.Use(middleware.Recovery())
 
 	// CORS middleware
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "X-API-Key"}
+	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "X-API-Key", "X-Request-ID", "Idempotency-Key", "If-Match", "Traceparent", "Tracestate"}
+	config.ExposeHeaders = []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID", "X-Trace-ID", "Idempotent-Replayed", "ETag"}
 	r.Use(cors.New(config))
 
+	// Liveness and readiness probes (no auth, no rate limit)
+	r.GET("/healthz", handlers.Healthz)
+	r.GET("/readyz", handlers.Readyz)
+
 	// Public authentication endpoints (no auth required)
 	api := r.Group("/api")
+	api.Use(middleware.RateLimit(middleware.RateLimitConfig{
+		Limit: middleware.RateLimitFromEnv("RATE_LIMIT_PUBLIC", 30),
+		Key:   middleware.KeyByIP,
+	}))
 	{
 		api.POST("/admin/login", handlers.AdminLogin)
+		api.POST("/admin/password-setup", handlers.SetupAdminPassword)
 		api.POST("/customer/login", handlers.CustomerLogin)
 		api.POST("/customer/signup", handlers.CustomerSignup)
+		api.POST("/customer/password-setup", handlers.SetupCustomerPassword)
+		api.POST("/customer/invitations/accept", handlers.AcceptInvitation)
+		api.POST("/auth/mfa/verify", handlers.VerifyMFALogin)
+		api.POST("/auth/mfa/enroll", handlers.EnrollMFALogin)
+		api.GET("/auth/oidc/:client/login", handlers.SSOLogin)
+		api.GET("/auth/oidc/callback", handlers.SSOCallback)
 	}
 
-	// Protected admin endpoints (JWT + Admin role required)
+	// Mutating requests with an Idempotency-Key header replay their first response
+	idempotencyTTL := envDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+
+	// Protected admin endpoints (JWT + staff role required, plus a permission per route)
 	adminV1 := r.Group("/api/v1/admin")
 	adminV1.Use(middleware.AuthMiddleware())
-	adminV1.Use(middleware.AdminOnly())
+	adminV1.Use(middleware.StaffOnly())
+	adminV1.Use(middleware.RateLimit(middleware.RateLimitConfig{
+		Limit: middleware.RateLimitFromEnv("RATE_LIMIT_ADMIN", 600),
+		Key:   middleware.KeyByUser,
+	}))
+	// Routes whose response carries a one-time secret aren't replayable,
+	// since that would store the secret; they refuse Idempotency-Key instead
+	adminSecrets := adminV1.Group("", middleware.RejectIdempotencyKey())
 	{
-		adminV1.GET("/dashboard", handlers.GetDashboard)
-		adminV1.GET("/customers", handlers.ListCustomers)
-		adminV1.POST("/customers", handlers.CreateCustomer)
-		adminV1.GET("/customers/:customer_id", handlers.GetCustomer)
-		adminV1.PUT("/customers/:customer_id", handlers.UpdateCustomer)
-		adminV1.DELETE("/customers/:customer_id", handlers.DeleteCustomer)
-		adminV1.GET("/subscription-packs", handlers.ListSubscriptionPacks)
-		adminV1.POST("/subscription-packs", handlers.CreateSubscriptionPack)
-		adminV1.PUT("/subscription-packs/:pack_id", handlers.UpdateSubscriptionPack)
-		adminV1.DELETE("/subscription-packs/:pack_id", handlers.DeleteSubscriptionPack)
-		adminV1.GET("/subscriptions", handlers.ListSubscriptions)
-		adminV1.POST("/subscriptions/:subscription_id/approve", handlers.ApproveSubscription)
-		adminV1.POST("/customers/:customer_id/assign-subscription", handlers.AssignSubscription)
-		adminV1.DELETE("/customers/:customer_id/subscription/:subscription_id", handlers.UnassignSubscription)
+		adminSecrets.POST("/mfa/enroll", handlers.EnrollMFA)
+		adminSecrets.POST("/mfa/recovery-codes", handlers.RegenerateRecoveryCodes)
+		adminSecrets.POST("/customers", middleware.RequirePermission(rbac.CustomersWrite), handlers.CreateCustomer)
+		adminSecrets.POST("/customers/:customer_id/invitations", middleware.RequirePermission(rbac.CustomersWrite), handlers.InviteCustomerMember)
+		adminSecrets.POST("/admins", middleware.RequirePermission(rbac.AdminsWrite), handlers.CreateAdmin)
+		adminSecrets.POST("/admins/:user_id/invitation", middleware.RequirePermission(rbac.AdminsWrite), handlers.ResendAdminInvitation)
+	}
+	adminV1.Use(middleware.Idempotency(idempotencyTTL))
+	{
+		adminV1.GET("/mfa", handlers.GetMFAStatus)
+		adminV1.POST("/mfa/confirm", handlers.ConfirmMFA)
+		adminV1.DELETE("/mfa", handlers.DisableMFA)
+		adminV1.GET("/dashboard", middleware.RequirePermission(rbac.DashboardRead), handlers.GetDashboard)
+		adminV1.GET("/customers", middleware.RequirePermission(rbac.CustomersRead), handlers.ListCustomers)
+		adminV1.POST("/customers/import", middleware.RequirePermission(rbac.CustomersWrite), handlers.ImportCustomers)
+		adminV1.GET("/customers/export", middleware.RequirePermission(rbac.CustomersRead), middleware.RequirePermission(rbac.SubscriptionsRead), handlers.ExportCustomers)
+		adminV1.GET("/customers/:customer_id", middleware.RequirePermission(rbac.CustomersRead), handlers.GetCustomer)
+		adminV1.PUT("/customers/:customer_id", middleware.RequirePermission(rbac.CustomersWrite), handlers.UpdateCustomer)
+		adminV1.PATCH("/customers/:customer_id", middleware.RequirePermission(rbac.CustomersWrite), handlers.PatchCustomer)
+		adminV1.DELETE("/customers/:customer_id", middleware.RequirePermission(rbac.CustomersWrite), handlers.DeleteCustomer)
+		adminV1.POST("/customers/:customer_id/restore", middleware.RequirePermission(rbac.CustomersWrite), handlers.RestoreCustomer)
+		adminV1.GET("/customers/:customer_id/personal-data", middleware.RequirePermission(rbac.CustomersRead), middleware.RequirePermission(rbac.SubscriptionsRead), handlers.ExportCustomerPersonalData)
+		adminV1.POST("/customers/:customer_id/erase", middleware.RequirePermission(rbac.CustomersWrite), handlers.EraseCustomer)
+		adminV1.GET("/customers/:customer_id/members", middleware.RequirePermission(rbac.CustomersRead), handlers.ListCustomerMembers)
+		adminV1.DELETE("/customers/:customer_id/members/:user_id", middleware.RequirePermission(rbac.CustomersWrite), handlers.RemoveCustomerMember)
+		adminV1.DELETE("/customers/:customer_id/members/:user_id/mfa", middleware.RequirePermission(rbac.CustomersWrite), handlers.ResetCustomerMemberMFA)
+		adminV1.GET("/subscription-packs", middleware.RequirePermission(rbac.PacksRead), handlers.ListSubscriptionPacks)
+		adminV1.POST("/subscription-packs", middleware.RequirePermission(rbac.PacksWrite), handlers.CreateSubscriptionPack)
+		adminV1.GET("/subscription-packs/:pack_id", middleware.RequirePermission(rbac.PacksRead), handlers.GetSubscriptionPack)
+		adminV1.PUT("/subscription-packs/:pack_id", middleware.RequirePermission(rbac.PacksWrite), handlers.UpdateSubscriptionPack)
+		adminV1.PATCH("/subscription-packs/:pack_id", middleware.RequirePermission(rbac.PacksWrite), handlers.PatchSubscriptionPack)
+		adminV1.DELETE("/subscription-packs/:pack_id", middleware.RequirePermission(rbac.PacksWrite), handlers.DeleteSubscriptionPack)
+		adminV1.POST("/subscription-packs/:pack_id/restore", middleware.RequirePermission(rbac.PacksWrite), handlers.RestoreSubscriptionPack)
+		adminV1.GET("/subscription-packs/:pack_id/prices", middleware.RequirePermission(rbac.PacksRead), handlers.ListPackPrices)
+		adminV1.PUT("/subscription-packs/:pack_id/prices", middleware.RequirePermission(rbac.PacksWrite), handlers.SetPackPrice)
+		adminV1.DELETE("/subscription-packs/:pack_id/prices/:currency", middleware.RequirePermission(rbac.PacksWrite), handlers.DeletePackPrice)
+		adminV1.GET("/subscription-packs/:pack_id/price-history", middleware.RequirePermission(rbac.PacksRead), handlers.GetPackPriceHistory)
+		adminV1.GET("/subscriptions", middleware.RequirePermission(rbac.SubscriptionsRead), handlers.ListSubscriptions)
+		adminV1.POST("/subscriptions/bulk", middleware.RequirePermission(rbac.SubscriptionsWrite), handlers.BulkUpdateSubscriptions)
+		adminV1.POST("/subscriptions/:subscription_id/approve", middleware.RequirePermission(rbac.SubscriptionsWrite), handlers.ApproveSubscription)
+		adminV1.POST("/customers/:customer_id/assign-subscription", middleware.RequirePermission(rbac.SubscriptionsWrite), handlers.AssignSubscription)
+		adminV1.DELETE("/customers/:customer_id/subscription/:subscription_id", middleware.RequirePermission(rbac.SubscriptionsWrite), handlers.UnassignSubscription)
+		adminV1.GET("/coupons", middleware.RequirePermission(rbac.CouponsRead), handlers.ListCoupons)
+		adminV1.POST("/coupons", middleware.RequirePermission(rbac.CouponsWrite), handlers.CreateCoupon)
+		adminV1.GET("/coupons/:coupon_id", middleware.RequirePermission(rbac.CouponsRead), handlers.GetCoupon)
+		adminV1.PUT("/coupons/:coupon_id", middleware.RequirePermission(rbac.CouponsWrite), handlers.UpdateCoupon)
+		adminV1.DELETE("/coupons/:coupon_id", middleware.RequirePermission(rbac.CouponsWrite), handlers.DeleteCoupon)
+		adminV1.GET("/coupons/:coupon_id/redemptions", middleware.RequirePermission(rbac.CouponsRead), handlers.ListCouponRedemptions)
+		adminV1.GET("/roles", middleware.RequirePermission(rbac.AdminsRead), handlers.ListRoles)
+		adminV1.GET("/admins", middleware.RequirePermission(rbac.AdminsRead), handlers.ListAdmins)
+		adminV1.GET("/admins/:user_id", middleware.RequirePermission(rbac.AdminsRead), handlers.GetAdmin)
+		adminV1.PUT("/admins/:user_id", middleware.RequirePermission(rbac.AdminsWrite), handlers.UpdateAdmin)
+		adminV1.DELETE("/admins/:user_id", middleware.RequirePermission(rbac.AdminsWrite), handlers.DeleteAdmin)
+		adminV1.PUT("/admins/:user_id/role", middleware.RequirePermission(rbac.AdminsWrite), handlers.AssignAdminRole)
+		adminV1.POST("/admins/:user_id/disable", middleware.RequirePermission(rbac.AdminsWrite), handlers.DisableAdmin)
+		adminV1.POST("/admins/:user_id/enable", middleware.RequirePermission(rbac.AdminsWrite), handlers.EnableAdmin)
+		adminV1.DELETE("/admins/:user_id/mfa", middleware.RequirePermission(rbac.AdminsWrite), handlers.ResetAdminMFA)
+		adminV1.GET("/login-lockouts", middleware.RequirePermission(rbac.CustomersRead), handlers.GetLoginLockout)
+		adminV1.DELETE("/login-lockouts", middleware.RequirePermission(rbac.CustomersWrite), handlers.UnlockLogin)
+		adminV1.GET("/jobs/:job_id", handlers.GetJob)
+		adminV1.GET("/trash/customers", middleware.RequirePermission(rbac.CustomersRead), handlers.ListDeletedCustomers)
+		adminV1.DELETE("/trash/customers/:customer_id", middleware.RequirePermission(rbac.CustomersWrite), handlers.PurgeCustomer)
+		adminV1.GET("/trash/subscription-packs", middleware.RequirePermission(rbac.PacksRead), handlers.ListDeletedPacks)
+		adminV1.DELETE("/trash/subscription-packs/:pack_id", middleware.RequirePermission(rbac.PacksWrite), handlers.PurgeSubscriptionPack)
+		adminV1.GET("/audit-logs", middleware.RequirePermission(rbac.AuditRead), handlers.ListAuditLogs)
+		adminV1.GET("/settings/security", middleware.RequirePermission(rbac.AdminsRead), handlers.GetSecuritySettings)
+		adminV1.PUT("/settings/security", middleware.RequirePermission(rbac.AdminsWrite), handlers.UpdateSecuritySettings)
 	}
 
 	// Protected customer endpoints (JWT + Customer role required)
 	customerV1 := r.Group("/api/v1/customer")
 	customerV1.Use(middleware.AuthMiddleware())
 	customerV1.Use(middleware.CustomerOnly())
+	customerV1.Use(middleware.RateLimit(middleware.RateLimitConfig{
+		Limit: middleware.RateLimitFromEnv("RATE_LIMIT_CUSTOMER", 120),
+		Key:   middleware.KeyByUser,
+		Tier:  middleware.PackTierLimit,
+	}))
+	customerSecrets := customerV1.Group("", middleware.RejectIdempotencyKey())
+	{
+		customerSecrets.POST("/mfa/enroll", handlers.EnrollMFA)
+		customerSecrets.POST("/mfa/recovery-codes", handlers.RegenerateRecoveryCodes)
+		customerSecrets.POST("/organization/invitations", handlers.InviteMember)
+		customerSecrets.POST("/api-keys", handlers.CreateAPIKey)
+		customerSecrets.POST("/oauth-clients", handlers.CreateOAuthClient)
+		customerSecrets.POST("/oauth-clients/:client_id/rotate-secret", handlers.RotateOAuthClientSecret)
+	}
+	customerV1.Use(middleware.Idempotency(idempotencyTTL))
 	{
 		customerV1.GET("/subscription", handlers.GetCustomerSubscription)
+		customerV1.GET("/mfa", handlers.GetMFAStatus)
+		customerV1.POST("/mfa/confirm", handlers.ConfirmMFA)
+		customerV1.DELETE("/mfa", handlers.DisableMFA)
 		customerV1.POST("/subscription", handlers.RequestSubscription)
 		customerV1.DELETE("/subscription", handlers.DeactivateSubscription)
 		customerV1.GET("/subscription-history", handlers.GetSubscriptionHistory)
+		customerV1.GET("/personal-data", handlers.ExportMyPersonalData)
+		customerV1.GET("/organization", handlers.GetOrganization)
+		customerV1.GET("/organization/invitations", handlers.ListInvitations)
+		customerV1.DELETE("/organization/invitations/:invitation_id", handlers.RevokeInvitation)
+		customerV1.PUT("/organization/members/:user_id", handlers.UpdateMemberRole)
+		customerV1.DELETE("/organization/members/:user_id", handlers.RemoveMember)
+		customerV1.GET("/api-keys", handlers.ListAPIKeys)
+		customerV1.DELETE("/api-keys/:key_id", handlers.RevokeAPIKey)
+		customerV1.GET("/oauth-clients", handlers.ListOAuthClients)
+		customerV1.DELETE("/oauth-clients/:client_id", handlers.RevokeOAuthClient)
 	}
 
 	// SDK authentication (no auth required)
 	sdk := r.Group("/sdk")
+	sdk.Use(middleware.RateLimit(middleware.RateLimitConfig{
+		Limit: middleware.RateLimitFromEnv("RATE_LIMIT_PUBLIC", 30),
+		Key:   middleware.KeyByIP,
+	}))
 	{
 		sdk.POST("/auth/login", handlers.SDKLogin)
+		sdk.POST("/auth/mfa/verify", handlers.VerifyMFALogin)
+		sdk.POST("/oauth/token", handlers.OAuthToken)
 	}
 
-	// SDK protected endpoints (API Key required)
+	// SDK protected endpoints (API key or OAuth client token required)
 	sdkV1 := r.Group("/sdk/v1")
-	sdkV1.Use(middleware.APIKeyAuth())
+	// Throttle by IP before SDKAuth so guessing API keys or tokens costs
+	// requests too; the per-key limit below only applies once one is valid
+	sdkV1.Use(middleware.RateLimit(middleware.RateLimitConfig{
+		Limit: middleware.RateLimitFromEnv("RATE_LIMIT_SDK_IP", 600),
+		Key:   middleware.KeyByIP,
+	}))
+	sdkV1.Use(middleware.SDKAuth())
+	sdkV1.Use(middleware.RateLimit(middleware.RateLimitConfig{
+		Limit: middleware.RateLimitFromEnv("RATE_LIMIT_SDK", 60),
+		Key:   middleware.KeyByAPIKey,
+		Tier:  middleware.PackTierLimit,
+	}))
+	sdkV1.Use(middleware.Idempotency(idempotencyTTL))
 	{
-		sdkV1.GET("/subscription", handlers.SDKGetSubscription)
-		sdkV1.POST("/subscription", handlers.SDKRequestSubscription)
-		sdkV1.DELETE("/subscription", handlers.SDKDeactivateSubscription)
-		sdkV1.GET("/subscription-history", handlers.SDKGetSubscriptionHistory)
+		sdkV1.GET("/subscription", middleware.RequireScope(rbac.ScopeSubscriptionRead), handlers.SDKGetSubscription)
+		sdkV1.POST("/subscription", middleware.RequireScope(rbac.ScopeSubscriptionWrite), handlers.SDKRequestSubscription)
+		sdkV1.DELETE("/subscription", middleware.RequireScope(rbac.ScopeSubscriptionWrite), handlers.SDKDeactivateSubscription)
+		sdkV1.GET("/subscription-history", middleware.RequireScope(rbac.ScopeHistoryRead), handlers.SDKGetSubscriptionHistory)
+	}
+
+	// Metrics go on their own port when METRICS_ADDR is set (keep it off the
+	// public network); otherwise /metrics needs the METRICS_TOKEN bearer token
+	// and is not served at all without one
+	var metricsServer *http.Server
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metricsServer = newServer(addr, metrics.Handler())
+		go func() {
+			slog.Info("serving metrics", "addr", addr)
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("metrics server stopped", "error", err)
+			}
+		}()
+	} else if token := os.Getenv("METRICS_TOKEN"); token != "" {
+		r.GET("/metrics", middleware.MetricsAuth(token), gin.WrapH(metrics.Handler()))
 	}
 
 	// Start server
-	r.Run("0.0.0.0:8080")
+	server := newServer(envOr("HOST", "0.0.0.0")+":"+envOr("PORT", "8080"), r)
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("serving API", "addr", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Run until SIGINT/SIGTERM, then fail readiness, let in-flight requests
+	// finish and stop the background workers
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErr:
+		fatal("Server failed", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("shutting down")
+	handlers.StartDraining()
+	// Give load balancers time to see the failing readiness probe
+	time.Sleep(envDuration("SHUTDOWN_DELAY", 0))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("in-flight requests did not finish", "error", err)
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("metrics server did not stop", "error", err)
+		}
+	}
+	if err := jobs.Shutdown(shutdownCtx); err != nil {
+		slog.Error("background jobs did not stop", "error", err)
+	}
+	if err := trash.Shutdown(shutdownCtx); err != nil {
+		slog.Error("trash purge did not stop", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
+	if err := database.Close(); err != nil {
+		slog.Error("failed to close database", "error", err)
+	}
+	slog.Info("shutdown complete")
 }
 
+// newServer returns an HTTP server with timeouts, so slow or idle clients
+// can't hold connections forever
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+	}
+}
 
+// envOr returns the environment variable name, or fallback when it is unset
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
 
+// envList splits the comma-separated environment variable name, dropping
+// empty items
+func envList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
 
+// envDuration parses the environment variable name as a duration such as
+// "30s", or returns fallback when it is unset or invalid
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(name)); err == nil && value >= 0 {
+		return value
+	}
+	return fallback
+}
 
+// fatal logs a startup error and exits
+func fatal(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
+}
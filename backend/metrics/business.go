@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// SubscriptionStatuses lists the subscription lifecycle states; each is
+// reported, at zero if need be, so the series never disappear
+var SubscriptionStatuses = []string{"requested", "approved", "rejected", "active", "inactive", "expired"}
+
+// SubscriptionCounts returns the number of subscriptions in each status
+func SubscriptionCounts(db *gorm.DB) (map[string]int64, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := db.Table("subscriptions").Select("status, COUNT(*) AS count").Group("status").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(SubscriptionStatuses))
+	for _, status := range SubscriptionStatuses {
+		counts[status] = 0
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// CustomerCount returns the number of customers that aren't deleted
+func CustomerCount(db *gorm.DB) (int64, error) {
+	var count int64
+	err := db.Table("customers").Where("deleted_at IS NULL").Count(&count).Error
+	return count, err
+}
+
+var (
+	subscriptionsDesc = prometheus.NewDesc("license_subscriptions",
+		"Subscriptions by status.", []string{"status"}, nil)
+	pendingRequestsDesc = prometheus.NewDesc("license_subscription_requests_pending",
+		"Subscription requests waiting for approval.", nil, nil)
+	customersDesc = prometheus.NewDesc("license_customers",
+		"Customers, excluding deleted ones.", nil, nil)
+)
+
+// businessCollector queries the database at scrape time, so the gauges are
+// always current without the handlers having to update them
+type businessCollector struct {
+	db *gorm.DB
+}
+
+func (b *businessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- subscriptionsDesc
+	ch <- pendingRequestsDesc
+	ch <- customersDesc
+}
+
+func (b *businessCollector) Collect(ch chan<- prometheus.Metric) {
+	if counts, err := SubscriptionCounts(b.db); err != nil {
+		ch <- prometheus.NewInvalidMetric(subscriptionsDesc, err)
+	} else {
+		for status, count := range counts {
+			ch <- prometheus.MustNewConstMetric(subscriptionsDesc, prometheus.GaugeValue, float64(count), status)
+		}
+		ch <- prometheus.MustNewConstMetric(pendingRequestsDesc, prometheus.GaugeValue, float64(counts["requested"]))
+	}
+
+	if count, err := CustomerCount(b.db); err != nil {
+		ch <- prometheus.NewInvalidMetric(customersDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(customersDesc, prometheus.GaugeValue, float64(count))
+	}
+}
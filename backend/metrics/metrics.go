@@ -0,0 +1,63 @@
+// Package metrics defines the Prometheus metrics served at /metrics: HTTP
+// request latency, logins, subscription and customer counts and database
+// connection-pool stats.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// registry holds this server's metrics, so /metrics only exposes what Init registers
+var registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequestDuration observes every request by method, route pattern and status
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// Logins counts login attempts by the user's role ("unknown" when no user
+	// matched) and result: success, failure or blocked (by login lockout)
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "license_logins_total",
+		Help: "Login attempts by role and result.",
+	}, []string{"role", "result"})
+)
+
+// Init registers the metrics, reading subscription counts and pool stats from db
+func Init(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	return registerAll(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(sqlDB, "main"),
+		HTTPRequestDuration,
+		Logins,
+		&businessCollector{db: db},
+	)
+}
+
+func registerAll(cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registered metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -1,9 +1,14 @@
 package middleware
 
 import (
-	"net/http"
 	"strings"
+	"time"
 
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/logging"
+	"license-mnm/models"
+	"license-mnm/rbac"
 	"license-mnm/utils"
 
 	"github.com/gin-gonic/gin"
@@ -14,24 +19,21 @@ func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Authorization header required"})
-			c.Abort()
+			apierror.AbortCode(c, apierror.AuthenticationRequired, "Authorization header required")
 			return
 		}
 
 		// Extract token from "Bearer <token>"
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid authorization header format"})
-			c.Abort()
+			apierror.AbortCode(c, apierror.InvalidToken, "Invalid authorization header format")
 			return
 		}
 
 		token := parts[1]
 		claims, err := utils.ValidateToken(token)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid or expired token"})
-			c.Abort()
+			apierror.AbortCode(c, apierror.InvalidToken, "Invalid or expired token")
 			return
 		}
 
@@ -44,52 +46,121 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
-// AdminOnly middleware ensures only admin users can access
-func AdminOnly() gin.HandlerFunc {
+// StaffOnly middleware ensures only staff users (any admin role) can access.
+// The role is re-read from the database so role changes apply immediately.
+func StaffOnly() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		role, exists := c.Get("role")
-		if !exists || role != "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "Admin access required"})
-			c.Abort()
+		userID, _ := c.Get("user_id")
+
+		var user models.User
+		if err := database.DB.WithContext(c.Request.Context()).Select("id", "role", "disabled_at").Where("id = ?", userID).First(&user).Error; err != nil ||
+			!rbac.IsStaffRole(user.Role) || user.DisabledAt != nil {
+			apierror.AbortCode(c, apierror.Forbidden, "Admin access required")
 			return
 		}
+
+		c.Set("role", user.Role)
 		c.Next()
 	}
 }
 
-// CustomerOnly middleware ensures only customer users can access
-func CustomerOnly() gin.HandlerFunc {
+// RequirePermission middleware ensures the staff user's role grants perm.
+// It must run after StaffOnly.
+func RequirePermission(perm rbac.Permission) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		role, exists := c.Get("role")
-		if !exists || role != "customer" {
-			c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "Customer access required"})
-			c.Abort()
+		role, _ := c.Get("role")
+		roleName, _ := role.(string)
+		if !rbac.HasPermission(roleName, perm) {
+			apierror.AbortCode(c, apierror.PermissionDenied, "Missing permission: "+string(perm))
 			return
 		}
 		c.Next()
 	}
 }
 
-// APIKeyAuth middleware validates API key for SDK endpoints
-func APIKeyAuth() gin.HandlerFunc {
+// CustomerOnly middleware ensures only customer users can access
+func CustomerOnly() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		apiKey := c.GetHeader("X-API-Key")
-		if apiKey == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "X-API-Key header required"})
-			c.Abort()
+		role, exists := c.Get("role")
+		if !exists || role != "customer" {
+			apierror.AbortCode(c, apierror.Forbidden, "Customer access required")
 			return
 		}
-
-		// Validate API key in database
-		// This will be implemented in the handler
-		c.Set("api_key", apiKey)
 		c.Next()
 	}
 }
 
+// apiKeyUsedInterval limits how often a scoped key's last_used_at is written
+const apiKeyUsedInterval = time.Minute
+
+// resolveAPIKey returns the user and scopes of an API key: a scoped key
+// created by the customer, or the key SDKLogin returns, which has every scope
+func resolveAPIKey(c *gin.Context, apiKey string) (uint, string, error) {
+	var key models.APIKey
+	err := database.DB.WithContext(c.Request.Context()).Where("key_hash = ? AND revoked_at IS NULL", utils.HashToken(apiKey)).First(&key).Error
+	if err == nil {
+		now := time.Now()
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyUsedInterval {
+			if err := database.DB.WithContext(c.Request.Context()).Model(&key).Update("last_used_at", now).Error; err != nil {
+				logging.FromContext(c).Error("database error", "operation", "update api key last use", "error", err)
+			}
+		}
+		return key.UserID, key.Scopes, nil
+	}
 
+	var user models.User
+	if err := database.DB.WithContext(c.Request.Context()).Select("id").Where("api_key = ?", apiKey).First(&user).Error; err != nil {
+		return 0, "", err
+	}
+	return user.ID, strings.Join(rbac.SDKScopes, " "), nil
+}
 
+// SDKAuth middleware authenticates SDK requests by X-API-Key header or by
+// an OAuth client access token in the Authorization header, and sets the
+// granted scopes for RequireScope
+func SDKAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			userID, scopes, err := resolveAPIKey(c, apiKey)
+			if err != nil {
+				apierror.AbortCode(c, apierror.InvalidAPIKey, "Invalid API key")
+				return
+			}
+
+			c.Set("api_key", apiKey)
+			c.Set("user_id", userID)
+			c.Set("scope", scopes)
+			c.Next()
+			return
+		}
 
+		tokenString, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || tokenString == "" {
+			apierror.AbortCode(c, apierror.AuthenticationRequired, "X-API-Key header or bearer token required")
+			return
+		}
 
+		claims, err := utils.ValidateClientToken(tokenString)
+		if err != nil {
+			apierror.AbortCode(c, apierror.InvalidToken, "Invalid or expired token")
+			return
+		}
 
+		c.Set("oauth_client_id", claims.Subject)
+		c.Set("customer_id", claims.CustomerID)
+		c.Set("scope", claims.Scope)
+		c.Next()
+	}
+}
 
+// RequireScope middleware rejects SDK credentials not granted scope. It must
+// run after SDKAuth.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !rbac.HasScope(c.GetString("scope"), scope) {
+			apierror.AbortCode(c, apierror.InsufficientScope, "Credentials lack the "+scope+" scope")
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"errors"
+
+	"license-mnm/apierror"
+	"license-mnm/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Errors middleware renders the error a handler or middleware recorded with
+// apierror.Abort, so every error response has the same shape. Errors that
+// aren't *apierror.Error are logged and sent as INTERNAL_ERROR. With problem
+// set, or when the client accepts application/problem+json, errors are sent
+// as RFC 7807 problem documents.
+func Errors(problem bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(problemFormatKey, problem)
+		c.Next()
+		renderError(c)
+	}
+}
+
+// problemFormatKey holds Errors' problem setting for renderError
+const problemFormatKey = "error_format_problem"
+
+// renderError writes the last recorded error, unless there is none or a
+// response was already written. Middleware that needs the error response
+// itself, like Idempotency, calls it before Errors does.
+func renderError(c *gin.Context) {
+	if len(c.Errors) == 0 || c.Writer.Written() {
+		return
+	}
+
+	var apiErr *apierror.Error
+	if err := c.Errors.Last().Err; !errors.As(err, &apiErr) {
+		logging.FromContext(c).Error("unhandled error", "error", err)
+		apiErr = apierror.New(apierror.Internal, "Internal server error")
+	}
+	apierror.Render(c, apiErr, c.GetBool(problemFormatKey) || apierror.WantsProblem(c))
+}
@@ -0,0 +1,204 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/logging"
+	"license-mnm/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// IdempotencyKeyHeader lets a client retry a mutating request without
+// running it twice
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds the keys clients may send
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBodyBytes bounds the request bodies Idempotency reads to hash;
+// no route accepts more (customer imports are limited to the same)
+const maxIdempotentBodyBytes = 10 << 20
+
+// idempotentMethods are the methods Idempotency applies to
+var idempotentMethods = map[string]bool{
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// Idempotency middleware makes mutating requests sent with an Idempotency-Key
+// header safe to retry. The first response for a key is stored per caller for
+// ttl and replayed, with Idempotent-Replayed: true, for later requests with
+// the same key. Reusing a key for a different method, path, query or body is
+// rejected with 422, and retrying while the first request still runs with
+// 409. Server errors aren't stored, so a retry runs the request again.
+// It must run after AuthMiddleware or SDKAuth.
+func Idempotency(ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" || !idempotentMethods[c.Request.Method] {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			apierror.AbortCode(c, apierror.IdempotencyKeyInvalid, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBodyBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apierror.AbortCode(c, apierror.PayloadTooLarge, fmt.Sprintf("Request bodies are limited to %d MB", maxIdempotentBodyBytes>>20))
+			return
+		}
+		if err != nil {
+			apierror.AbortCode(c, apierror.ValidationFailed, "Request body could not be read")
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s?%s\n", c.Request.Method, c.Request.URL.Path, c.Request.URL.RawQuery)
+		hash.Write(body)
+
+		db := database.DB.WithContext(c.Request.Context())
+		record := models.IdempotencyKey{
+			Caller:      idempotencyCaller(c),
+			Key:         key,
+			RequestHash: hex.EncodeToString(hash.Sum(nil)),
+			ExpiresAt:   time.Now().Add(ttl),
+		}
+		existing, err := claimIdempotencyKey(db, &record)
+		if err != nil {
+			logging.FromContext(c).Error("database error", "operation", "claim idempotency key", "error", err)
+			apierror.AbortCode(c, apierror.Internal, "Failed to check Idempotency-Key")
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				apierror.AbortCode(c, apierror.IdempotencyKeyReused, "Idempotency-Key was already used for a different request")
+			case existing.StatusCode == 0:
+				apierror.AbortCode(c, apierror.IdempotencyKeyInProgress, "A request with this Idempotency-Key is still in progress")
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.StatusCode, existing.ContentType, existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		// Release the key if the request panics or fails, so it can be retried
+		completed := false
+		defer func() {
+			if !completed {
+				if err := db.Delete(&record).Error; err != nil {
+					logging.FromContext(c).Error("database error", "operation", "release idempotency key", "error", err)
+				}
+			}
+		}()
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		// Errors renders after this middleware returns; store the error response too
+		renderError(c)
+
+		if writer.Status() >= http.StatusInternalServerError {
+			return
+		}
+		err = db.Model(&record).Updates(models.IdempotencyKey{
+			StatusCode:  writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+		}).Error
+		if err != nil {
+			logging.FromContext(c).Error("database error", "operation", "store idempotent response", "error", err)
+			return
+		}
+		completed = true
+	}
+}
+
+// RejectIdempotencyKey refuses requests with an Idempotency-Key header on
+// routes that respond with a secret shown only once, such as an API key or
+// setup token. Idempotency would store the secret to replay it, so those
+// routes don't use it, and clients learn the key isn't honored.
+func RejectIdempotencyKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader(IdempotencyKeyHeader) != "" && idempotentMethods[c.Request.Method] {
+			apierror.AbortCode(c, apierror.IdempotencyKeyInvalid, "Idempotency-Key is not supported here because the response carries a one-time secret")
+			return
+		}
+		c.Next()
+	}
+}
+
+// idempotencyCaller identifies whose keys a request's key is compared with
+func idempotencyCaller(c *gin.Context) string {
+	if clientID, exists := c.Get("oauth_client_id"); exists {
+		return fmt.Sprintf("client:%v", clientID)
+	}
+	userID, _ := c.Get("user_id")
+	return fmt.Sprintf("user:%v", userID)
+}
+
+// claimIdempotencyKey inserts record, marking its key as in progress. When the
+// caller already used the key it returns that record instead; an expired one
+// is deleted and the key claimed again.
+func claimIdempotencyKey(db *gorm.DB, record *models.IdempotencyKey) (*models.IdempotencyKey, error) {
+	for {
+		err := db.Create(record).Error
+		if err == nil {
+			// Keep the table small; expired keys would be replaced anyway
+			return nil, db.Where("expires_at < ?", time.Now()).Delete(&models.IdempotencyKey{}).Error
+		}
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, err
+		}
+
+		var existing models.IdempotencyKey
+		err = db.Where(&models.IdempotencyKey{Caller: record.Caller, Key: record.Key}).First(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue // deleted since the insert failed
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().Before(existing.ExpiresAt) {
+			return &existing, nil
+		}
+		if err := db.Delete(&existing).Error; err != nil {
+			return nil, err
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"license-mnm/apierror"
+	"license-mnm/database/dbtest"
+	"license-mnm/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyRouter serves a handler counting its calls behind Idempotency.
+// The caller is the user in the X-Test-User header.
+func idempotencyRouter(ttl time.Duration, handler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Errors(false))
+	r.Use(func(c *gin.Context) { c.Set("user_id", c.GetHeader("X-Test-User")) })
+	r.Use(Idempotency(ttl))
+	r.Any("/things", handler)
+	return r
+}
+
+func idempotentRequest(r *gin.Engine, method, target, user, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("X-Test-User", user)
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyReplayAndConflict(t *testing.T) {
+	dbtest.Open(t)
+	var calls atomic.Int64
+	r := idempotencyRouter(time.Hour, func(c *gin.Context) {
+		if c.Query("invalid") != "" {
+			apierror.AbortCode(c, apierror.ValidationFailed, "invalid")
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"call": calls.Add(1)})
+	})
+
+	// Requests run in order against the same store
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		user         string
+		key          string
+		body         string
+		wantStatus   int
+		wantReplayed bool
+		wantCalls    int64
+	}{
+		{"first use runs", http.MethodPost, "/things?a=1", "1", "k1", `{"n":1}`, http.StatusCreated, false, 1},
+		{"retry is replayed", http.MethodPost, "/things?a=1", "1", "k1", `{"n":1}`, http.StatusCreated, true, 1},
+		{"different query", http.MethodPost, "/things?a=2", "1", "k1", `{"n":1}`, http.StatusUnprocessableEntity, false, 1},
+		{"query added", http.MethodPost, "/things?a=1&b=2", "1", "k1", `{"n":1}`, http.StatusUnprocessableEntity, false, 1},
+		{"different body", http.MethodPost, "/things?a=1", "1", "k1", `{"n":2}`, http.StatusUnprocessableEntity, false, 1},
+		{"different method", http.MethodPut, "/things?a=1", "1", "k1", `{"n":1}`, http.StatusUnprocessableEntity, false, 1},
+		{"same key of another caller", http.MethodPost, "/things?a=1", "2", "k1", `{"n":1}`, http.StatusCreated, false, 2},
+		{"new key", http.MethodPost, "/things?a=1", "1", "k2", `{"n":1}`, http.StatusCreated, false, 3},
+		{"no key runs every time", http.MethodPost, "/things?a=1", "1", "", `{"n":1}`, http.StatusCreated, false, 4},
+		{"safe methods ignore the key", http.MethodGet, "/things?a=1", "1", "k1", "", http.StatusCreated, false, 5},
+		{"client errors are stored", http.MethodPost, "/things?invalid=1", "1", "k3", "", http.StatusBadRequest, false, 5},
+		{"client errors are replayed", http.MethodPost, "/things?invalid=1", "1", "k3", "", http.StatusBadRequest, true, 5},
+		{"overlong key", http.MethodPost, "/things", "1", strings.Repeat("k", 256), "", http.StatusBadRequest, false, 5},
+		{"body over the limit", http.MethodPost, "/things", "1", "k4", strings.Repeat("x", maxIdempotentBodyBytes+1), http.StatusRequestEntityTooLarge, false, 5},
+	}
+	var first string
+	for _, tt := range tests {
+		w := idempotentRequest(r, tt.method, tt.target, tt.user, tt.key, tt.body)
+		replayed := w.Header().Get("Idempotent-Replayed") == "true"
+		if w.Code != tt.wantStatus || replayed != tt.wantReplayed || calls.Load() != tt.wantCalls {
+			t.Fatalf("%s: got %d, replayed %v, %d calls; want %d, %v, %d (%s)",
+				tt.name, w.Code, replayed, calls.Load(), tt.wantStatus, tt.wantReplayed, tt.wantCalls, w.Body)
+		}
+		switch tt.name {
+		case "first use runs":
+			first = w.Body.String()
+		case "retry is replayed":
+			if w.Body.String() != first {
+				t.Errorf("replayed body %s, want %s", w.Body, first)
+			}
+		}
+		if tt.wantStatus == http.StatusUnprocessableEntity && !strings.Contains(w.Body.String(), string(apierror.IdempotencyKeyReused)) {
+			t.Errorf("%s: body %s, want %s", tt.name, w.Body, apierror.IdempotencyKeyReused)
+		}
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	dbtest.Open(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	r := idempotencyRouter(time.Hour, func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusNoContent)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- idempotentRequest(r, http.MethodPost, "/things", "1", "slow", "") }()
+	<-started
+
+	w := idempotentRequest(r, http.MethodPost, "/things", "1", "slow", "")
+	var body struct{ Code string }
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusConflict || body.Code != string(apierror.IdempotencyKeyInProgress) {
+		t.Errorf("retry while running: got %d %s", w.Code, w.Body)
+	}
+
+	close(release)
+	if w := <-done; w.Code != http.StatusNoContent {
+		t.Errorf("first request: got %d", w.Code)
+	}
+	if w := idempotentRequest(r, http.MethodPost, "/things", "1", "slow", ""); w.Code != http.StatusNoContent || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry after completion: got %d, replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotencyReleasesKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		handler func(c *gin.Context, call int64)
+	}{
+		{"server error", time.Hour, func(c *gin.Context, call int64) {
+			if call == 1 {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.Status(http.StatusOK)
+		}},
+		{"panic", time.Hour, func(c *gin.Context, call int64) {
+			if call == 1 {
+				panic("boom")
+			}
+			c.Status(http.StatusOK)
+		}},
+		{"expired key", -time.Second, func(c *gin.Context, call int64) {
+			c.Status(http.StatusOK)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbtest.Open(t)
+			var calls atomic.Int64
+			r := idempotencyRouter(tt.ttl, func(c *gin.Context) { tt.handler(c, calls.Add(1)) })
+
+			func() {
+				defer func() { recover() }()
+				idempotentRequest(r, http.MethodPost, "/things", "1", "retry", "")
+			}()
+			w := idempotentRequest(r, http.MethodPost, "/things", "1", "retry", "")
+			if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" || calls.Load() != 2 {
+				t.Errorf("retry: got %d, replayed %q, %d calls; want a second run", w.Code, w.Header().Get("Idempotent-Replayed"), calls.Load())
+			}
+		})
+	}
+}
+
+func TestRejectIdempotencyKey(t *testing.T) {
+	db := dbtest.Open(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Errors(false))
+	r.Use(func(c *gin.Context) { c.Set("user_id", c.GetHeader("X-Test-User")) })
+	// As in main: the group is created before Idempotency is added
+	secrets := r.Group("", RejectIdempotencyKey())
+	secrets.Any("/secrets", func(c *gin.Context) {
+		c.JSON(http.StatusCreated, gin.H{"api_key": "sk-secret"})
+	})
+	r.Use(Idempotency(time.Hour))
+	r.POST("/things", func(c *gin.Context) { c.Status(http.StatusCreated) })
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		key        string
+		wantStatus int
+		wantStored int64
+	}{
+		{"secret without a key", http.MethodPost, "/secrets", "", http.StatusCreated, 0},
+		{"secret with a key", http.MethodPost, "/secrets", "k1", http.StatusBadRequest, 0},
+		{"safe request with a key", http.MethodGet, "/secrets", "k1", http.StatusCreated, 0},
+		{"other routes keep Idempotency", http.MethodPost, "/things", "k1", http.StatusCreated, 1},
+	}
+	for _, tt := range tests {
+		w := idempotentRequest(r, tt.method, tt.target, "1", tt.key, "")
+		var stored int64
+		db.Model(&models.IdempotencyKey{}).Count(&stored)
+		if w.Code != tt.wantStatus || stored != tt.wantStored {
+			t.Errorf("%s: got %d %s, %d keys stored; want %d, %d", tt.name, w.Code, w.Body, stored, tt.wantStatus, tt.wantStored)
+		}
+		if tt.wantStatus == http.StatusBadRequest && !strings.Contains(w.Body.String(), string(apierror.IdempotencyKeyInvalid)) {
+			t.Errorf("%s: body %s, want %s", tt.name, w.Body, apierror.IdempotencyKeyInvalid)
+		}
+	}
+}
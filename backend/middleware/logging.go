@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"license-mnm/apierror"
+	"license-mnm/logging"
+	"license-mnm/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the ID that correlates a request's log lines
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits the IDs accepted from clients to safe log values
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID middleware takes the request ID from the X-Request-ID header, or
+// generates one, and returns it in the response
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			token, err := utils.GenerateRandomToken()
+			if err != nil {
+				token = time.Now().Format("20060102150405.000000000")
+			}
+			requestID = token[:32]
+		}
+
+		c.Set("request_id", requestID)
+		c.Header(RequestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// probePaths are the health probe endpoints
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+// RequestLogger middleware logs one line per request with its outcome and
+// the caller's fields (see logging.FromContext). The query string is left
+// out because it may hold tokens. It must run after RequestID.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case probePaths[c.Request.URL.Path]:
+			// Probes arrive every few seconds; only failing ones are worth reading
+			level = slog.LevelDebug
+			if status >= http.StatusBadRequest {
+				level = slog.LevelWarn
+			}
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		}
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+			"bytes", c.Writer.Size(),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+		logging.FromContext(c).Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Recovery middleware turns a panic into an INTERNAL_ERROR response and logs
+// it with the stack trace. It must run inside Errors, which renders the response.
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				logging.FromContext(c).Error("panic recovered", "error", err, "stack", string(debug.Stack()))
+				apierror.AbortCode(c, apierror.Internal, "Internal server error")
+			}
+		}()
+		c.Next()
+	}
+}
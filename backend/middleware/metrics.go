@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"time"
+
+	"license-mnm/apierror"
+	"license-mnm/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics middleware records each request's latency by route pattern, so
+// path parameters don't create a series per ID
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.HTTPRequestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsAuth middleware requires Authorization: Bearer <token>, the static
+// token a Prometheus scrape config sends
+func MetricsAuth(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			apierror.AbortCode(c, apierror.InvalidToken, "Invalid metrics token")
+			return
+		}
+		c.Next()
+	}
+}
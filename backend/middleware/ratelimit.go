@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"license-mnm/apierror"
+	"license-mnm/database"
+	"license-mnm/logging"
+	"license-mnm/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitConfig configures RateLimit for one route group
+type RateLimitConfig struct {
+	Limit int                         // requests per minute; also the burst size. 0 disables the limit
+	Key   func(c *gin.Context) string // identifies the client the limit applies to
+	Tier  func(c *gin.Context) int    // optional per-client limit; 0 keeps Limit
+}
+
+// RateLimit middleware throttles each client with a token bucket that holds
+// Limit requests and refills continuously over a minute. Every response
+// carries RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset (seconds
+// until the bucket is full); rejected requests get 429 with Retry-After.
+// Buckets are kept in memory, so each server instance limits separately.
+func RateLimit(config RateLimitConfig) gin.HandlerFunc {
+	limiter := newRateLimiter()
+
+	return func(c *gin.Context) {
+		limit := config.Limit
+		if config.Tier != nil {
+			if tier := config.Tier(c); tier > 0 {
+				limit = tier
+			}
+		}
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+
+		allowed, remaining, reset, retryAfter := limiter.take(config.Key(c), limit, time.Now())
+
+		c.Header("RateLimit-Limit", strconv.Itoa(limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+			apierror.AbortCode(c, apierror.RateLimited, "Rate limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+// KeyByIP limits each client IP
+func KeyByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// KeyByUser limits each authenticated user, falling back to the client IP.
+// It must run after AuthMiddleware.
+func KeyByUser(c *gin.Context) string {
+	if userID, exists := c.Get("user_id"); exists {
+		return fmt.Sprintf("user:%v", userID)
+	}
+	return KeyByIP(c)
+}
+
+// KeyByAPIKey limits each SDK API key or OAuth client, falling back to the
+// client IP. It must run after SDKAuth.
+func KeyByAPIKey(c *gin.Context) string {
+	if clientID, exists := c.Get("oauth_client_id"); exists {
+		return fmt.Sprintf("client:%v", clientID)
+	}
+	if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+		return "key:" + utils.HashToken(apiKey)
+	}
+	return KeyByIP(c)
+}
+
+// RateLimitFromEnv returns the requests-per-minute limit in the environment
+// variable name, or fallback when it is unset or invalid. "0" disables the limit.
+func RateLimitFromEnv(name string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value >= 0 {
+		return value
+	}
+	return fallback
+}
+
+// packTierTTL is how long a client's pack limit is cached, so throttled
+// requests don't each cost a database query
+const packTierTTL = time.Minute
+
+type packTierEntry struct {
+	limit   int
+	expires time.Time
+}
+
+var packTiers = struct {
+	sync.Mutex
+	entries map[string]packTierEntry
+}{entries: make(map[string]packTierEntry)}
+
+// PackTierLimit returns the rate limit of the subscription pack of the
+// client's organization's active subscription, identified by an OAuth client
+// token or the user authenticated by JWT or API key. It returns 0 when there
+// is none or the pack sets no limit.
+func PackTierLimit(c *gin.Context) int {
+	query := database.DB.WithContext(c.Request.Context()).Table("subscription_packs").
+		Select("subscription_packs.rate_limit").
+		Joins("JOIN subscriptions ON subscriptions.pack_id = subscription_packs.id AND subscriptions.status = ?", "active").
+		Joins("JOIN customer_members ON customer_members.customer_id = subscriptions.customer_id").
+		Joins("JOIN users ON users.id = customer_members.user_id")
+
+	var cacheKey string
+	if customerID, exists := c.Get("customer_id"); exists {
+		cacheKey = fmt.Sprintf("customer:%v", customerID)
+		query = query.Where("subscriptions.customer_id = ?", customerID)
+	} else if userID, exists := c.Get("user_id"); exists {
+		cacheKey = fmt.Sprintf("user:%v", userID)
+		query = query.Where("users.id = ?", userID)
+	} else {
+		return 0
+	}
+
+	now := time.Now()
+	packTiers.Lock()
+	entry, ok := packTiers.entries[cacheKey]
+	packTiers.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.limit
+	}
+
+	var limits []int
+	if err := query.Limit(1).Pluck("subscription_packs.rate_limit", &limits).Error; err != nil {
+		logging.FromContext(c).Error("database error", "operation", "load pack rate limit", "error", err)
+	}
+	limit := 0
+	if len(limits) > 0 {
+		limit = limits[0]
+	}
+
+	packTiers.Lock()
+	if len(packTiers.entries) >= maxRateLimitKeys {
+		for key, entry := range packTiers.entries {
+			if now.After(entry.expires) {
+				delete(packTiers.entries, key)
+			}
+		}
+	}
+	packTiers.entries[cacheKey] = packTierEntry{limit: limit, expires: now.Add(packTierTTL)}
+	packTiers.Unlock()
+
+	return limit
+}
+
+// maxRateLimitKeys bounds the in-memory maps; beyond it, idle entries are pruned
+const maxRateLimitKeys = 10000
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// take spends one token from key's bucket if it has one. It returns whether
+// the request is allowed, the whole tokens left, the time until the bucket is
+// full again and, when not allowed, the time until the next token.
+func (l *rateLimiter) take(key string, limit int, now time.Time) (bool, int, time.Duration, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := float64(limit)
+	perSecond := capacity / 60
+
+	if len(l.buckets) >= maxRateLimitKeys {
+		// A bucket idle long enough to have refilled carries no state
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+
+	reset := secondsToDuration((capacity - bucket.tokens) / perSecond)
+	var retryAfter time.Duration
+	if !allowed {
+		retryAfter = secondsToDuration((1 - bucket.tokens) / perSecond)
+	}
+	return allowed, int(bucket.tokens), reset, retryAfter
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := newRateLimiter()
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// A limit of 60 per minute refills one token a second
+	for i := 0; i < 60; i++ {
+		if allowed, _, _, _ := limiter.take("k", 60, t0); !allowed {
+			t.Fatalf("request %d of a full bucket was refused", i+1)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		at            time.Duration
+		wantAllowed   bool
+		wantRemaining int
+		wantReset     time.Duration
+		wantRetry     time.Duration
+	}{
+		{"empty bucket", 0, false, 0, 60 * time.Second, time.Second},
+		{"half a token", 500 * time.Millisecond, false, 0, 59500 * time.Millisecond, 500 * time.Millisecond},
+		{"a token refilled", 1500 * time.Millisecond, true, 0, 59500 * time.Millisecond, 0},
+		{"partly refilled", 11500 * time.Millisecond, true, 9, 50500 * time.Millisecond, 0},
+		{"refill is capped at the limit", time.Hour, true, 59, time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, remaining, reset, retry := limiter.take("k", 60, t0.Add(tt.at))
+			if allowed != tt.wantAllowed || remaining != tt.wantRemaining || !near(reset, tt.wantReset) || !near(retry, tt.wantRetry) {
+				t.Errorf("take() = %v, %d, %v, %v; want %v, %d, %v, %v",
+					allowed, remaining, reset, retry, tt.wantAllowed, tt.wantRemaining, tt.wantReset, tt.wantRetry)
+			}
+		})
+	}
+
+	if allowed, remaining, _, _ := limiter.take("other", 60, t0); !allowed || remaining != 59 {
+		t.Errorf("another key: %v, %d; want its own full bucket", allowed, remaining)
+	}
+}
+
+// near reports whether d is within a millisecond of want, absorbing float error
+func near(d, want time.Duration) bool {
+	diff := d - want
+	return diff > -time.Millisecond && diff < time.Millisecond
+}
+
+func TestRateLimitKeyByIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		proxies    []string
+		wantStatus int
+	}{
+		{"forwarded header ignored without trusted proxies", nil, http.StatusTooManyRequests},
+		{"forwarded header used from a trusted proxy", []string{"192.0.2.0/24"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			if err := r.SetTrustedProxies(tt.proxies); err != nil {
+				t.Fatal(err)
+			}
+			r.Use(Errors(false))
+			r.Use(RateLimit(RateLimitConfig{Limit: 2, Key: KeyByIP}))
+			r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			// Each request claims a different client address
+			var w *httptest.ResponseRecorder
+			for _, forwarded := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "192.0.2.1:40000"
+				req.Header.Set("X-Forwarded-For", forwarded)
+				w = httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("third request got %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Error("429 without Retry-After")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+
+	"license-mnm/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceIDHeader returns the request's trace ID, to look the trace up
+const TraceIDHeader = "X-Trace-ID"
+
+// Tracing middleware starts a server span for each request, continuing the
+// trace of an incoming traceparent header, and returns the trace ID in
+// X-Trace-ID. Handlers pass c.Request.Context() on so their database
+// queries become child spans.
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		name := c.Request.Method + " " + route
+		if route == "" {
+			name = c.Request.Method
+		}
+
+		ctx, span := tracing.Tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		if traceID := tracing.TraceID(ctx); traceID != "" {
+			c.Header(TraceIDHeader, traceID)
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		if len(c.Errors) > 0 {
+			span.SetAttributes(semconv.ExceptionMessage(c.Errors.String()))
+		}
+	}
+}
@@ -9,23 +9,31 @@ type User struct {
 	ID           uint      `gorm:"primaryKey" json:"id"`
 	Email        string    `gorm:"uniqueIndex;not null" json:"email"`
 	PasswordHash string    `gorm:"not null" json:"-"`
-	Role         string    `gorm:"not null;default:'customer'" json:"role"` // 'admin' or 'customer'
+	Role         string    `gorm:"not null;default:'customer'" json:"role"` // 'customer' or a staff role: 'super_admin', 'admin', 'billing_admin', 'support'
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	Customer     *Customer `gorm:"foreignKey:UserID" json:"customer,omitempty"`
 	APIKey       string    `gorm:"index" json:"-"`
+	DisabledAt   *time.Time `json:"disabled_at,omitempty"` // disabled users can't sign in
+	MFASecret    string     `json:"-"`                        // base32 TOTP secret, set at enrollment
+	MFAEnabledAt *time.Time `json:"mfa_enabled_at,omitempty"` // set once enrollment is confirmed
+	MFALastStep  int64      `json:"-"`                        // last TOTP time step used, to reject replays
 }
 
-// Customer represents customer profile information
+// Customer represents customer profile information. A customer is the
+// organization that owns subscriptions; its users are listed in Members.
 type Customer struct {
 	ID           uint       `gorm:"primaryKey" json:"id"`
 	UserID       uint       `gorm:"uniqueIndex;not null" json:"user_id"`
 	Name         string     `gorm:"not null" json:"name"`
 	Phone        string     `json:"phone"`
+	Version      uint       `gorm:"not null;default:1" json:"version"` // incremented on every update; the ETag
 	CreatedAt    time.Time  `json:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at"`
 	DeletedAt    *time.Time `gorm:"index" json:"deleted_at,omitempty"`
+	ErasedAt     *time.Time `json:"erased_at,omitempty"` // personal data was pseudonymized; subscriptions are kept
 	User         User       `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Members      []CustomerMember `gorm:"foreignKey:CustomerID" json:"members,omitempty"`
 	Subscriptions []Subscription `gorm:"foreignKey:CustomerID" json:"subscriptions,omitempty"`
 }
 
@@ -35,11 +43,13 @@ type SubscriptionPack struct {
 	Name          string     `gorm:"not null" json:"name"`
 	Description   string     `json:"description"`
 	SKU           string     `gorm:"uniqueIndex;not null" json:"sku"`
-	Price         float64    `gorm:"not null" json:"price"`
 	ValidityMonths int       `gorm:"not null;check:validity_months >= 1 AND validity_months <= 12" json:"validity_months"`
+	RateLimit     int        `gorm:"not null;default:0" json:"rate_limit"` // API requests per minute for subscribers; 0 uses the server default
+	Version       uint       `gorm:"not null;default:1" json:"version"` // incremented on every update, prices included; the ETag
 	CreatedAt     time.Time  `json:"created_at"`
 	UpdatedAt     time.Time  `json:"updated_at"`
 	DeletedAt     *time.Time `gorm:"index" json:"deleted_at,omitempty"`
+	Prices        []PackPrice `gorm:"foreignKey:PackID" json:"prices,omitempty"`
 	Subscriptions []Subscription `gorm:"foreignKey:PackID" json:"subscriptions,omitempty"`
 }
 
@@ -48,21 +58,269 @@ type Subscription struct {
 	ID            uint       `gorm:"primaryKey" json:"id"`
 	CustomerID    uint       `gorm:"not null;index" json:"customer_id"`
 	PackID        uint       `gorm:"not null;index" json:"pack_id"`
-	Status        string     `gorm:"not null;default:'requested'" json:"status"` // requested, approved, active, inactive, expired
+	Status        string     `gorm:"not null;default:'requested'" json:"status"` // requested, approved, rejected, active, inactive, expired
 	RequestedAt   time.Time  `json:"requested_at"`
 	ApprovedAt    *time.Time `json:"approved_at,omitempty"`
 	AssignedAt    *time.Time `json:"assigned_at,omitempty"`
 	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	RejectedAt    *time.Time `json:"rejected_at,omitempty"`
 	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	PriceAmount   int64      `gorm:"not null;default:0" json:"price_amount"`   // price the subscription was sold at, in minor units
+	PriceCurrency string     `gorm:"size:3" json:"price_currency"`             // ISO 4217 code of PriceAmount
+	CouponID      *uint      `gorm:"index" json:"coupon_id,omitempty"`
+	DiscountAmount int64     `gorm:"not null;default:0" json:"discount_amount"` // coupon discount already taken off PriceAmount
 	CreatedAt     time.Time  `json:"created_at"`
 	UpdatedAt     time.Time  `json:"updated_at"`
 	Customer      Customer   `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
 	Pack          SubscriptionPack `gorm:"foreignKey:PackID" json:"pack,omitempty"`
 }
 
+// PackPrice is the current price of a subscription pack in one currency
+type PackPrice struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	PackID    uint      `gorm:"not null;uniqueIndex:idx_pack_prices_pack_currency" json:"pack_id"`
+	Currency  string    `gorm:"size:3;not null;uniqueIndex:idx_pack_prices_pack_currency" json:"currency"` // ISO 4217 code
+	Amount    int64     `gorm:"not null;check:amount >= 0" json:"amount"`                                  // minor units, e.g. cents
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PackPriceHistory records every change to a pack's price in one currency
+type PackPriceHistory struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	PackID      uint      `gorm:"not null;index" json:"pack_id"`
+	Currency    string    `gorm:"size:3;not null" json:"currency"`
+	Amount      *int64    `json:"amount"` // nil when the price was removed
+	EffectiveAt time.Time `gorm:"not null;index" json:"effective_at"`
+	ChangedBy   uint      `json:"changed_by,omitempty"` // admin user ID
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TableName keeps the history table name readable
+func (PackPriceHistory) TableName() string {
+	return "pack_price_history"
+}
+
+// Coupon is an admin-managed discount code applied when a subscription is requested or assigned
+type Coupon struct {
+	ID                        uint               `gorm:"primaryKey" json:"id"`
+	Code                      string             `gorm:"uniqueIndex;not null" json:"code"`
+	Description               string             `json:"description"`
+	DiscountType              string             `gorm:"not null" json:"discount_type"` // 'percentage' or 'fixed'
+	PercentOff                int                `json:"percent_off,omitempty"`         // 1-100, for percentage coupons
+	AmountOff                 int64              `json:"amount_off,omitempty"`          // minor units, for fixed coupons
+	Currency                  string             `gorm:"size:3" json:"currency,omitempty"`
+	StartsAt                  *time.Time         `json:"starts_at,omitempty"`
+	ExpiresAt                 *time.Time         `json:"expires_at,omitempty"`
+	MaxRedemptions            int                `gorm:"not null;default:0" json:"max_redemptions"`              // 0 means unlimited
+	MaxRedemptionsPerCustomer int                `gorm:"not null;default:0" json:"max_redemptions_per_customer"` // 0 means unlimited
+	TimesRedeemed             int                `gorm:"not null;default:0" json:"times_redeemed"`
+	Active                    bool               `gorm:"not null" json:"active"`
+	Packs                     []SubscriptionPack `gorm:"many2many:coupon_packs" json:"packs,omitempty"` // empty means any pack
+	CreatedAt                 time.Time          `json:"created_at"`
+	UpdatedAt                 time.Time          `json:"updated_at"`
+	DeletedAt                 *time.Time         `gorm:"index" json:"deleted_at,omitempty"`
+}
+
+// CouponRedemption records a coupon used on a subscription
+type CouponRedemption struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CouponID       uint      `gorm:"not null;index" json:"coupon_id"`
+	CustomerID     uint      `gorm:"not null;index" json:"customer_id"`
+	SubscriptionID uint      `gorm:"not null;index" json:"subscription_id"`
+	DiscountAmount int64     `gorm:"not null" json:"discount_amount"`
+	Currency       string    `gorm:"size:3;not null" json:"currency"`
+	Seq            int       `gorm:"not null;default:0" json:"-"` // which of the customer's uses of the coupon this is; unique per coupon and customer
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// CustomerMember links a user to the customer organization whose license they share
+type CustomerMember struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	CustomerID uint      `gorm:"not null;index" json:"customer_id"`
+	UserID     uint      `gorm:"uniqueIndex;not null" json:"user_id"`      // a user belongs to one organization
+	Role       string    `gorm:"not null;default:'member'" json:"role"`    // 'owner', 'billing' or 'member'
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Customer   Customer  `gorm:"foreignKey:CustomerID" json:"-"`
+	User       User      `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+// CustomerInvitation is a pending invitation for a new user to join a customer organization
+type CustomerInvitation struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	CustomerID uint       `gorm:"not null;index" json:"customer_id"`
+	Email      string     `gorm:"not null;index" json:"email"`
+	Role       string     `gorm:"not null" json:"role"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	InvitedBy  uint       `json:"invited_by"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// PasswordSetupToken lets an invited user choose their password
+type PasswordSetupToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	TokenHash string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
 
+// MFARecoveryCode is a single-use code that replaces a TOTP code when the
+// user's authenticator is unavailable
+type MFARecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"not null;index" json:"-"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
 
+// Setting is a key/value pair for settings changed at runtime through the admin API
+type Setting struct {
+	Key       string    `gorm:"primaryKey;size:100" json:"key"`
+	Value     string    `gorm:"not null" json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
 
+// LoginAttempt counts recent failed logins for an account or client IP
+// (see package lockout)
+type LoginAttempt struct {
+	Key           string    `gorm:"primaryKey;size:255" json:"key"`
+	Failures      int       `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time `gorm:"index" json:"last_failure_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
 
+// AuditLog records a security-relevant event
+type AuditLog struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Action    string    `gorm:"not null;index" json:"action"`    // e.g. 'login.locked', 'login.unlocked'
+	ActorID   *uint     `gorm:"index" json:"actor_id,omitempty"` // user who acted; nil for system events
+	Subject   string    `gorm:"index" json:"subject"`            // what the event is about, e.g. 'account:user@example.com'
+	IP        string    `json:"ip"`
+	Details   string    `gorm:"type:text" json:"details"` // JSON object
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
 
+// UserIdentity links a user to an account at an OIDC identity provider
+type UserIdentity struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"user_id"`
+	Issuer      string     `gorm:"not null;uniqueIndex:idx_user_identities_issuer_subject" json:"issuer"`
+	Subject     string     `gorm:"not null;uniqueIndex:idx_user_identities_issuer_subject" json:"subject"`
+	Email       string     `json:"email"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
 
+// OIDCLoginState holds an SSO login between the redirect to the identity
+// provider and its callback
+type OIDCLoginState struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	StateHash    string    `gorm:"uniqueIndex;not null" json:"-"`
+	Nonce        string    `gorm:"not null" json:"-"`
+	CodeVerifier string    `gorm:"not null" json:"-"`      // PKCE verifier
+	Client       string    `gorm:"not null" json:"client"` // 'admin' or 'customer'
+	ReturnTo     string    `json:"return_to"`
+	ExpiresAt    time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// TableName overrides GORM's "o_id_c_login_states"
+func (OIDCLoginState) TableName() string {
+	return "oidc_login_states"
+}
+
+// APIKey is an SDK key a customer user created with a chosen set of scopes.
+// Only the key's hash is stored. The key SDKLogin returns (User.APIKey) has
+// every scope.
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"not null" json:"name"`
+	Prefix     string     `gorm:"not null" json:"prefix"` // first characters of the key, to tell keys apart
+	KeyHash    string     `gorm:"uniqueIndex;not null" json:"-"`
+	Scopes     string     `gorm:"not null" json:"scopes"` // space-separated, e.g. 'subscription:read history:read'
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// OAuthClient lets a customer's backend services call the SDK API with the
+// OAuth2 client credentials grant instead of a user's API key
+type OAuthClient struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	CustomerID uint       `gorm:"not null;index" json:"customer_id"`
+	Name       string     `gorm:"not null" json:"name"`
+	ClientID   string     `gorm:"uniqueIndex;not null" json:"client_id"`
+	SecretHash string     `gorm:"not null" json:"-"`
+	Scopes     string     `gorm:"not null" json:"scopes"` // space-separated, e.g. 'subscription:read subscription:write'
+	CreatedBy  uint       `json:"created_by"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"` // last token issued
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// TableName overrides GORM's "o_auth_clients"
+func (OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+// IdempotencyKey stores the first response to a mutating request sent with an
+// Idempotency-Key header, so retries with the same key replay it instead of
+// running the request again
+type IdempotencyKey struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Caller      string    `gorm:"uniqueIndex:idx_idempotency_caller_key;size:64;not null" json:"caller"` // 'user:<id>' or 'client:<client_id>'
+	Key         string    `gorm:"uniqueIndex:idx_idempotency_caller_key;size:255;not null" json:"key"`
+	RequestHash string    `gorm:"not null" json:"-"`  // method, path, query and body the key was first used with
+	StatusCode  int       `json:"status_code"`        // 0 while the first request is still running
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"-"`
+	ExpiresAt   time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Job is a bulk operation an admin started that runs in the background.
+// Clients poll it until Status is 'succeeded' or 'failed'.
+type Job struct {
+	ID         uint        `gorm:"primaryKey" json:"id"`
+	Kind       string      `gorm:"not null;index" json:"kind"`              // e.g. 'customer_import'
+	Status     string      `gorm:"not null;default:'queued'" json:"status"` // queued, running, succeeded, failed
+	DryRun     bool        `gorm:"not null;default:false" json:"dry_run"`   // rows are checked but nothing is written
+	CreatedBy  uint        `gorm:"index" json:"created_by"`
+	Total      int         `gorm:"not null;default:0" json:"total"` // rows to process
+	Processed  int         `gorm:"not null;default:0" json:"processed"`
+	Succeeded  int         `gorm:"not null;default:0" json:"succeeded"`
+	Failed     int         `gorm:"not null;default:0" json:"failed"`
+	Errors     []JobError  `gorm:"serializer:json;type:text" json:"errors"`            // one per failed row
+	Results    []JobResult `gorm:"serializer:json;type:text" json:"results,omitempty"` // one per created row
+	Message    string      `json:"message,omitempty"`                                  // why the whole job failed
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+}
+
+// JobResult is what one row of a job created. SetupToken is the one-time
+// token a created customer's owner sets a password with.
+type JobResult struct {
+	Row            int        `json:"row"`
+	CustomerID     uint       `json:"customer_id,omitempty"`
+	SetupToken     string     `json:"setup_token,omitempty"`
+	SetupExpiresAt *time.Time `json:"setup_expires_at,omitempty"`
+}
+
+// JobError is why one row of a job failed
+type JobError struct {
+	Row     int    `json:"row"` // 1-based, not counting a CSV header
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,258 @@
+// Package pagination pages, sorts and bounds admin and customer list
+// endpoints. A list accepts limit and either page (offset pagination) or
+// cursor (keyset pagination), plus sort and order. Every page reports a
+// next_cursor, so a client can switch to cursors after the first page.
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"license-mnm/apierror"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// MaxLimit is the largest page size any list returns; larger limits are capped
+const MaxLimit = 100
+
+// Sort is a column a list can be sorted by
+type Sort[T any] struct {
+	// Column is the column or expression to order by. It is written into SQL
+	// as is, so it must come from code, never from the request.
+	Column string
+	// Value returns row's value of Column, which next_cursor encodes. Sorts
+	// by a computed value, like a search rank, leave it nil and page only by
+	// page number.
+	Value func(row *T) any
+}
+
+// List describes how one endpoint pages rows of type T
+type List[T any] struct {
+	DefaultLimit int
+	DefaultSort  string
+	DefaultDesc  bool
+	// Sorts are the fields clients may sort by, keyed by their names in the
+	// sort parameter. Rows are ordered by the field, then by id.
+	Sorts map[string]Sort[T]
+	// ID returns row's primary key
+	ID func(row *T) uint
+	// IDColumn is the primary key column, qualified if the query joins;
+	// "id" when empty
+	IDColumn string
+}
+
+// Request is a parsed page request
+type Request[T any] struct {
+	list  *List[T]
+	Limit int
+	Page  int // 0 when paging by cursor
+	Sort  string
+	Desc  bool
+	after *cursor
+	// afterValue is the cursor's sort value, decoded; afterNull is set when
+	// the value is NULL
+	afterValue any
+	afterNull  bool
+}
+
+// Page describes the page a list returned
+type Page struct {
+	Page       int    `json:"page,omitempty"`
+	Limit      int    `json:"limit"`
+	Total      int64  `json:"total"`
+	Sort       string `json:"sort"`
+	Order      string `json:"order"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// cursor is the position after the last row of a page. It carries the sort
+// it was made for, so it can't be used with a different one.
+type cursor struct {
+	Sort  string          `json:"s"`
+	Desc  bool            `json:"d,omitempty"`
+	Value json.RawMessage `json:"v"`
+	ID    uint            `json:"i"`
+}
+
+// Parse reads limit, page, cursor, sort and order from the query string. It
+// returns a VALIDATION_FAILED error listing every invalid parameter. For
+// compatibility sort may also be just asc or desc, ordering by the default
+// field.
+func (l *List[T]) Parse(c *gin.Context) (*Request[T], *apierror.Error) {
+	r := &Request[T]{list: l, Limit: l.DefaultLimit, Page: 1, Sort: l.DefaultSort, Desc: l.DefaultDesc}
+	var details []apierror.FieldError
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			details = append(details, apierror.FieldError{Field: "limit", Rule: "min", Message: "must be a positive integer"})
+		}
+		r.Limit = min(limit, MaxLimit)
+	}
+	if value := c.Query("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			details = append(details, apierror.FieldError{Field: "page", Rule: "min", Message: "must be a positive integer"})
+		}
+		r.Page = page
+	}
+
+	sortName, order := c.Query("sort"), c.Query("order")
+	if order == "" && (sortName == "asc" || sortName == "desc") {
+		sortName, order = "", sortName
+	}
+	if sortName != "" {
+		if _, ok := l.Sorts[sortName]; !ok {
+			details = append(details, apierror.FieldError{Field: "sort", Rule: "oneof", Message: "must be one of: " + strings.Join(l.sortNames(), ", ")})
+		}
+		r.Sort = sortName
+	}
+	switch order {
+	case "":
+	case "asc", "desc":
+		r.Desc = order == "desc"
+	default:
+		details = append(details, apierror.FieldError{Field: "order", Rule: "oneof", Message: "must be one of: asc, desc"})
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		after, ok := decodeCursor(value)
+		if ok {
+			r.afterValue, r.afterNull, ok = l.cursorValue(after)
+		}
+		switch {
+		case !ok:
+			details = append(details, apierror.FieldError{Field: "cursor", Rule: "cursor", Message: "is not a cursor returned by this list"})
+		case (sortName != "" && sortName != after.Sort) || (order != "" && r.Desc != after.Desc):
+			details = append(details, apierror.FieldError{Field: "cursor", Rule: "cursor", Message: "was returned for a different sort or order"})
+		case c.Query("page") != "":
+			details = append(details, apierror.FieldError{Field: "page", Rule: "excluded_with", Message: "can't be combined with cursor"})
+		default:
+			r.after, r.Sort, r.Desc, r.Page = after, after.Sort, after.Desc, 0
+		}
+	}
+
+	if details != nil {
+		return nil, apierror.Fields(details...)
+	}
+	return r, nil
+}
+
+// Apply orders query and restricts it to the requested page. It fetches one
+// row more than the limit, so Result can tell whether there is a next page.
+// Count the total before calling it.
+func (r *Request[T]) Apply(query *gorm.DB) *gorm.DB {
+	column := r.list.Sorts[r.Sort].Column
+	direction := " ASC"
+	if r.Desc {
+		direction = " DESC"
+	}
+	query = query.Order(column + direction).Order(r.list.idColumn() + direction)
+
+	if r.after == nil {
+		return query.Offset((r.Page - 1) * r.Limit).Limit(r.Limit + 1)
+	}
+	condition := keyset(column, r.list.idColumn(), r.Desc, r.afterNull)
+	return query.Where(condition, keysetArgs(r.afterValue, r.after.ID, r.afterNull)...).Limit(r.Limit + 1)
+}
+
+// Result drops the extra row Apply fetched and describes the page
+func (r *Request[T]) Result(rows []T, total int64) ([]T, Page) {
+	page := Page{Page: r.Page, Limit: r.Limit, Total: total, Sort: r.Sort, Order: "asc"}
+	if r.Desc {
+		page.Order = "desc"
+	}
+	if len(rows) > r.Limit {
+		rows = rows[:r.Limit]
+		if r.list.Sorts[r.Sort].Value != nil {
+			page.NextCursor = r.encodeCursor(&rows[len(rows)-1])
+		}
+	}
+	return rows, page
+}
+
+// keyset is the condition for rows after the cursor's row. SQLite sorts
+// NULL before every value, so NULLs come first ascending and last
+// descending.
+func keyset(column, id string, desc, isNull bool) string {
+	switch {
+	case !desc && isNull:
+		return "((" + column + " IS NULL AND " + id + " > ?) OR " + column + " IS NOT NULL)"
+	case !desc:
+		return "(" + column + " > ? OR (" + column + " = ? AND " + id + " > ?))"
+	case isNull:
+		return "(" + column + " IS NULL AND " + id + " < ?)"
+	default:
+		return "(" + column + " < ? OR " + column + " IS NULL OR (" + column + " = ? AND " + id + " < ?))"
+	}
+}
+
+// keysetArgs are the arguments of keyset's condition
+func keysetArgs(value any, id uint, isNull bool) []any {
+	if isNull {
+		return []any{id}
+	}
+	return []any{value, value, id}
+}
+
+// cursorValue decodes a cursor's sort value into the type Sort.Value
+// returns, so it is bound the way the column's values were stored. It
+// reports whether the value is NULL and whether the cursor fits the list.
+func (l *List[T]) cursorValue(after *cursor) (any, bool, bool) {
+	field, ok := l.Sorts[after.Sort]
+	if !ok || field.Value == nil {
+		return nil, false, false
+	}
+	ptr := reflect.New(reflect.TypeOf(field.Value(new(T))))
+	if err := json.Unmarshal(after.Value, ptr.Interface()); err != nil {
+		return nil, false, false
+	}
+	value := ptr.Elem()
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil, true, true
+		}
+		value = value.Elem()
+	}
+	return value.Interface(), false, true
+}
+
+func (r *Request[T]) encodeCursor(row *T) string {
+	value, _ := json.Marshal(r.list.Sorts[r.Sort].Value(row))
+	data, _ := json.Marshal(cursor{Sort: r.Sort, Desc: r.Desc, Value: value, ID: r.list.ID(row)})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*cursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false
+	}
+	var after cursor
+	if err := json.Unmarshal(data, &after); err != nil || after.Value == nil {
+		return nil, false
+	}
+	return &after, true
+}
+
+func (l *List[T]) idColumn() string {
+	if l.IDColumn == "" {
+		return "id"
+	}
+	return l.IDColumn
+}
+
+func (l *List[T]) sortNames() []string {
+	names := make([]string, 0, len(l.Sorts))
+	for name := range l.Sorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
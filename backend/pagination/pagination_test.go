@@ -0,0 +1,171 @@
+package pagination
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"license-mnm/database/dbtest"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type item struct {
+	ID    uint `gorm:"primaryKey"`
+	Name  string
+	Score *int
+}
+
+var items = List[item]{
+	DefaultLimit: 20,
+	DefaultSort:  "id",
+	Sorts: map[string]Sort[item]{
+		"id":    {Column: "id", Value: func(row *item) any { return row.ID }},
+		"name":  {Column: "name", Value: func(row *item) any { return row.Name }},
+		"score": {Column: "score", Value: func(row *item) any { return row.Score }},
+		"rank":  {Column: "length(name)"},
+	},
+	ID: func(row *item) uint { return row.ID },
+}
+
+func testContext(query string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+	return c
+}
+
+// seedItems stores items whose scores include NULLs and ties
+func seedItems(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := dbtest.Open(t)
+	if err := db.AutoMigrate(&item{}); err != nil {
+		t.Fatal(err)
+	}
+	score := func(n int) *int { return &n }
+	for i, s := range []*int{nil, score(3), nil, score(1), score(3), nil, score(2)} {
+		if err := db.Create(&item{Name: string(rune('a' + i)), Score: s}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// fetch runs one page request and returns the ids it listed
+func fetch(t *testing.T, db *gorm.DB, query string) ([]uint, Page) {
+	t.Helper()
+	req, apiErr := items.Parse(testContext(query))
+	if apiErr != nil {
+		t.Fatalf("Parse(%s): %v", query, apiErr.Details)
+	}
+	var total int64
+	db.Model(&item{}).Count(&total)
+	var rows []item
+	if err := req.Apply(db.Model(&item{})).Find(&rows).Error; err != nil {
+		t.Fatalf("query %s: %v", query, err)
+	}
+	rows, page := req.Result(rows, total)
+	ids := make([]uint, len(rows))
+	for i := range rows {
+		ids[i] = rows[i].ID
+	}
+	return ids, page
+}
+
+func TestKeysetPagination(t *testing.T) {
+	db := seedItems(t)
+
+	tests := []struct {
+		query string
+		want  []uint
+	}{
+		// NULL sorts first ascending and last descending, ties by id
+		{"sort=score&order=asc", []uint{1, 3, 6, 4, 7, 2, 5}},
+		{"sort=score&order=desc", []uint{5, 2, 7, 4, 6, 3, 1}},
+		{"sort=name&order=desc", []uint{7, 6, 5, 4, 3, 2, 1}},
+		{"sort=desc", []uint{7, 6, 5, 4, 3, 2, 1}},
+	}
+	for _, tt := range tests {
+		for limit := 1; limit <= 4; limit++ {
+			query := fmt.Sprintf("%s&limit=%d", tt.query, limit)
+
+			var byCursor []uint
+			ids, page := fetch(t, db, query)
+			byCursor = append(byCursor, ids...)
+			for page.NextCursor != "" && len(byCursor) <= len(tt.want) {
+				ids, page = fetch(t, db, fmt.Sprintf("limit=%d&cursor=%s", limit, page.NextCursor))
+				if page.Page != 0 || page.Total != int64(len(tt.want)) {
+					t.Errorf("%s: cursor page reports page %d, total %d", query, page.Page, page.Total)
+				}
+				byCursor = append(byCursor, ids...)
+			}
+			if !reflect.DeepEqual(byCursor, tt.want) {
+				t.Errorf("%s by cursor: %v, want %v", query, byCursor, tt.want)
+			}
+
+			var byPage []uint
+			for n := 1; len(byPage) < len(tt.want); n++ {
+				ids, _ := fetch(t, db, fmt.Sprintf("%s&page=%d", query, n))
+				if len(ids) == 0 {
+					break
+				}
+				byPage = append(byPage, ids...)
+			}
+			if !reflect.DeepEqual(byPage, tt.want) {
+				t.Errorf("%s by page: %v, want %v", query, byPage, tt.want)
+			}
+		}
+	}
+
+	// Sorts without a Value page only by number
+	if _, page := fetch(t, db, "sort=rank&limit=2"); page.NextCursor != "" {
+		t.Errorf("computed sort returned cursor %q", page.NextCursor)
+	}
+}
+
+func TestParse(t *testing.T) {
+	// This cursor is after a NULL score
+	_, page := fetch(t, seedItems(t), "sort=score&limit=2")
+	tests := []struct {
+		name      string
+		query     string
+		wantField string // the invalid parameter; empty when valid
+		wantLimit int
+		wantSort  string
+		wantDesc  bool
+	}{
+		{"defaults", "", "", 20, "id", false},
+		{"limit capped", "limit=500", "", MaxLimit, "id", false},
+		{"legacy order in sort", "sort=desc", "", 20, "id", true},
+		{"sort and order", "sort=name&order=desc", "", 20, "name", true},
+		{"zero limit", "limit=0", "limit", 0, "", false},
+		{"bad page", "page=x", "page", 0, "", false},
+		{"unknown sort", "sort=email", "sort", 0, "", false},
+		{"bad order", "order=up", "order", 0, "", false},
+		{"garbage cursor", "cursor=abc", "cursor", 0, "", false},
+		{"cursor for another sort", "sort=name&cursor=" + page.NextCursor, "cursor", 0, "", false},
+		{"cursor for another order", "order=desc&cursor=" + page.NextCursor, "cursor", 0, "", false},
+		{"cursor with page", "page=2&cursor=" + page.NextCursor, "page", 0, "", false},
+		{"cursor keeps its sort", "cursor=" + page.NextCursor, "", 20, "score", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, apiErr := items.Parse(testContext(tt.query))
+			if tt.wantField != "" {
+				if apiErr == nil || len(apiErr.Details) != 1 || apiErr.Details[0].Field != tt.wantField {
+					t.Errorf("Parse() = %v, want an error for %s", apiErr, tt.wantField)
+				}
+				return
+			}
+			if apiErr != nil {
+				t.Fatalf("Parse(): %v", apiErr.Details)
+			}
+			if req.Limit != tt.wantLimit || req.Sort != tt.wantSort || req.Desc != tt.wantDesc {
+				t.Errorf("Parse() = limit %d, sort %s, desc %v", req.Limit, req.Sort, req.Desc)
+			}
+		})
+	}
+}
@@ -36,7 +36,7 @@ PACK_RESPONSE=$(curl -s -X POST $BASE_URL/api/v1/admin/subscription-packs \
   -H "Content-Type: application/json" \
   -H "Authorization: Bearer $ADMIN_TOKEN" \
   -d '{"name":"Premium Plan","description":"Full access","sku":"premium-plan","price":29.99,"validity_months":12}')
-PACK_ID=$(echo $PACK_RESPONSE | grep -o '"id":[0-9]*' | cut -d':' -f2)
+PACK_ID=$(echo $PACK_RESPONSE | grep -o '"id":[0-9]*' | head -1 | cut -d':' -f2)
 if [ ! -z "$PACK_ID" ]; then
   echo -e "${GREEN}✓ Subscription pack created (ID: $PACK_ID)${NC}"
 else
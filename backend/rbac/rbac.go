@@ -0,0 +1,104 @@
+package rbac
+
+import "strings"
+
+// Permission is an action a staff user may perform in the admin API
+type Permission string
+
+const (
+	DashboardRead      Permission = "dashboard:read"
+	CustomersRead      Permission = "customers:read"
+	CustomersWrite     Permission = "customers:write"
+	PacksRead          Permission = "packs:read"
+	PacksWrite         Permission = "packs:write"
+	SubscriptionsRead  Permission = "subscriptions:read"
+	SubscriptionsWrite Permission = "subscriptions:write"
+	CouponsRead        Permission = "coupons:read"
+	CouponsWrite       Permission = "coupons:write"
+	AdminsRead         Permission = "admins:read"
+	AdminsWrite        Permission = "admins:write"
+	AuditRead          Permission = "audit:read"
+)
+
+// Staff roles. RoleCustomer is not a staff role and has no admin permissions.
+const (
+	RoleSuperAdmin   = "super_admin"
+	RoleAdmin        = "admin"
+	RoleBillingAdmin = "billing_admin"
+	RoleSupport      = "support"
+	RoleCustomer     = "customer"
+)
+
+// AllPermissions lists every permission, in display order
+var AllPermissions = []Permission{
+	DashboardRead,
+	CustomersRead, CustomersWrite,
+	PacksRead, PacksWrite,
+	SubscriptionsRead, SubscriptionsWrite,
+	CouponsRead, CouponsWrite,
+	AdminsRead, AdminsWrite,
+	AuditRead,
+}
+
+// RolePermissions maps each staff role to the permissions it grants
+var RolePermissions = map[string][]Permission{
+	RoleSuperAdmin: AllPermissions,
+	RoleAdmin: {
+		DashboardRead,
+		CustomersRead, CustomersWrite,
+		PacksRead, PacksWrite,
+		SubscriptionsRead, SubscriptionsWrite,
+		CouponsRead, CouponsWrite,
+		AuditRead,
+	},
+	RoleBillingAdmin: {
+		PacksRead, PacksWrite,
+		CouponsRead, CouponsWrite,
+	},
+	RoleSupport: {
+		DashboardRead,
+		CustomersRead,
+		PacksRead,
+		SubscriptionsRead,
+		CouponsRead,
+	},
+}
+
+// StaffRoles lists the roles that can sign in to the admin API, most privileged first
+var StaffRoles = []string{RoleSuperAdmin, RoleAdmin, RoleBillingAdmin, RoleSupport}
+
+// IsStaffRole reports whether role is one of the admin API roles
+func IsStaffRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether role grants perm
+func HasPermission(role string, perm Permission) bool {
+	for _, p := range RolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Scopes an API key or OAuth client may be granted on the SDK API
+const (
+	ScopeSubscriptionRead  = "subscription:read"  // view the current subscription
+	ScopeSubscriptionWrite = "subscription:write" // request and deactivate subscriptions
+	ScopeHistoryRead       = "history:read"       // view the subscription history
+)
+
+// SDKScopes lists every SDK scope; credentials without explicit scopes get all of them
+var SDKScopes = []string{ScopeSubscriptionRead, ScopeSubscriptionWrite, ScopeHistoryRead}
+
+// HasScope reports whether the space-separated scopes include scope
+func HasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
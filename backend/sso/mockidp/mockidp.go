@@ -0,0 +1,235 @@
+// Package mockidp is a stand-in OpenID Connect identity provider for trying
+// single sign-on locally and for tests. Every authorization request is
+// approved at once for the server's identity; the email, name and groups can
+// be overridden per request with the query parameters mock_email, mock_name
+// and mock_groups. Codes are only redeemed with the matching PKCE verifier.
+package mockidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Server is a mock identity provider. Set Issuer to the URL it is served at
+// before the first request.
+type Server struct {
+	Issuer string
+	Email  string
+	Name   string
+	Groups []string
+
+	key   *rsa.PrivateKey
+	keyID string
+	mux   *http.ServeMux
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+type authorization struct {
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	email         string
+	name          string
+	groups        []string
+	expiresAt     time.Time
+}
+
+// New creates a Server signing in the given identity
+func New(email, name string, groups []string) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Email:  email,
+		Name:   name,
+		Groups: groups,
+		key:    key,
+		keyID:  randomString(8),
+		mux:    http.NewServeMux(),
+		codes:  make(map[string]authorization),
+	}
+	s.mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	s.mux.HandleFunc("/jwks", s.jwks)
+	s.mux.HandleFunc("/authorize", s.authorize)
+	s.mux.HandleFunc("/token", s.token)
+	return s, nil
+}
+
+// ServeHTTP serves the discovery, jwks, authorize and token endpoints
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) issuer() string {
+	return strings.TrimSuffix(s.Issuer, "/")
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := s.issuer()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": s.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize approves the request immediately and redirects back with a code
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI := query.Get("redirect_uri")
+	if query.Get("response_type") != "code" || redirectURI == "" || query.Get("client_id") == "" {
+		http.Error(w, "response_type=code, client_id and redirect_uri are required", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	auth := authorization{
+		clientID:      query.Get("client_id"),
+		redirectURI:   redirectURI,
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		email:         s.Email,
+		name:          s.Name,
+		groups:        s.Groups,
+		expiresAt:     time.Now().Add(time.Minute),
+	}
+	if email := query.Get("mock_email"); email != "" {
+		auth.email = email
+	}
+	if name := query.Get("mock_name"); name != "" {
+		auth.name = name
+	}
+	if groups, ok := query["mock_groups"]; ok {
+		auth.groups = SplitGroups(groups[0])
+	}
+
+	callback, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString(16)
+	s.mu.Lock()
+	s.codes[code] = auth
+	s.mu.Unlock()
+
+	values := callback.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	callback.RawQuery = values.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+// token redeems a code, checking the PKCE verifier, and issues an ID token
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	s.mu.Lock()
+	auth, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || time.Now().After(auth.expiresAt) ||
+		r.PostForm.Get("redirect_uri") != auth.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            s.issuer(),
+		"sub":            "mock|" + auth.email,
+		"aud":            auth.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          auth.nonce,
+		"email":          auth.email,
+		"email_verified": true,
+		"name":           auth.name,
+		"groups":         auth.groups,
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = s.keyID
+	signed, err := idToken.SignedString(s.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(16),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+// SplitGroups splits a comma-separated group list
+func SplitGroups(groups string) []string {
+	list := []string{}
+	for _, group := range strings.Split(groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			list = append(list, group)
+		}
+	}
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func randomString(n int) string {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
@@ -0,0 +1,275 @@
+// Package sso signs users in through an OpenID Connect identity provider
+// using the authorization code flow with PKCE.
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"license-mnm/rbac"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrNotConfigured is returned when OIDC_ISSUER_URL is not set
+var ErrNotConfigured = errors.New("single sign-on is not configured")
+
+// Identity is the user an ID token was issued for
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
+
+// Provider is a discovered OIDC identity provider
+type Provider struct {
+	oauth2      oauth2.Config
+	verifier    *oidc.IDTokenVerifier
+	groupsClaim string
+	adminRoles  map[string]string // IdP group -> staff role
+	returnURLs  []string
+}
+
+// settings is the provider configuration read from the environment by Init
+type settings struct {
+	issuerURL    string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	groupsClaim  string
+	adminRoles   map[string]string
+	returnURLs   []string
+}
+
+var (
+	mu       sync.Mutex
+	config   *settings
+	provider *Provider
+)
+
+// Init reads the provider configuration from the environment. The provider
+// itself is discovered on first use, so the server starts while the IdP is down.
+//
+//	OIDC_ISSUER_URL         issuer URL; SSO is disabled when unset
+//	OIDC_CLIENT_ID          client ID registered at the IdP
+//	OIDC_CLIENT_SECRET      client secret; may be empty for public clients
+//	OIDC_REDIRECT_URL       this server's callback, e.g. https://api.example.com/api/auth/oidc/callback
+//	OIDC_SCOPES             space-separated scopes (default "openid email profile")
+//	OIDC_GROUPS_CLAIM       ID token claim holding the user's groups (default "groups")
+//	OIDC_ADMIN_ROLE_GROUPS  comma-separated group=role pairs, e.g. "it-admins=super_admin,finance=billing_admin"
+//	OIDC_RETURN_URLS        comma-separated URLs a login may return the browser to, or paths below them
+func Init() error {
+	issuerURL := os.Getenv("OIDC_ISSUER_URL")
+	if issuerURL == "" {
+		return nil
+	}
+
+	s := &settings{
+		issuerURL:    issuerURL,
+		clientID:     os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+		groupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		adminRoles:   make(map[string]string),
+		returnURLs:   splitList(os.Getenv("OIDC_RETURN_URLS")),
+	}
+	if s.clientID == "" || s.redirectURL == "" {
+		return errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER_URL")
+	}
+	if len(s.scopes) == 0 {
+		s.scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	if s.groupsClaim == "" {
+		s.groupsClaim = "groups"
+	}
+	for _, pair := range splitList(os.Getenv("OIDC_ADMIN_ROLE_GROUPS")) {
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || !rbac.IsStaffRole(strings.TrimSpace(role)) {
+			return fmt.Errorf("invalid OIDC_ADMIN_ROLE_GROUPS entry %q", pair)
+		}
+		s.adminRoles[strings.TrimSpace(group)] = strings.TrimSpace(role)
+	}
+
+	mu.Lock()
+	config, provider = s, nil
+	mu.Unlock()
+	return nil
+}
+
+// Enabled reports whether SSO is configured
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return config != nil
+}
+
+// Get returns the provider, running OIDC discovery on first use
+func Get(ctx context.Context) (*Provider, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if config == nil {
+		return nil, ErrNotConfigured
+	}
+	if provider != nil {
+		return provider, nil
+	}
+
+	discovered, err := oidc.NewProvider(ctx, config.issuerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	provider = &Provider{
+		oauth2: oauth2.Config{
+			ClientID:     config.clientID,
+			ClientSecret: config.clientSecret,
+			RedirectURL:  config.redirectURL,
+			Endpoint:     discovered.Endpoint(),
+			Scopes:       config.scopes,
+		},
+		verifier:    discovered.Verifier(&oidc.Config{ClientID: config.clientID}),
+		groupsClaim: config.groupsClaim,
+		adminRoles:  config.adminRoles,
+		returnURLs:  config.returnURLs,
+	}
+	return provider, nil
+}
+
+// AuthCodeURL returns the IdP URL the browser is sent to. The verifier's
+// S256 challenge is sent now and the verifier itself with the code exchange.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange redeems an authorization code and verifies the returned ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (Identity, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return Identity{}, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, errors.New("token response has no id_token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return Identity{}, err
+	}
+	if idToken.Nonce != nonce {
+		return Identity{}, errors.New("id_token nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+		Groups:  stringList(claims[p.groupsClaim]),
+	}
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	return identity, nil
+}
+
+// AdminRole returns the most privileged staff role the groups map to, or ""
+// when none of them is an admin group
+func (p *Provider) AdminRole(groups []string) string {
+	granted := make(map[string]bool)
+	for _, group := range groups {
+		if role, ok := p.adminRoles[group]; ok {
+			granted[role] = true
+		}
+	}
+	for _, role := range rbac.StaffRoles {
+		if granted[role] {
+			return role
+		}
+	}
+	return ""
+}
+
+// ReturnURLAllowed reports whether a login may send the browser to rawURL:
+// its scheme and host must be those of an OIDC_RETURN_URLS entry and its path
+// must be the entry's path or below it
+func (p *Provider) ReturnURLAllowed(rawURL string) bool {
+	target, err := url.Parse(rawURL)
+	if err != nil || target.Host == "" || target.User != nil {
+		return false
+	}
+	for _, entry := range p.returnURLs {
+		allowed, err := url.Parse(entry)
+		if err != nil || allowed.Host == "" {
+			continue
+		}
+		if strings.EqualFold(target.Scheme, allowed.Scheme) &&
+			strings.EqualFold(target.Host, allowed.Host) &&
+			pathWithin(target.Path, allowed.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathWithin reports whether target is base or below it, comparing whole
+// path segments after resolving dot segments as a browser would
+func pathWithin(target, base string) bool {
+	base = strings.TrimSuffix(base, "/")
+	if base == "" {
+		return true
+	}
+	if target == "" {
+		target = "/"
+	}
+	target = path.Clean(target)
+	return target == base || strings.HasPrefix(target, base+"/")
+}
+
+// stringList reads a claim holding a list of strings or a single string
+func stringList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var list []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,205 @@
+package sso
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"license-mnm/rbac"
+	"license-mnm/sso/mockidp"
+
+	"golang.org/x/oauth2"
+)
+
+const testRedirectURL = "http://api.test/api/auth/oidc/callback"
+
+// startIdP serves a mock identity provider and configures SSO to use it
+func startIdP(t *testing.T) {
+	t.Helper()
+	idp, err := mockidp.New("alice@example.com", "Alice", []string{"it-admins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(idp)
+	t.Cleanup(server.Close)
+	idp.Issuer = server.URL
+
+	t.Setenv("OIDC_ISSUER_URL", server.URL)
+	t.Setenv("OIDC_CLIENT_ID", "license-mnm")
+	t.Setenv("OIDC_REDIRECT_URL", testRedirectURL)
+	t.Setenv("OIDC_ADMIN_ROLE_GROUPS", "it-admins=super_admin, finance=billing_admin")
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		config, provider = nil, nil
+		mu.Unlock()
+	})
+}
+
+// authorize visits authURL at the IdP and returns the code and state it
+// redirects back with
+func authorize(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got %d, want 302", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := callback.Scheme + "://" + callback.Host + callback.Path; got != testRedirectURL {
+		t.Fatalf("redirected to %s, want %s", got, testRedirectURL)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func TestExchange(t *testing.T) {
+	startIdP(t)
+	ctx := context.Background()
+	provider, err := Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		groups      string // mock_groups; empty keeps the IdP's
+		wrongVerify bool
+		wrongNonce  bool
+		reuse       bool
+		wantErr     bool
+		wantGroups  []string
+		wantRole    string
+	}{
+		{name: "identity with its groups", wantGroups: []string{"it-admins"}, wantRole: rbac.RoleSuperAdmin},
+		{name: "other groups", groups: "finance,staff", wantGroups: []string{"finance", "staff"}, wantRole: rbac.RoleBillingAdmin},
+		{name: "no admin group", groups: "staff", wantGroups: []string{"staff"}},
+		{name: "wrong PKCE verifier", wrongVerify: true, wantErr: true},
+		{name: "nonce mismatch", wrongNonce: true, wantErr: true},
+		{name: "code used twice", reuse: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := oauth2.GenerateVerifier()
+			authURL := provider.AuthCodeURL("state-1", "nonce-1", verifier)
+			if tt.groups != "" {
+				authURL += "&mock_groups=" + url.QueryEscape(tt.groups)
+			}
+			code, state := authorize(t, authURL)
+			if state != "state-1" {
+				t.Errorf("state %q, want state-1", state)
+			}
+
+			if tt.wrongVerify {
+				verifier = oauth2.GenerateVerifier()
+			}
+			nonce := "nonce-1"
+			if tt.wrongNonce {
+				nonce = "nonce-2"
+			}
+			if tt.reuse {
+				if _, err := provider.Exchange(ctx, code, verifier, nonce); err != nil {
+					t.Fatalf("first exchange: %v", err)
+				}
+			}
+
+			identity, err := provider.Exchange(ctx, code, verifier, nonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exchange() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if identity.Email != "alice@example.com" || !identity.EmailVerified || identity.Name != "Alice" || identity.Subject == "" {
+				t.Errorf("identity %+v", identity)
+			}
+			if !reflect.DeepEqual(identity.Groups, tt.wantGroups) {
+				t.Errorf("groups %v, want %v", identity.Groups, tt.wantGroups)
+			}
+			if role := provider.AdminRole(identity.Groups); role != tt.wantRole {
+				t.Errorf("AdminRole() = %q, want %q", role, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestAdminRole(t *testing.T) {
+	provider := &Provider{adminRoles: map[string]string{
+		"it-admins": rbac.RoleSuperAdmin,
+		"finance":   rbac.RoleBillingAdmin,
+	}}
+	tests := []struct {
+		groups []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"staff"}, ""},
+		{[]string{"finance"}, rbac.RoleBillingAdmin},
+		{[]string{"finance", "it-admins"}, rbac.RoleSuperAdmin},
+	}
+	for _, tt := range tests {
+		if got := provider.AdminRole(tt.groups); got != tt.want {
+			t.Errorf("AdminRole(%v) = %q, want %q", tt.groups, got, tt.want)
+		}
+	}
+}
+
+func TestReturnURLAllowed(t *testing.T) {
+	provider := &Provider{returnURLs: []string{"https://app.example.com/", "https://portal.example.com/sso/"}}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://app.example.com/", true},
+		{"https://app.example.com", true},
+		{"https://app.example.com/dashboard?tab=1", true},
+		{"https://APP.example.com/dashboard", true},
+		{"https://portal.example.com/sso", true},
+		{"https://portal.example.com/sso/done", true},
+		{"https://app.example.com.evil.com/", false},
+		{"https://app.example.com@evil.com/", false},
+		{"https://app.example.com:8443/", false},
+		{"http://app.example.com/", false},
+		{"https://portal.example.com/ssoevil", false},
+		{"https://portal.example.com/", false},
+		{"https://portal.example.com/sso/../admin", false},
+		{"https://portal.example.com/sso/%2e%2e/admin", false},
+		{"//app.example.com/", false},
+		{"/dashboard", false},
+		{"javascript:alert(1)", false},
+		{"https://evil.com/?https://app.example.com/", false},
+	}
+	for _, tt := range tests {
+		if got := provider.ReturnURLAllowed(tt.url); got != tt.want {
+			t.Errorf("ReturnURLAllowed(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestStringList(t *testing.T) {
+	tests := []struct {
+		claim interface{}
+		want  []string
+	}{
+		{nil, nil},
+		{"admins", []string{"admins"}},
+		{[]interface{}{"a", 1, "b"}, []string{"a", "b"}},
+		{42, nil},
+	}
+	for _, tt := range tests {
+		if got := stringList(tt.claim); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("stringList(%v) = %v, want %v", tt.claim, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// spanKey is where a statement's span is kept between the callbacks
+const spanKey = "tracing:span"
+
+// GormPlugin traces each GORM operation as a child span of the span in the
+// statement's context (set with DB.WithContext). Queries run outside a traced
+// request are not traced, so they don't show up as traces of their own.
+type GormPlugin struct{}
+
+// Name implements gorm.Plugin
+func (GormPlugin) Name() string {
+	return "tracing"
+}
+
+// Initialize implements gorm.Plugin by wrapping GORM's own callbacks
+func (GormPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register("tracing:before_create", startSpan("create")),
+		callbacks.Create().After("gorm:create").Register("tracing:after_create", endSpan),
+		callbacks.Query().Before("gorm:query").Register("tracing:before_query", startSpan("query")),
+		callbacks.Query().After("gorm:query").Register("tracing:after_query", endSpan),
+		callbacks.Update().Before("gorm:update").Register("tracing:before_update", startSpan("update")),
+		callbacks.Update().After("gorm:update").Register("tracing:after_update", endSpan),
+		callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", startSpan("delete")),
+		callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", endSpan),
+		callbacks.Row().Before("gorm:row").Register("tracing:before_row", startSpan("row")),
+		callbacks.Row().After("gorm:row").Register("tracing:after_row", endSpan),
+		callbacks.Raw().Before("gorm:raw").Register("tracing:before_raw", startSpan("raw")),
+		callbacks.Raw().After("gorm:raw").Register("tracing:after_raw", endSpan),
+	)
+}
+
+func startSpan(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+
+		ctx, span := Tracer().Start(ctx, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemSqlite,
+				semconv.DBOperation(operation),
+			))
+		db.Statement.Context = ctx
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+func endSpan(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+
+	// The SQL has placeholders rather than values, so it holds no user data
+	span.SetAttributes(
+		semconv.DBStatement(db.Statement.SQL.String()),
+		semconv.DBSQLTable(db.Statement.Table),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if db.Error != nil && db.Error != gorm.ErrRecordNotFound {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,109 @@
+// Package tracing sets up OpenTelemetry tracing: a span per HTTP request
+// (see middleware.Tracing) with child spans for its database queries (see
+// GormPlugin).
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer of this server's spans
+const instrumentation = "license-mnm"
+
+// Tracer returns the tracer for this server's spans
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Init installs the global tracer provider and W3C trace-context propagation.
+// Trace IDs are always generated, so logs and responses carry them; spans
+// are only exported when an exporter is configured. The returned function
+// flushes pending spans and must be called on shutdown.
+//
+//	OTEL_TRACES_EXPORTER  none (default), stdout, file or otlp
+//	OTEL_TRACES_FILE      file the file exporter appends to (default traces.json)
+//	OTEL_SERVICE_NAME     service name on the spans (default license-mnm)
+//
+// The otlp exporter sends over HTTP and reads the standard variables such as
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_HEADERS.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = instrumentation
+	}
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	}
+
+	var closeFile func() error
+	switch exporter := strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")); exporter {
+	case "", "none":
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		// Local exporters write each span at once, so none are lost when the server is killed
+		options = append(options, sdktrace.WithSyncer(exp))
+	case "file":
+		path := os.Getenv("OTEL_TRACES_FILE")
+		if path == "" {
+			path = "traces.json"
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		options = append(options, sdktrace.WithSyncer(exp))
+		closeFile = file.Close
+	case "otlp":
+		exp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exp))
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			if closeErr := closeFile(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// TraceID returns the ID of the trace ctx belongs to, or "" outside a trace
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
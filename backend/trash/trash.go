@@ -0,0 +1,198 @@
+// Package trash permanently removes soft-deleted customers and subscription
+// packs, on request or once they have been deleted for longer than the
+// retention period.
+package trash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"license-mnm/database"
+	"license-mnm/models"
+
+	"gorm.io/gorm"
+)
+
+// sweepInterval is how often deleted records past retention are purged
+const sweepInterval = time.Hour
+
+// ErrPackInUse is returned when purging a pack that subscriptions still
+// refer to; their history needs the pack
+var ErrPackInUse = errors.New("subscription pack has subscriptions")
+
+// ErrCustomerErased is returned when purging an erased customer; its
+// subscriptions and coupon redemptions are kept for accounting
+var ErrCustomerErased = errors.New("customer has been erased")
+
+var (
+	retention time.Duration
+
+	// stopping is canceled by Shutdown; a purge in progress is rolled back
+	stopping, stop = context.WithCancel(context.Background())
+	running        sync.WaitGroup
+)
+
+// Retention is how long deleted records are kept; 0 when they are kept
+// until purged by hand
+func Retention() time.Duration {
+	return retention
+}
+
+// Start purges records deleted longer than keep ago now and then every
+// hour. A zero keep disables automatic purging.
+func Start(keep time.Duration) {
+	retention = keep
+	if keep <= 0 {
+		return
+	}
+
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			customers, packs, err := Purge(stopping, time.Now().Add(-keep))
+			switch {
+			case errors.Is(err, context.Canceled):
+			case err != nil:
+				slog.Error("database error", "operation", "purge trash", "error", err)
+			case customers > 0 || packs > 0:
+				slog.Info("purged deleted records", "customers", customers, "packs", packs)
+			}
+
+			select {
+			case <-stopping.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops automatic purging and waits for a purge in progress to
+// roll back, or for ctx to end
+func Shutdown(ctx context.Context) error {
+	stop()
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Purge permanently removes customers and packs deleted before cutoff.
+// Erased customers, whose subscriptions are kept for accounting, and packs
+// that subscriptions still refer to stay in the trash.
+func Purge(ctx context.Context, cutoff time.Time) (customers, packs int, err error) {
+	db := database.DB.WithContext(ctx)
+
+	var customerIDs, packIDs []uint
+	if err := db.Model(&models.Customer{}).Where("deleted_at < ? AND erased_at IS NULL", cutoff).Order("id").Pluck("id", &customerIDs).Error; err != nil {
+		return 0, 0, err
+	}
+	for _, id := range customerIDs {
+		if err := PurgeCustomer(db, id); err != nil {
+			return customers, packs, fmt.Errorf("customer %d: %w", id, err)
+		}
+		customers++
+	}
+
+	if err := db.Model(&models.SubscriptionPack{}).Where("deleted_at < ?", cutoff).Order("id").Pluck("id", &packIDs).Error; err != nil {
+		return customers, 0, err
+	}
+	for _, id := range packIDs {
+		err := PurgePack(db, id)
+		if errors.Is(err, ErrPackInUse) {
+			continue
+		}
+		if err != nil {
+			return customers, packs, fmt.Errorf("pack %d: %w", id, err)
+		}
+		packs++
+	}
+	return customers, packs, nil
+}
+
+// PurgeCustomer permanently removes a customer with its subscriptions,
+// coupon redemptions, invitations, OAuth clients and member users, in one
+// transaction. Coupons keep counting the redemptions. It returns
+// ErrCustomerErased if the customer has been erased.
+func PurgeCustomer(db *gorm.DB, customerID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var customer models.Customer
+		if err := tx.Select("id", "user_id", "erased_at").First(&customer, customerID).Error; err != nil {
+			return err
+		}
+		if customer.ErasedAt != nil {
+			return ErrCustomerErased
+		}
+		var userIDs []uint
+		if err := tx.Model(&models.CustomerMember{}).Where("customer_id = ? AND user_id <> ?", customerID, customer.UserID).Pluck("user_id", &userIDs).Error; err != nil {
+			return err
+		}
+		userIDs = append(userIDs, customer.UserID)
+		callers := make([]string, len(userIDs))
+		for i, id := range userIDs {
+			callers[i] = fmt.Sprintf("user:%d", id)
+		}
+
+		for _, step := range []struct {
+			model any
+			where string
+			args  []any
+		}{
+			{&models.CouponRedemption{}, "customer_id = ?", []any{customerID}},
+			{&models.Subscription{}, "customer_id = ?", []any{customerID}},
+			{&models.CustomerInvitation{}, "customer_id = ?", []any{customerID}},
+			{&models.OAuthClient{}, "customer_id = ?", []any{customerID}},
+			{&models.CustomerMember{}, "customer_id = ?", []any{customerID}},
+			{&models.APIKey{}, "user_id IN ?", []any{userIDs}},
+			{&models.PasswordSetupToken{}, "user_id IN ?", []any{userIDs}},
+			{&models.MFARecoveryCode{}, "user_id IN ?", []any{userIDs}},
+			{&models.UserIdentity{}, "user_id IN ?", []any{userIDs}},
+			{&models.IdempotencyKey{}, "caller IN ?", []any{callers}},
+			{&models.Customer{}, "id = ?", []any{customerID}},
+			{&models.User{}, "id IN ? AND role = ?", []any{userIDs, "customer"}},
+		} {
+			if err := tx.Where(step.where, step.args...).Delete(step.model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PurgePack permanently removes a pack with its prices and price history.
+// It returns ErrPackInUse if subscriptions refer to the pack.
+func PurgePack(db *gorm.DB, packID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var subscriptions int64
+		if err := tx.Model(&models.Subscription{}).Where("pack_id = ?", packID).Count(&subscriptions).Error; err != nil {
+			return err
+		}
+		if subscriptions > 0 {
+			return ErrPackInUse
+		}
+
+		if err := tx.Exec("DELETE FROM coupon_packs WHERE subscription_pack_id = ?", packID).Error; err != nil {
+			return err
+		}
+		for _, model := range []any{&models.PackPrice{}, &models.PackPriceHistory{}} {
+			if err := tx.Where("pack_id = ?", packID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&models.SubscriptionPack{}, packID).Error
+	})
+}
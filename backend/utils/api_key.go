@@ -14,9 +14,13 @@ func GenerateAPIKey() (string, error) {
 	return "sk-sdk-" + hex.EncodeToString(bytes), nil
 }
 
+// apiKeyPrefixLength is how much of a key is shown to tell keys apart
+const apiKeyPrefixLength = 12
 
-
-
-
-
-
+// APIKeyPrefix returns the start of an API key, which is safe to show and log
+func APIKeyPrefix(apiKey string) string {
+	if len(apiKey) <= apiKeyPrefixLength {
+		return apiKey
+	}
+	return apiKey[:apiKeyPrefixLength]
+}
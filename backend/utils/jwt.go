@@ -13,9 +13,31 @@ type Claims struct {
 	UserID uint   `json:"user_id"`
 	Email  string `json:"email"`
 	Role   string `json:"role"`
+	// Purpose is set on tokens that are not user sessions: MFA login steps
+	// (see GenerateMFAToken) and OAuth client tokens (see GenerateClientToken).
+	// Such tokens are rejected by ValidateToken.
+	Purpose string `json:"purpose,omitempty"`
+	// Client is the login endpoint an MFA token was issued by: "admin", "customer" or "sdk"
+	Client string `json:"client,omitempty"`
+	// CustomerID and Scope are set on OAuth client tokens, whose subject is the client ID
+	CustomerID uint   `json:"customer_id,omitempty"`
+	Scope      string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// MFA token purposes
+const (
+	PurposeMFAChallenge = "mfa_challenge" // password accepted, TOTP or recovery code pending
+	PurposeMFASetup     = "mfa_setup"     // password accepted, 2FA is required but not yet enrolled
+	PurposeSDKAccess    = "sdk_access"    // OAuth client credentials access token for the SDK API
+)
+
+// ClientTokenTTL is the lifetime of OAuth client access tokens
+const ClientTokenTTL = time.Hour
+
+// mfaTokenTTL is how long the second login step may take
+const mfaTokenTTL = 5 * time.Minute
+
 // GenerateToken generates a JWT token
 func GenerateToken(userID uint, email, role string) (string, error) {
 	expirationTime := time.Now().Add(24 * time.Hour) // Token expires in 24 hours
@@ -34,8 +56,80 @@ func GenerateToken(userID uint, email, role string) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
+// GenerateMFAToken generates a short-lived token for the second step of a login
+func GenerateMFAToken(userID uint, email, role, purpose, client string) (string, error) {
+	claims := &Claims{
+		UserID:  userID,
+		Email:   email,
+		Role:    role,
+		Purpose: purpose,
+		Client:  client,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+// ValidateMFAToken validates a token issued by GenerateMFAToken; callers
+// check claims.Purpose
+func ValidateMFAToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != PurposeMFAChallenge && claims.Purpose != PurposeMFASetup {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	return claims, nil
+}
+
+// GenerateClientToken generates an access token for an OAuth client of a customer
+func GenerateClientToken(clientID string, customerID uint, scope string) (string, error) {
+	claims := &Claims{
+		Purpose:    PurposeSDKAccess,
+		CustomerID: customerID,
+		Scope:      scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   clientID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ClientTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+// ValidateClientToken validates a token issued by GenerateClientToken
+func ValidateClientToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != PurposeSDKAccess {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	return claims, nil
+}
+
 // ValidateToken validates a JWT token
 func ValidateToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	return claims, nil
+}
+
+// parseToken verifies a token's signature and expiry and returns its claims
+func parseToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"math"
+	"os"
+	"strings"
+)
+
+// currencyExponents lists ISO 4217 currencies whose minor unit is not 1/100
+var currencyExponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0,
+	"XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+// NormalizeCurrency upper-cases and trims an ISO 4217 currency code
+func NormalizeCurrency(currency string) string {
+	return strings.ToUpper(strings.TrimSpace(currency))
+}
+
+// DefaultCurrency returns the currency used when a request doesn't name one
+func DefaultCurrency() string {
+	if currency := NormalizeCurrency(os.Getenv("DEFAULT_CURRENCY")); currency != "" {
+		return currency
+	}
+	return "USD"
+}
+
+// CurrencyExponent returns the number of decimal places of a currency's minor unit
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[NormalizeCurrency(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// ToMinorUnits converts a major-unit amount (e.g. 29.99 USD) to minor units (2999)
+func ToMinorUnits(amount float64, currency string) int64 {
+	return int64(math.Round(amount * math.Pow10(CurrencyExponent(currency))))
+}
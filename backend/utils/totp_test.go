@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the RFC 6238 SHA-1 test key "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The RFC lists 8-digit values; these are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	key, _ := totpEncoding.DecodeString(rfcSecret)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	codeAt := func(step int64) string { return totpCode(key, step) }
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfcSecret, codeAt(current), 0, current, true},
+		{"previous step within skew", rfcSecret, codeAt(current - 1), 0, current - 1, true},
+		{"next step within skew", rfcSecret, codeAt(current + 1), 0, current + 1, true},
+		{"two steps old", rfcSecret, codeAt(current - 2), 0, 0, false},
+		{"two steps ahead", rfcSecret, codeAt(current + 2), 0, 0, false},
+		{"replayed code", rfcSecret, codeAt(current), current, 0, false},
+		{"older code after a newer one", rfcSecret, codeAt(current - 1), current, 0, false},
+		{"newer code after an older one", rfcSecret, codeAt(current), current - 1, current, true},
+		{"spaces are ignored", rfcSecret, " " + codeAt(current)[:3] + " " + codeAt(current)[3:], 0, current, true},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", codeAt(current), 0, current, true},
+		{"wrong code", rfcSecret, "000000", 0, 0, false},
+		{"too short", rfcSecret, codeAt(current)[:5], 0, 0, false},
+		{"invalid secret", "not base32!", codeAt(current), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(tt.secret, tt.code, tt.lastStep, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("ValidateTOTP() = %d, %v; want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("recovery code %q is not formatted like xxxxx-xxxxx", code)
+		}
+	}
+
+	tests := map[string]string{
+		"k3j7d-4fq2m":   "k3j7d4fq2m",
+		" K3J7D 4FQ2M ": "k3j7d4fq2m",
+		"k3j7d4fq2m":    "k3j7d4fq2m",
+	}
+	for input, want := range tests {
+		if got := NormalizeRecoveryCode(input); got != want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", input, got, want)
+		}
+	}
+}